@@ -1,12 +1,16 @@
 package backend
 
 import (
+	"context"
 	"fmt"
+	"math/rand/v2"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/cloudresty/emit"
+	"github.com/cloudresty/nautiluslb/config"
 )
 
 // BackendServer represents a backend server.
@@ -16,84 +20,206 @@ type BackendServer struct {
 	Port              int    `json:"port"`
 	PortName          string `json:"port_name"`
 	Weight            int
-	ActiveConnections int
+	ActiveConnections int64 // Accessed atomically, see AcquireConnection
 	Healthy           bool
 	PreviousHealthy   bool // Track previous health status
+
+	// HealthCheckOverride holds health check settings set on the Kubernetes
+	// service, nil to use the settings of the configuration.
+	HealthCheckOverride *config.HealthCheckConfig
+
+	// Settings set on the Kubernetes service through annotations. Zero values
+	// leave the setting to the configuration.
+	Strategy       string        // Load balancing strategy
+	IdleTimeout    time.Duration // Closes sessions without traffic in either direction
+	ProxyProtocol  string        // PROXY protocol version sent to the backend
+	MaxConnections int           // Upper bound of active connections
 }
 
-// HealthCheck checks the health of a backend server.
-func (server *BackendServer) HealthCheck(interval time.Duration) {
+// MaxWeight is the largest weight a backend can be given. The cost of the
+// consistent hash ring grows with the weights.
+const MaxWeight = 1000
 
-	var lastCheck time.Time
+// Address returns the host:port address of the backend server.
+func (server *BackendServer) Address() string {
 
-	failureCounter := 0
-	retryLimit := 3
-	connectionTimeout := 2 * time.Second
+	return net.JoinHostPort(server.IP, fmt.Sprintf("%d", server.Port))
 
-	for {
+}
+
+// probeAddress returns the host:port address that health checks with settings
+// probe, which is the backend address unless settings name another port.
+func (server *BackendServer) probeAddress(settings config.HealthCheckConfig) string {
+
+	if settings.Port > 0 {
+		return net.JoinHostPort(server.IP, fmt.Sprintf("%d", settings.Port))
+	}
+
+	return server.Address()
+
+}
+
+// AcquireConnection records a new connection to the backend server and
+// returns the resulting number of active connections.
+func (server *BackendServer) AcquireConnection() int64 {
+
+	return atomic.AddInt64(&server.ActiveConnections, 1)
+
+}
+
+// ReleaseConnection records that a connection to the backend server has closed.
+func (server *BackendServer) ReleaseConnection() {
+
+	atomic.AddInt64(&server.ActiveConnections, -1)
 
-		// Calculate elapsed time since last check
-		elapsed := time.Since(lastCheck)
-		sleepDuration := interval - elapsed
-		time.Sleep(sleepDuration)
-		conn, err := net.DialTimeout("tcp", net.JoinHostPort(server.IP, fmt.Sprintf("%d", server.Port)), connectionTimeout)
+}
+
+// Connections returns the number of active connections to the backend server.
+func (server *BackendServer) Connections() int64 {
+
+	return atomic.LoadInt64(&server.ActiveConnections)
+
+}
+
+// HealthCheck probes the backend server until ctx is cancelled. It starts from
+// the given health status and calls onChange whenever the unhealthy or healthy
+// threshold flips it. The server itself is not modified, as discovery replaces
+// backend objects while the check keeps running for their address.
+func (server *BackendServer) HealthCheck(ctx context.Context, settings config.HealthCheckConfig, healthy bool, onChange func(healthy bool)) {
+
+	interval := settings.GetInterval()
+
+	probe, err := NewProbe(settings)
+	if err != nil {
+		emit.Error.StructuredFields("Invalid health check, falling back to TCP",
+			emit.ZString("backend_ip", server.IP),
+			emit.ZInt("backend_port", server.Port),
+			emit.ZString("error", err.Error()))
+		probe = tcpProbe{}
+	}
+
+	// Start after a random part of the jitter so backends discovered together
+	// are not all probed in the same instant
+	if !sleepContext(ctx, initialProbeDelay(interval, settings.GetJitter())) {
+		return
+	}
+
+	counters := healthCounters{healthy: healthy}
 
-		healthChanged := false
-		if err != nil {
+	for {
 
-			failureCounter++
+		err := probe.Check(server.probeAddress(settings), settings.GetTimeout())
+		if ctx.Err() != nil {
+			return
+		}
 
-			emit.Warn.StructuredFields("Backend health check failed",
+		if server.recordProbe(err, settings, &counters) {
+			emit.Debug.StructuredFields("Backend health status",
 				emit.ZString("backend_ip", server.IP),
 				emit.ZInt("backend_port", server.Port),
-				emit.ZInt("attempt", failureCounter),
-				emit.ZString("error", err.Error()))
-
-			if failureCounter >= retryLimit && server.Healthy { // Require 3 consecutive failures
-				server.Healthy = false
-				healthChanged = true
-				emit.Error.StructuredFields("Backend marked as unhealthy",
-					emit.ZString("backend_ip", server.IP),
-					emit.ZInt("backend_port", server.Port),
-					emit.ZString("reason", "3 consecutive failures"))
-			}
-
-		} else {
-
-			failureCounter = 0 // Reset failure count on success
-
-			if !server.Healthy {
-				server.Healthy = true
-				healthChanged = true
-				emit.Info.StructuredFields("Backend recovered to healthy",
-					emit.ZString("backend_ip", server.IP),
-					emit.ZInt("backend_port", server.Port))
-			}
-
-			// Close the connection only if it was successfully created
-			if err := conn.Close(); err != nil {
-				// Only log if it's not an expected "already closed" error
-				if !isConnectionClosedError(err) {
-					emit.Warn.StructuredFields("Failed to close health check connection",
-						emit.ZString("backend_ip", server.IP),
-						emit.ZInt("backend_port", server.Port),
-						emit.ZString("error", err.Error()))
-				}
-			}
+				emit.ZBool("healthy", counters.healthy))
+			onChange(counters.healthy)
+		}
 
+		if !sleepContext(ctx, nextProbeDelay(interval, settings.GetJitter())) {
+			return
 		}
 
-		if healthChanged {
-			emit.Debug.StructuredFields("Backend health status",
+	}
+
+}
+
+// sleepContext waits for d and returns false if ctx got cancelled first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+
+}
+
+// healthCounters holds the consecutive probe results and the resulting
+// health status of a health check.
+type healthCounters struct {
+	failures  int
+	successes int
+	healthy   bool
+}
+
+// recordProbe applies a probe result to the counters, flipping the health
+// status once the unhealthy or healthy threshold of consecutive results is
+// reached. It returns true when the health status changed.
+func (server *BackendServer) recordProbe(err error, settings config.HealthCheckConfig, counters *healthCounters) bool {
+
+	if err != nil {
+
+		counters.failures++
+		counters.successes = 0
+
+		emit.Warn.StructuredFields("Backend health check failed",
+			emit.ZString("backend_ip", server.IP),
+			emit.ZInt("backend_port", server.Port),
+			emit.ZInt("attempt", counters.failures),
+			emit.ZString("error", err.Error()))
+
+		if counters.failures >= settings.GetUnhealthyThreshold() && counters.healthy {
+			counters.healthy = false
+			emit.Error.StructuredFields("Backend marked as unhealthy",
 				emit.ZString("backend_ip", server.IP),
 				emit.ZInt("backend_port", server.Port),
-				emit.ZString("status", server.healthStatus()))
+				emit.ZString("reason", fmt.Sprintf("%d consecutive failures", counters.failures)))
+			return true
 		}
 
-		lastCheck = time.Now()
+		return false
 
 	}
 
+	counters.failures = 0 // Reset failure count on success
+	counters.successes++
+
+	if counters.successes >= settings.GetHealthyThreshold() && !counters.healthy {
+		counters.healthy = true
+		emit.Info.StructuredFields("Backend recovered to healthy",
+			emit.ZString("backend_ip", server.IP),
+			emit.ZInt("backend_port", server.Port),
+			emit.ZInt("consecutive_successes", counters.successes))
+		return true
+	}
+
+	return false
+
+}
+
+// initialProbeDelay returns a random delay of up to jitter percent of the
+// interval, zero without jitter.
+func initialProbeDelay(interval time.Duration, jitter int) time.Duration {
+
+	spread := int64(interval) * int64(jitter) / 100
+	if spread <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int64N(spread + 1))
+
+}
+
+// nextProbeDelay returns the interval spread randomly by up to jitter percent in either direction.
+func nextProbeDelay(interval time.Duration, jitter int) time.Duration {
+
+	spread := int64(interval) * int64(jitter) / 100
+	if spread <= 0 {
+		return interval
+	}
+
+	return interval + time.Duration(rand.Int64N(2*spread+1)-spread)
+
 }
 
 func (server *BackendServer) healthStatus() string {
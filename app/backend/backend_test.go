@@ -1,13 +1,16 @@
 package backend
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/cloudresty/emit"
+	"github.com/cloudresty/nautiluslb/config"
 )
 
 func TestBackendServerCreation(t *testing.T) {
@@ -145,6 +148,18 @@ func TestBackendServerHealthCheckWithMockServer(t *testing.T) {
 	}
 }
 
+func TestBackendServerProbeAddress(t *testing.T) {
+	server := &BackendServer{IP: "10.0.0.1", Port: 30080}
+
+	if got := server.probeAddress(config.HealthCheckConfig{}); got != "10.0.0.1:30080" {
+		t.Errorf("probeAddress() = %s; want 10.0.0.1:30080", got)
+	}
+
+	if got := server.probeAddress(config.HealthCheckConfig{Port: 32000}); got != "10.0.0.1:32000" {
+		t.Errorf("probeAddress() = %s; want 10.0.0.1:32000", got)
+	}
+}
+
 func TestBackendServerDefaultValues(t *testing.T) {
 	server := &BackendServer{}
 
@@ -185,3 +200,135 @@ func TestBackendServerConnectionManagement(t *testing.T) {
 		t.Errorf("Expected ActiveConnections %d, got %d", originalCount, server.ActiveConnections)
 	}
 }
+
+func TestBackendServerConnectionCounterConcurrent(t *testing.T) {
+	server := &BackendServer{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.AcquireConnection()
+			server.ReleaseConnection()
+			server.AcquireConnection()
+		}()
+	}
+	wg.Wait()
+
+	if got := server.Connections(); got != 100 {
+		t.Errorf("Expected 100 active connections, got %d", got)
+	}
+}
+
+func TestBackendServerRecordProbeThresholds(t *testing.T) {
+	settings := config.HealthCheckConfig{
+		UnhealthyThreshold: 3,
+		HealthyThreshold:   2,
+	}
+
+	server := &BackendServer{IP: "192.168.1.1", Port: 8080}
+	counters := &healthCounters{healthy: true}
+	probeErr := fmt.Errorf("connection refused")
+
+	// Two failures are not enough to mark the backend unhealthy
+	for i := 0; i < 2; i++ {
+		if server.recordProbe(probeErr, settings, counters) {
+			t.Fatalf("Health changed after %d failures", i+1)
+		}
+	}
+
+	if !server.recordProbe(probeErr, settings, counters) || counters.healthy {
+		t.Fatal("Backend should be unhealthy after 3 consecutive failures")
+	}
+
+	// A single success must not flip it back with a healthy threshold of 2
+	if server.recordProbe(nil, settings, counters) || counters.healthy {
+		t.Fatal("Backend should stay unhealthy after a single success")
+	}
+
+	// A failure in between resets the success streak
+	server.recordProbe(probeErr, settings, counters)
+	server.recordProbe(nil, settings, counters)
+	if counters.healthy {
+		t.Fatal("Backend should stay unhealthy when successes are not consecutive")
+	}
+
+	if !server.recordProbe(nil, settings, counters) || !counters.healthy {
+		t.Error("Backend should be healthy after 2 consecutive successes")
+	}
+}
+
+func TestHealthCheckStopsOnCancel(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create test listener: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	if err := listener.Close(); err != nil {
+		t.Fatalf("Failed to close test listener: %v", err)
+	}
+
+	server := &BackendServer{IP: "127.0.0.1", Port: port, Healthy: true}
+	settings := config.HealthCheckConfig{Interval: 1, Timeout: 1, UnhealthyThreshold: 1}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := make(chan bool, 1)
+	done := make(chan struct{})
+
+	go func() {
+		server.HealthCheck(ctx, settings, true, func(healthy bool) { changes <- healthy })
+		close(done)
+	}()
+
+	select {
+	case healthy := <-changes:
+		if healthy {
+			t.Error("A closed port should be reported unhealthy")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No health change reported")
+	}
+
+	if !server.Healthy {
+		t.Error("HealthCheck should report through onChange instead of modifying the server")
+	}
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("HealthCheck did not return after the context was cancelled")
+	}
+}
+
+func TestNextProbeDelay(t *testing.T) {
+	interval := 10 * time.Second
+
+	for i := 0; i < 100; i++ {
+		delay := nextProbeDelay(interval, 20)
+		if delay < 8*time.Second || delay > 12*time.Second {
+			t.Fatalf("Delay %v outside of the 20%% jitter range", delay)
+		}
+	}
+
+	if delay := nextProbeDelay(interval, 0); delay != interval {
+		t.Errorf("Expected no jitter, got %v", delay)
+	}
+}
+
+func TestInitialProbeDelay(t *testing.T) {
+	interval := 10 * time.Second
+
+	for i := 0; i < 100; i++ {
+		delay := initialProbeDelay(interval, 20)
+		if delay < 0 || delay > 2*time.Second {
+			t.Fatalf("Delay %v outside of the 20%% jitter range", delay)
+		}
+	}
+
+	if delay := initialProbeDelay(interval, 0); delay != 0 {
+		t.Errorf("Expected no initial delay without jitter, got %v", delay)
+	}
+}
@@ -0,0 +1,89 @@
+package backend
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cloudresty/emit"
+	"github.com/cloudresty/nautiluslb/config"
+)
+
+// Probe checks the health of a backend address once.
+type Probe interface {
+	Check(address string, timeout time.Duration) error
+}
+
+// NewProbe returns the probe for the configured health check type.
+// Every connection of the probe starts with a PROXY protocol header when
+// settings name the version the backend expects.
+func NewProbe(settings config.HealthCheckConfig) (Probe, error) {
+
+	dialer := probeDialer{proxyHeader: proxyLocalHeader(settings.ProxyProtocol)}
+
+	switch settings.GetType() {
+	case config.HealthCheckTCP:
+		return tcpProbe{dialer}, nil
+	case config.HealthCheckHTTP:
+		return newHTTPProbe(settings.HTTP, false, dialer)
+	case config.HealthCheckHTTPS:
+		return newHTTPProbe(settings.HTTP, true, dialer)
+	case config.HealthCheckRedis:
+		return redisProbe{dialer}, nil
+	case config.HealthCheckMongoDB:
+		return mongoDBProbe{dialer}, nil
+	case config.HealthCheckAMQP:
+		return amqpProbe{dialer}, nil
+	case config.HealthCheckMySQL:
+		return mysqlProbe{dialer}, nil
+	case config.HealthCheckPostgres:
+		return postgresProbe{dialer}, nil
+	case config.HealthCheckSendExpect:
+		return newSendExpectProbe(settings.SendExpect, dialer)
+	default:
+		return nil, fmt.Errorf("unknown health check type '%s'", settings.Type)
+	}
+
+}
+
+// proxyLocalHeader returns the PROXY protocol header of the given version
+// that starts the connections of probes, or nil for no header. Probes are not
+// proxied for a client, so the header carries no addresses: the UNKNOWN
+// protocol of v1 and the LOCAL command of v2 tell the backend to use those of
+// the connection.
+func proxyLocalHeader(version string) []byte {
+
+	switch version {
+	case config.ProxyProtocolV1:
+		return []byte("PROXY UNKNOWN\r\n")
+	case config.ProxyProtocolV2:
+		// Signature, then version 2 LOCAL command, unspecified family and no payload
+		return append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x20, 0x00, 0x00, 0x00)
+	default:
+		return nil
+	}
+
+}
+
+// tcpProbe considers a backend healthy when it accepts a TCP connection.
+type tcpProbe struct{ probeDialer }
+
+func (p tcpProbe) Check(address string, timeout time.Duration) error {
+
+	conn, err := p.dial(address, timeout)
+	if err != nil {
+		return err
+	}
+
+	// Close the connection only if it was successfully created
+	if err := conn.Close(); err != nil {
+		// Only log if it's not an expected "already closed" error
+		if !isConnectionClosedError(err) {
+			emit.Warn.StructuredFields("Failed to close health check connection",
+				emit.ZString("backend_address", address),
+				emit.ZString("error", err.Error()))
+		}
+	}
+
+	return nil
+
+}
@@ -0,0 +1,132 @@
+package backend
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cloudresty/nautiluslb/config"
+)
+
+// maxHealthCheckBodySize limits how much of a response body is read for matching.
+const maxHealthCheckBodySize = 64 * 1024
+
+// httpProbe considers a backend healthy when it answers an HTTP request with
+// an expected status code and, optionally, a body matching a substring or regex.
+type httpProbe struct {
+	settings  config.HTTPHealthCheckConfig
+	scheme    string
+	minStatus int
+	maxStatus int
+	bodyRegex *regexp.Regexp
+	client    *http.Client
+}
+
+// newHTTPProbe creates an HTTP probe, using TLS when secure is set and dialing
+// with dialer.
+func newHTTPProbe(settings config.HTTPHealthCheckConfig, secure bool, dialer probeDialer) (*httpProbe, error) {
+
+	minStatus, maxStatus, err := settings.GetExpectedStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	probe := &httpProbe{
+		settings:  settings,
+		scheme:    "http",
+		minStatus: minStatus,
+		maxStatus: maxStatus,
+	}
+
+	if settings.BodyRegex != "" {
+		probe.bodyRegex, err = regexp.Compile(settings.BodyRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid body regex: %v", err)
+		}
+	}
+
+	transport := &http.Transport{
+		DialContext:       dialer.dialContext,
+		DisableKeepAlives: true,
+	}
+
+	if secure {
+		probe.scheme = "https"
+
+		serverName := settings.ServerName
+		if serverName == "" {
+			serverName = settings.Host
+		}
+
+		transport.TLSClientConfig = &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: settings.InsecureSkipVerify,
+		}
+	}
+
+	probe.client = &http.Client{
+		Transport: transport,
+		// Report redirects as they are instead of following them
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return probe, nil
+
+}
+
+func (p *httpProbe) Check(address string, timeout time.Duration) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	url := fmt.Sprintf("%s://%s%s", p.scheme, address, p.settings.GetPath())
+
+	req, err := http.NewRequestWithContext(ctx, p.settings.GetMethod(), url, nil)
+	if err != nil {
+		return err
+	}
+
+	if p.settings.Host != "" {
+		req.Host = p.settings.Host
+	}
+	req.Header.Set("User-Agent", "NautilusLB-HealthCheck")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode < p.minStatus || resp.StatusCode > p.maxStatus {
+		return fmt.Errorf("unexpected status %d, expected %d-%d", resp.StatusCode, p.minStatus, p.maxStatus)
+	}
+
+	if p.settings.BodyContains == "" && p.bodyRegex == nil {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthCheckBodySize))
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %v", err)
+	}
+
+	if p.settings.BodyContains != "" && !strings.Contains(string(body), p.settings.BodyContains) {
+		return fmt.Errorf("response body does not contain '%s'", p.settings.BodyContains)
+	}
+
+	if p.bodyRegex != nil && !p.bodyRegex.Match(body) {
+		return fmt.Errorf("response body does not match '%s'", p.settings.BodyRegex)
+	}
+
+	return nil
+
+}
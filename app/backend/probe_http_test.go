@@ -0,0 +1,118 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudresty/nautiluslb/config"
+)
+
+func newHealthServer(t *testing.T, tls bool) *httptest.Server {
+	t.Helper()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			_, _ = fmt.Fprint(w, "status: ok")
+		case "/host":
+			_, _ = fmt.Fprint(w, r.Host)
+		case "/method":
+			_, _ = fmt.Fprint(w, r.Method)
+		case "/redirect":
+			http.Redirect(w, r, "/healthz", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+
+	var server *httptest.Server
+	if tls {
+		server = httptest.NewTLSServer(handler)
+	} else {
+		server = httptest.NewServer(handler)
+	}
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestHTTPProbe(t *testing.T) {
+	server := newHealthServer(t, false)
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	tests := []struct {
+		name     string
+		settings config.HTTPHealthCheckConfig
+		wantErr  bool
+	}{
+		{"Healthy path", config.HTTPHealthCheckConfig{Path: "/healthz"}, false},
+		{"Service unavailable", config.HTTPHealthCheckConfig{Path: "/"}, true},
+		{"Exact status", config.HTTPHealthCheckConfig{Path: "/healthz", ExpectedStatus: "200"}, false},
+		{"Status outside range", config.HTTPHealthCheckConfig{Path: "/healthz", ExpectedStatus: "204"}, true},
+		{"Accept the 503", config.HTTPHealthCheckConfig{Path: "/", ExpectedStatus: "503"}, false},
+		{"Redirect is not followed", config.HTTPHealthCheckConfig{Path: "/redirect", ExpectedStatus: "302"}, false},
+		{"Body contains", config.HTTPHealthCheckConfig{Path: "/healthz", BodyContains: "ok"}, false},
+		{"Body does not contain", config.HTTPHealthCheckConfig{Path: "/healthz", BodyContains: "degraded"}, true},
+		{"Body regex", config.HTTPHealthCheckConfig{Path: "/healthz", BodyRegex: `^status: (ok|green)$`}, false},
+		{"Body regex mismatch", config.HTTPHealthCheckConfig{Path: "/healthz", BodyRegex: `^green$`}, true},
+		{"Host header", config.HTTPHealthCheckConfig{Path: "/host", Host: "app.example.com", BodyContains: "app.example.com"}, false},
+		{"Method", config.HTTPHealthCheckConfig{Path: "/method", Method: "post", BodyContains: "POST"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			probe, err := newHTTPProbe(tt.settings, false, probeDialer{})
+			if err != nil {
+				t.Fatalf("newHTTPProbe() failed: %v", err)
+			}
+
+			err = probe.Check(address, 2*time.Second)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Check() error = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHTTPSProbe(t *testing.T) {
+	server := newHealthServer(t, true)
+	address := strings.TrimPrefix(server.URL, "https://")
+
+	// The test certificate is self-signed, so verification must fail unless skipped
+	probe, err := newHTTPProbe(config.HTTPHealthCheckConfig{Path: "/healthz"}, true, probeDialer{})
+	if err != nil {
+		t.Fatalf("newHTTPProbe() failed: %v", err)
+	}
+
+	if err := probe.Check(address, 2*time.Second); err == nil {
+		t.Error("Expected certificate verification to fail")
+	}
+
+	probe, err = newHTTPProbe(config.HTTPHealthCheckConfig{Path: "/healthz", InsecureSkipVerify: true, ServerName: "example.com"}, true, probeDialer{})
+	if err != nil {
+		t.Fatalf("newHTTPProbe() failed: %v", err)
+	}
+
+	if err := probe.Check(address, 2*time.Second); err != nil {
+		t.Errorf("Expected probe to succeed with verification skipped: %v", err)
+	}
+}
+
+func TestHTTPProbeConnectionRefused(t *testing.T) {
+	server := newHealthServer(t, false)
+	address := strings.TrimPrefix(server.URL, "http://")
+	server.Close()
+
+	probe, err := newHTTPProbe(config.HTTPHealthCheckConfig{}, false, probeDialer{})
+	if err != nil {
+		t.Fatalf("newHTTPProbe() failed: %v", err)
+	}
+
+	if err := probe.Check(address, time.Second); err == nil {
+		t.Error("Expected probe to fail against a closed server")
+	}
+}
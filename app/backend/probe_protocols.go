@@ -0,0 +1,565 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"time"
+)
+
+// probeDialer opens the connections of a probe. Backends that expect the
+// PROXY protocol get proxyHeader first, see proxyLocalHeader.
+type probeDialer struct {
+	proxyHeader []byte
+}
+
+// dial connects to address and bounds the whole exchange by timeout.
+func (d probeDialer) dial(address string, timeout time.Duration) (net.Conn, error) {
+
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	if err := d.writeProxyHeader(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+
+}
+
+// dialContext connects to address like net.Dialer.DialContext, for probes
+// whose client dials for them.
+func (d probeDialer) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.writeProxyHeader(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+
+}
+
+// writeProxyHeader starts conn with the PROXY protocol header, if any.
+func (d probeDialer) writeProxyHeader(conn net.Conn) error {
+
+	if len(d.proxyHeader) == 0 {
+		return nil
+	}
+
+	if _, err := conn.Write(d.proxyHeader); err != nil {
+		return fmt.Errorf("failed to send PROXY protocol header: %v", err)
+	}
+
+	return nil
+
+}
+
+// redisProbe sends PING and expects PONG. A server that requires
+// authentication answers NOAUTH, which still proves it is serving, while a
+// server that is still loading its dataset answers LOADING and fails.
+type redisProbe struct{ probeDialer }
+
+func (p redisProbe) Check(address string, timeout time.Duration) error {
+
+	conn, err := p.dial(address, timeout)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	if _, err := conn.Write([]byte("*1\r\n$4\r\nPING\r\n")); err != nil {
+		return err
+	}
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read PING reply: %v", err)
+	}
+
+	line = strings.TrimRight(line, "\r\n")
+
+	switch {
+	case line == "+PONG":
+		return nil
+	case strings.HasPrefix(line, "-NOAUTH"):
+		return nil
+	default:
+		return fmt.Errorf("unexpected PING reply '%s'", line)
+	}
+
+}
+
+// MongoDB wire protocol constants.
+const (
+	mongoOpMsg        = 2013
+	mongoHeaderLength = 16
+	mongoMaxMessage   = 16 * 1024 * 1024
+
+	mongoCommandNotFound = 59 // Error code of commands the server does not know
+)
+
+// mongoDBProbe sends a hello command in an OP_MSG and expects ok: 1. Servers
+// that predate hello (before 4.4.2, 4.2.10, 4.0.21 and 3.6.21) answer with
+// CommandNotFound and are asked the legacy isMaster command instead. OP_MSG
+// itself requires MongoDB 3.6 or later.
+type mongoDBProbe struct{ probeDialer }
+
+func (p mongoDBProbe) Check(address string, timeout time.Duration) error {
+
+	conn, err := p.dial(address, timeout)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	command := "hello"
+	reply, err := mongoCommand(conn, command)
+	if err != nil {
+		return err
+	}
+
+	ok, err := bsonOK(reply)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		if code, found, _ := bsonNumber(reply, "code"); found && code == mongoCommandNotFound {
+			command = "isMaster"
+			if reply, err = mongoCommand(conn, command); err != nil {
+				return err
+			}
+			if ok, err = bsonOK(reply); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !ok {
+		return fmt.Errorf("%s command did not return ok", command)
+	}
+
+	return nil
+
+}
+
+// mongoCommand runs command against the admin database over conn and returns
+// the BSON document of the reply.
+func mongoCommand(conn net.Conn, command string) ([]byte, error) {
+
+	if _, err := conn.Write(mongoCommandMessage(command)); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, mongoHeaderLength)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, fmt.Errorf("failed to read %s reply: %v", command, err)
+	}
+
+	length := int(binary.LittleEndian.Uint32(header[0:4]))
+	opCode := binary.LittleEndian.Uint32(header[12:16])
+
+	if opCode != mongoOpMsg {
+		return nil, fmt.Errorf("unexpected reply opcode %d", opCode)
+	}
+
+	if length <= mongoHeaderLength+5 || length > mongoMaxMessage {
+		return nil, fmt.Errorf("invalid reply length %d", length)
+	}
+
+	body := make([]byte, length-mongoHeaderLength)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return nil, fmt.Errorf("failed to read %s reply: %v", command, err)
+	}
+
+	// Skip the flag bits and expect a single body section (kind 0)
+	if body[4] != 0 {
+		return nil, fmt.Errorf("unexpected section kind %d", body[4])
+	}
+
+	return body[5:], nil
+
+}
+
+// mongoCommandMessage builds an OP_MSG carrying {<command>: 1, $db: "admin"}.
+func mongoCommandMessage(command string) []byte {
+
+	var doc bytes.Buffer
+
+	doc.WriteByte(0x10) // int32
+	doc.WriteString(command + "\x00")
+	_ = binary.Write(&doc, binary.LittleEndian, int32(1))
+
+	doc.WriteByte(0x02) // string
+	doc.WriteString("$db\x00")
+	_ = binary.Write(&doc, binary.LittleEndian, int32(len("admin")+1))
+	doc.WriteString("admin\x00")
+
+	doc.WriteByte(0x00)
+
+	document := make([]byte, 4, 4+doc.Len())
+	binary.LittleEndian.PutUint32(document, uint32(4+doc.Len()))
+	document = append(document, doc.Bytes()...)
+
+	length := mongoHeaderLength + 4 + 1 + len(document)
+
+	message := make([]byte, mongoHeaderLength+5, length)
+	binary.LittleEndian.PutUint32(message[0:4], uint32(length))
+	binary.LittleEndian.PutUint32(message[4:8], 1) // requestID
+	binary.LittleEndian.PutUint32(message[8:12], 0)
+	binary.LittleEndian.PutUint32(message[12:16], mongoOpMsg)
+	binary.LittleEndian.PutUint32(message[16:20], 0) // flagBits
+	message[20] = 0                                  // body section
+
+	return append(message, document...)
+
+}
+
+// bsonOK reports whether the "ok" field of a BSON document is 1.
+func bsonOK(doc []byte) (bool, error) {
+
+	value, found, err := bsonNumber(doc, "ok")
+	if err != nil {
+		return false, err
+	}
+
+	if !found {
+		return false, fmt.Errorf("reply has no ok field")
+	}
+
+	return value == 1, nil
+
+}
+
+// bsonNumber walks the top-level elements of a BSON document and returns the
+// value of the numeric field name, and whether the document has that field.
+func bsonNumber(doc []byte, name string) (float64, bool, error) {
+
+	if len(doc) < 5 {
+		return 0, false, fmt.Errorf("truncated BSON document")
+	}
+
+	size := int(binary.LittleEndian.Uint32(doc[0:4]))
+	if size > len(doc) || size < 5 {
+		return 0, false, fmt.Errorf("invalid BSON document size %d", size)
+	}
+
+	pos := 4
+	for pos < size-1 {
+
+		elementType := doc[pos]
+		pos++
+
+		end := bytes.IndexByte(doc[pos:size], 0)
+		if end < 0 {
+			return 0, false, fmt.Errorf("truncated BSON element name")
+		}
+		elementName := string(doc[pos : pos+end])
+		pos += end + 1
+
+		valueSize, err := bsonValueSize(elementType, doc[pos:size])
+		if err != nil {
+			return 0, false, err
+		}
+
+		if elementName == name {
+			value := doc[pos : pos+valueSize]
+			switch elementType {
+			case 0x01:
+				return math.Float64frombits(binary.LittleEndian.Uint64(value)), true, nil
+			case 0x10:
+				return float64(int32(binary.LittleEndian.Uint32(value))), true, nil
+			case 0x12:
+				return float64(int64(binary.LittleEndian.Uint64(value))), true, nil
+			default:
+				return 0, false, fmt.Errorf("unexpected BSON type %d for %s", elementType, name)
+			}
+		}
+
+		pos += valueSize
+
+	}
+
+	return 0, false, nil
+
+}
+
+// bsonValueSize returns the encoded size of a BSON value of the given type.
+func bsonValueSize(elementType byte, data []byte) (int, error) {
+
+	var size int
+
+	switch elementType {
+	case 0x0A, 0x06, 0xFF, 0x7F: // null, undefined, min key, max key
+		size = 0
+	case 0x08: // boolean
+		size = 1
+	case 0x10: // int32
+		size = 4
+	case 0x01, 0x09, 0x11, 0x12: // double, datetime, timestamp, int64
+		size = 8
+	case 0x07: // object id
+		size = 12
+	case 0x13: // decimal128
+		size = 16
+	case 0x02, 0x0D, 0x0E: // string, javascript, symbol
+		if len(data) < 4 {
+			return 0, fmt.Errorf("truncated BSON string")
+		}
+		size = 4 + int(binary.LittleEndian.Uint32(data[0:4]))
+	case 0x03, 0x04, 0x0F: // document, array, code with scope
+		if len(data) < 4 {
+			return 0, fmt.Errorf("truncated BSON document")
+		}
+		size = int(binary.LittleEndian.Uint32(data[0:4]))
+	case 0x05: // binary
+		if len(data) < 4 {
+			return 0, fmt.Errorf("truncated BSON binary")
+		}
+		size = 5 + int(binary.LittleEndian.Uint32(data[0:4]))
+	case 0x0B: // regex, two cstrings
+		first := bytes.IndexByte(data, 0)
+		if first < 0 {
+			return 0, fmt.Errorf("truncated BSON regex")
+		}
+		second := bytes.IndexByte(data[first+1:], 0)
+		if second < 0 {
+			return 0, fmt.Errorf("truncated BSON regex")
+		}
+		size = first + second + 2
+	default:
+		return 0, fmt.Errorf("unsupported BSON type %d", elementType)
+	}
+
+	if size < 0 || size > len(data) {
+		return 0, fmt.Errorf("truncated BSON value")
+	}
+
+	return size, nil
+
+}
+
+// amqpProbe sends the AMQP 0-9-1 protocol header and expects the
+// Connection.Start method frame in return.
+type amqpProbe struct{ probeDialer }
+
+func (p amqpProbe) Check(address string, timeout time.Duration) error {
+
+	conn, err := p.dial(address, timeout)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	if _, err := conn.Write([]byte("AMQP\x00\x00\x09\x01")); err != nil {
+		return err
+	}
+
+	// Frame header (type, channel, size) followed by class and method IDs
+	frame := make([]byte, 11)
+	if _, err := io.ReadFull(conn, frame); err != nil {
+		return fmt.Errorf("failed to read Connection.Start: %v", err)
+	}
+
+	if bytes.HasPrefix(frame, []byte("AMQP")) {
+		return fmt.Errorf("server does not support AMQP 0-9-1, it offered %x", frame[4:8])
+	}
+
+	class := binary.BigEndian.Uint16(frame[7:9])
+	method := binary.BigEndian.Uint16(frame[9:11])
+
+	if frame[0] != 1 || class != 10 || method != 10 {
+		return fmt.Errorf("unexpected frame type %d class %d method %d, expected Connection.Start", frame[0], class, method)
+	}
+
+	return nil
+
+}
+
+// mysqlProbe reads the initial handshake packet a MySQL server sends on
+// connect. An error packet, such as "Too many connections", fails the probe.
+type mysqlProbe struct{ probeDialer }
+
+func (p mysqlProbe) Check(address string, timeout time.Duration) error {
+
+	conn, err := p.dial(address, timeout)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("failed to read server greeting: %v", err)
+	}
+
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	if length == 0 {
+		return fmt.Errorf("empty server greeting")
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return fmt.Errorf("failed to read server greeting: %v", err)
+	}
+
+	switch payload[0] {
+	case 0x0A:
+		end := bytes.IndexByte(payload[1:], 0)
+		if end < 0 {
+			return fmt.Errorf("malformed server greeting")
+		}
+		return nil
+	case 0xFF:
+		message := ""
+		if len(payload) > 3 {
+			message = strings.TrimPrefix(string(payload[3:]), "#")
+		}
+		return fmt.Errorf("server refused connection: %s", message)
+	default:
+		return fmt.Errorf("unsupported protocol version %d", payload[0])
+	}
+
+}
+
+// Postgres protocol constants.
+const (
+	postgresSSLRequestCode = 80877103
+	postgresProtocol30     = 196608
+	postgresStartupUser    = "nautiluslb"
+)
+
+// postgresProbe negotiates SSL with an SSLRequest and sends a startup
+// message. Any authentication request, or an authentication error, proves the
+// server accepts connections, while "the database system is starting up" and
+// similar errors fail the probe.
+type postgresProbe struct{ probeDialer }
+
+func (p postgresProbe) Check(address string, timeout time.Duration) error {
+
+	conn, err := p.dial(address, timeout)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint32(request[0:4], 8)
+	binary.BigEndian.PutUint32(request[4:8], postgresSSLRequestCode)
+
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	answer := make([]byte, 1)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return fmt.Errorf("failed to read SSLRequest reply: %v", err)
+	}
+
+	var session net.Conn = conn
+
+	switch answer[0] {
+	case 'N':
+	case 'S':
+		// Only the reachability of the server matters, not its identity
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		if err := tlsConn.Handshake(); err != nil {
+			return fmt.Errorf("TLS handshake failed: %v", err)
+		}
+		session = tlsConn
+	case 'E':
+		return fmt.Errorf("server rejected SSLRequest")
+	default:
+		return fmt.Errorf("unexpected SSLRequest reply %q", answer[0])
+	}
+
+	if _, err := session.Write(postgresStartupMessage()); err != nil {
+		return err
+	}
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(session, header); err != nil {
+		return fmt.Errorf("failed to read startup reply: %v", err)
+	}
+
+	switch header[0] {
+	case 'R':
+		return nil
+	case 'E':
+		length := int(binary.BigEndian.Uint32(header[1:5])) - 4
+		if length <= 0 || length > 64*1024 {
+			return fmt.Errorf("invalid error response length %d", length)
+		}
+		fields := make([]byte, length)
+		if _, err := io.ReadFull(session, fields); err != nil {
+			return fmt.Errorf("failed to read error response: %v", err)
+		}
+		return postgresStartupError(fields)
+	default:
+		return fmt.Errorf("unexpected startup reply %q", header[0])
+	}
+
+}
+
+// postgresStartupMessage builds a protocol 3.0 startup message.
+func postgresStartupMessage() []byte {
+
+	params := "user\x00" + postgresStartupUser + "\x00database\x00postgres\x00\x00"
+
+	message := make([]byte, 8, 8+len(params))
+	binary.BigEndian.PutUint32(message[0:4], uint32(8+len(params)))
+	binary.BigEndian.PutUint32(message[4:8], postgresProtocol30)
+
+	return append(message, params...)
+
+}
+
+// postgresStartupError interprets the fields of an ErrorResponse to a startup
+// message. Authentication and authorization errors mean the server is up.
+func postgresStartupError(fields []byte) error {
+
+	var code, message string
+
+	for _, field := range bytes.Split(fields, []byte{0}) {
+		if len(field) < 2 {
+			continue
+		}
+		switch field[0] {
+		case 'C':
+			code = string(field[1:])
+		case 'M':
+			message = string(field[1:])
+		}
+	}
+
+	// Class 28 is invalid authorization, 3D000 an unknown database
+	if strings.HasPrefix(code, "28") || code == "3D000" {
+		return nil
+	}
+
+	return fmt.Errorf("server error %s: %s", code, message)
+
+}
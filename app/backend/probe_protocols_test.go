@@ -0,0 +1,317 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeServer accepts a single connection and hands it to handler.
+func fakeServer(t *testing.T, handler func(conn net.Conn)) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create test listener: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		handler(conn)
+	}()
+
+	return listener.Addr().String()
+}
+
+// replyAfter reads n bytes from the client and writes reply.
+func replyAfter(n int, reply []byte) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		if _, err := io.ReadFull(conn, make([]byte, n)); err != nil {
+			return
+		}
+		_, _ = conn.Write(reply)
+	}
+}
+
+func TestRedisProbe(t *testing.T) {
+	ping := len("*1\r\n$4\r\nPING\r\n")
+
+	tests := []struct {
+		name    string
+		reply   string
+		wantErr bool
+	}{
+		{"PONG", "+PONG\r\n", false},
+		{"Authentication required", "-NOAUTH Authentication required.\r\n", false},
+		{"Loading dataset", "-LOADING Redis is loading the dataset in memory\r\n", true},
+		{"Garbage", "HTTP/1.1 400 Bad Request\r\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address := fakeServer(t, replyAfter(ping, []byte(tt.reply)))
+
+			err := (redisProbe{}).Check(address, time.Second)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Check() error = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// bsonDocument encodes a BSON document from raw element bytes.
+func bsonDocument(elements ...[]byte) []byte {
+	body := bytes.Join(elements, nil)
+	doc := make([]byte, 4, 5+len(body))
+	binary.LittleEndian.PutUint32(doc, uint32(5+len(body)))
+	doc = append(doc, body...)
+	return append(doc, 0)
+}
+
+func bsonDouble(name string, value float64) []byte {
+	element := append([]byte{0x01}, name+"\x00"...)
+	return binary.LittleEndian.AppendUint64(element, math.Float64bits(value))
+}
+
+func bsonString(name, value string) []byte {
+	element := append([]byte{0x02}, name+"\x00"...)
+	element = binary.LittleEndian.AppendUint32(element, uint32(len(value)+1))
+	return append(element, value+"\x00"...)
+}
+
+func bsonBool(name string, value bool) []byte {
+	element := append([]byte{0x08}, name+"\x00"...)
+	if value {
+		return append(element, 1)
+	}
+	return append(element, 0)
+}
+
+func bsonEmbedded(name string, doc []byte) []byte {
+	element := append([]byte{0x03}, name+"\x00"...)
+	return append(element, doc...)
+}
+
+// mongoReply wraps doc in an OP_MSG reply.
+func mongoReply(opCode uint32, doc []byte) []byte {
+	length := mongoHeaderLength + 5 + len(doc)
+	message := make([]byte, mongoHeaderLength+5, length)
+	binary.LittleEndian.PutUint32(message[0:4], uint32(length))
+	binary.LittleEndian.PutUint32(message[12:16], opCode)
+	return append(message, doc...)
+}
+
+func TestMongoDBProbe(t *testing.T) {
+	hello := len(mongoCommandMessage("hello"))
+
+	topology := bsonDocument(bsonString("processId", "abc"))
+
+	tests := []struct {
+		name    string
+		reply   []byte
+		wantErr bool
+	}{
+		{"Primary", mongoReply(mongoOpMsg, bsonDocument(
+			bsonBool("isWritablePrimary", true),
+			bsonEmbedded("topologyVersion", topology),
+			bsonDouble("ok", 1))), false},
+		{"Command failed", mongoReply(mongoOpMsg, bsonDocument(
+			bsonString("errmsg", "not ready"),
+			bsonDouble("ok", 0))), true},
+		{"No ok field", mongoReply(mongoOpMsg, bsonDocument(bsonBool("helloOk", true))), true},
+		{"Legacy reply opcode", mongoReply(1, bsonDocument(bsonDouble("ok", 1))), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address := fakeServer(t, replyAfter(hello, tt.reply))
+
+			err := (mongoDBProbe{}).Check(address, time.Second)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Check() error = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMongoDBProbeFallsBackToIsMaster(t *testing.T) {
+	hello := len(mongoCommandMessage("hello"))
+	isMaster := len(mongoCommandMessage("isMaster"))
+
+	commandNotFound := mongoReply(mongoOpMsg, bsonDocument(
+		bsonDouble("ok", 0),
+		bsonString("errmsg", "no such command: 'hello'"),
+		bsonDouble("code", mongoCommandNotFound)))
+
+	tests := []struct {
+		name          string
+		isMasterReply []byte
+		wantErr       bool
+	}{
+		{"isMaster succeeds", mongoReply(mongoOpMsg, bsonDocument(bsonBool("ismaster", true), bsonDouble("ok", 1))), false},
+		{"isMaster fails", mongoReply(mongoOpMsg, bsonDocument(bsonDouble("ok", 0))), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address := fakeServer(t, func(conn net.Conn) {
+				replyAfter(hello, commandNotFound)(conn)
+				replyAfter(isMaster, tt.isMasterReply)(conn)
+			})
+
+			err := (mongoDBProbe{}).Check(address, time.Second)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Check() error = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMongoDBProbeOtherErrorsDoNotFallBack(t *testing.T) {
+	hello := len(mongoCommandMessage("hello"))
+
+	// Any other failure of hello is final
+	address := fakeServer(t, replyAfter(hello, mongoReply(mongoOpMsg, bsonDocument(
+		bsonDouble("ok", 0),
+		bsonDouble("code", 13)))))
+
+	if err := (mongoDBProbe{}).Check(address, time.Second); err == nil {
+		t.Error("Check() error = nil; want an error")
+	}
+}
+
+func TestMongoCommandMessage(t *testing.T) {
+	message := mongoCommandMessage("hello")
+
+	if int(binary.LittleEndian.Uint32(message[0:4])) != len(message) {
+		t.Errorf("Message length header = %d; want %d", binary.LittleEndian.Uint32(message[0:4]), len(message))
+	}
+
+	if binary.LittleEndian.Uint32(message[12:16]) != mongoOpMsg {
+		t.Errorf("Opcode = %d; want %d", binary.LittleEndian.Uint32(message[12:16]), mongoOpMsg)
+	}
+
+	if !bytes.Contains(message, []byte("hello\x00")) || !bytes.Contains(message, []byte("admin\x00")) {
+		t.Error("Message should carry the hello command against the admin database")
+	}
+}
+
+func TestAMQPProbe(t *testing.T) {
+	header := len("AMQP\x00\x00\x09\x01")
+
+	connectionStart := []byte{1, 0, 0, 0, 0, 0, 4, 0, 10, 0, 10, 0xCE}
+
+	tests := []struct {
+		name    string
+		reply   []byte
+		wantErr bool
+	}{
+		{"Connection.Start", connectionStart, false},
+		{"Unsupported protocol", []byte("AMQP\x00\x00\x09\x01\x00\x00\x00"), true},
+		{"Unexpected method", []byte{1, 0, 0, 0, 0, 0, 4, 0, 10, 0, 50, 0xCE}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address := fakeServer(t, replyAfter(header, tt.reply))
+
+			err := (amqpProbe{}).Check(address, time.Second)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Check() error = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// mysqlPacket frames payload as a MySQL packet with sequence id 0.
+func mysqlPacket(payload []byte) []byte {
+	return append([]byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), 0}, payload...)
+}
+
+func TestMySQLProbe(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   []byte
+		wantErr bool
+	}{
+		{"Handshake v10", mysqlPacket(append([]byte{0x0A}, "8.0.36\x00\x01\x00\x00\x00"...)), false},
+		{"Too many connections", mysqlPacket(append([]byte{0xFF, 0x10, 0x04}, "Too many connections"...)), true},
+		{"Unknown protocol", mysqlPacket([]byte{0x09, 0x00}), true},
+		{"Closed", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address := fakeServer(t, func(conn net.Conn) {
+				_, _ = conn.Write(tt.reply)
+			})
+
+			err := (mysqlProbe{}).Check(address, time.Second)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Check() error = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// postgresError builds an ErrorResponse carrying the given SQLSTATE.
+func postgresError(code, message string) []byte {
+	fields := "SFATAL\x00C" + code + "\x00M" + message + "\x00\x00"
+	reply := binary.BigEndian.AppendUint32([]byte{'E'}, uint32(4+len(fields)))
+	return append(reply, fields...)
+}
+
+func TestPostgresProbe(t *testing.T) {
+	startup := len(postgresStartupMessage())
+
+	authRequest := []byte{'R', 0, 0, 0, 8, 0, 0, 0, 5}
+
+	tests := []struct {
+		name    string
+		reply   []byte
+		wantErr bool
+	}{
+		{"Authentication request", authRequest, false},
+		{"Password authentication failed", postgresError("28P01", "password authentication failed"), false},
+		{"Unknown database", postgresError("3D000", "database \"postgres\" does not exist"), false},
+		{"Starting up", postgresError("57P03", "the database system is starting up"), true},
+		{"Unexpected message", []byte{'Z', 0, 0, 0, 5, 'I'}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address := fakeServer(t, func(conn net.Conn) {
+				if _, err := io.ReadFull(conn, make([]byte, 8)); err != nil {
+					return
+				}
+				if _, err := conn.Write([]byte{'N'}); err != nil {
+					return
+				}
+				replyAfter(startup, tt.reply)(conn)
+			})
+
+			err := (postgresProbe{}).Check(address, time.Second)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Check() error = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPostgresProbeRejectsSSLRequest(t *testing.T) {
+	address := fakeServer(t, replyAfter(8, []byte{'X'}))
+
+	if err := (postgresProbe{}).Check(address, time.Second); err == nil {
+		t.Error("Probe should fail on an invalid SSLRequest reply")
+	}
+}
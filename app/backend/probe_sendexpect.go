@@ -0,0 +1,141 @@
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+
+	"github.com/cloudresty/nautiluslb/config"
+)
+
+// maxSendExpectResponseSize limits how much of a response is read for matching.
+const maxSendExpectResponseSize = 4 * 1024
+
+// sendExpectProbe writes a configured payload to the backend and considers it
+// healthy when the response matches a regular expression or starts with the
+// expected bytes, in the spirit of HAProxy's tcp-check send/expect.
+type sendExpectProbe struct {
+	probeDialer
+	payload         []byte
+	prefix          []byte
+	regex           *regexp.Regexp
+	responseTimeout time.Duration
+}
+
+// newSendExpectProbe creates a send-expect probe from the settings, dialing
+// with dialer.
+func newSendExpectProbe(settings config.SendExpectHealthCheckConfig, dialer probeDialer) (*sendExpectProbe, error) {
+
+	if err := settings.Validate(); err != nil {
+		return nil, err
+	}
+
+	payload, err := settings.GetPayload()
+	if err != nil {
+		return nil, err
+	}
+
+	prefix, err := settings.GetExpectedPrefix()
+	if err != nil {
+		return nil, err
+	}
+
+	probe := &sendExpectProbe{
+		probeDialer:     dialer,
+		payload:         payload,
+		prefix:          prefix,
+		responseTimeout: settings.GetTimeout(0),
+	}
+
+	if settings.ExpectRegex != "" {
+		probe.regex, err = regexp.Compile(settings.ExpectRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expect regex: %v", err)
+		}
+	}
+
+	return probe, nil
+
+}
+
+func (p *sendExpectProbe) Check(address string, timeout time.Duration) error {
+
+	conn, err := p.dial(address, timeout)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	if len(p.payload) > 0 {
+		if _, err := conn.Write(p.payload); err != nil {
+			return err
+		}
+	}
+
+	if p.responseTimeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(p.responseTimeout)); err != nil {
+			return err
+		}
+	}
+
+	// Read until the response matches, can no longer match, or the backend stops sending
+	response := make([]byte, 0, 512)
+	buf := make([]byte, 512)
+
+	for len(response) < maxSendExpectResponseSize {
+
+		n, readErr := conn.Read(buf)
+		response = append(response, buf[:n]...)
+
+		matched, final := p.match(response)
+		if matched {
+			return nil
+		}
+		if final {
+			break
+		}
+
+		if readErr != nil {
+			if errors.Is(readErr, io.EOF) {
+				break
+			}
+			return fmt.Errorf("no matching response: %v", readErr)
+		}
+
+	}
+
+	return fmt.Errorf("unexpected response %q", truncate(response, 64))
+
+}
+
+// match reports whether response satisfies the expectation and whether
+// reading more data could still change the outcome.
+func (p *sendExpectProbe) match(response []byte) (matched bool, final bool) {
+
+	if p.regex != nil {
+		return p.regex.Match(response), false
+	}
+
+	if len(response) < len(p.prefix) {
+		return false, !bytes.HasPrefix(p.prefix, response)
+	}
+
+	matched = bytes.HasPrefix(response, p.prefix)
+
+	return matched, true
+
+}
+
+// truncate shortens data to at most n bytes for logging.
+func truncate(data []byte, n int) []byte {
+
+	if len(data) > n {
+		return data[:n]
+	}
+
+	return data
+
+}
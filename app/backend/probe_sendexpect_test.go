@@ -0,0 +1,68 @@
+package backend
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cloudresty/nautiluslb/config"
+)
+
+func TestSendExpectProbe(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings config.SendExpectHealthCheckConfig
+		reply    []byte
+		wantErr  bool
+	}{
+		{"Text regex match", config.SendExpectHealthCheckConfig{Send: "STATUS\r\n", ExpectRegex: `^OK \d+`}, []byte("OK 42\r\n"), false},
+		{"Text regex mismatch", config.SendExpectHealthCheckConfig{Send: "STATUS\r\n", ExpectRegex: `^OK`}, []byte("ERR busy\r\n"), true},
+		{"Hex prefix match", config.SendExpectHealthCheckConfig{SendHex: "0102", ExpectHex: "cafe"}, []byte{0xCA, 0xFE, 0x00}, false},
+		{"Hex prefix mismatch", config.SendExpectHealthCheckConfig{SendHex: "0102", ExpectHex: "cafe"}, []byte{0xCA, 0xFF}, true},
+		{"Short response", config.SendExpectHealthCheckConfig{SendHex: "0102", ExpectHex: "cafebabe"}, []byte{0xCA, 0xFE}, true},
+		{"Server speaks first", config.SendExpectHealthCheckConfig{ExpectRegex: "^220 "}, []byte("220 ready\r\n"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := tt.settings.GetPayload()
+			if err != nil {
+				t.Fatalf("GetPayload() error = %v", err)
+			}
+
+			address := fakeServer(t, replyAfter(len(payload), tt.reply))
+
+			probe, err := newSendExpectProbe(tt.settings, probeDialer{})
+			if err != nil {
+				t.Fatalf("newSendExpectProbe() error = %v", err)
+			}
+
+			err = probe.Check(address, time.Second)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Check() error = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSendExpectProbeResponseTimeout(t *testing.T) {
+	// The backend reads the request but never answers
+	address := fakeServer(t, func(conn net.Conn) {
+		_, _ = io.Copy(io.Discard, conn)
+	})
+
+	probe, err := newSendExpectProbe(config.SendExpectHealthCheckConfig{Send: "PING", ExpectRegex: "PONG", Timeout: 50}, probeDialer{})
+	if err != nil {
+		t.Fatalf("newSendExpectProbe() error = %v", err)
+	}
+
+	start := time.Now()
+	if err := probe.Check(address, 5*time.Second); err == nil {
+		t.Fatal("Probe should fail when the backend does not answer")
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Probe took %v; the response timeout should have ended it after about 50ms", elapsed)
+	}
+}
@@ -0,0 +1,114 @@
+package backend
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cloudresty/nautiluslb/config"
+)
+
+func TestNewProbe(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings config.HealthCheckConfig
+		expected string
+		wantErr  bool
+	}{
+		{"Default is TCP", config.HealthCheckConfig{}, "backend.tcpProbe", false},
+		{"HTTP", config.HealthCheckConfig{Type: config.HealthCheckHTTP}, "*backend.httpProbe", false},
+		{"HTTPS", config.HealthCheckConfig{Type: config.HealthCheckHTTPS}, "*backend.httpProbe", false},
+		{"Redis", config.HealthCheckConfig{Type: config.HealthCheckRedis}, "backend.redisProbe", false},
+		{"MongoDB", config.HealthCheckConfig{Type: config.HealthCheckMongoDB}, "backend.mongoDBProbe", false},
+		{"AMQP", config.HealthCheckConfig{Type: config.HealthCheckAMQP}, "backend.amqpProbe", false},
+		{"MySQL", config.HealthCheckConfig{Type: config.HealthCheckMySQL}, "backend.mysqlProbe", false},
+		{"Postgres", config.HealthCheckConfig{Type: config.HealthCheckPostgres}, "backend.postgresProbe", false},
+		{"Send-expect", config.HealthCheckConfig{Type: config.HealthCheckSendExpect, SendExpect: config.SendExpectHealthCheckConfig{ExpectRegex: "ok"}}, "*backend.sendExpectProbe", false},
+		{"Send-expect without expectation", config.HealthCheckConfig{Type: config.HealthCheckSendExpect}, "", true},
+		{"Invalid HTTP status", config.HealthCheckConfig{Type: config.HealthCheckHTTP, HTTP: config.HTTPHealthCheckConfig{ExpectedStatus: "x"}}, "", true},
+		{"Unknown type", config.HealthCheckConfig{Type: "icmp"}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			probe, err := NewProbe(tt.settings)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewProbe() error = %v; wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && fmt.Sprintf("%T", probe) != tt.expected {
+				t.Errorf("NewProbe() = %T; want %s", probe, tt.expected)
+			}
+		})
+	}
+}
+
+func TestTCPProbe(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create test listener: %v", err)
+	}
+
+	address := listener.Addr().String()
+
+	if err := (tcpProbe{}).Check(address, time.Second); err != nil {
+		t.Errorf("Probe should succeed against a listening port: %v", err)
+	}
+
+	if err := listener.Close(); err != nil {
+		t.Fatalf("Failed to close test listener: %v", err)
+	}
+
+	if err := (tcpProbe{}).Check(address, time.Second); err == nil {
+		t.Error("Probe should fail against a closed port")
+	}
+}
+
+func TestProbeSendsProxyHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings config.HealthCheckConfig
+		expected string
+	}{
+		{"TCP without PROXY protocol", config.HealthCheckConfig{}, ""},
+		{"TCP with v1", config.HealthCheckConfig{ProxyProtocol: config.ProxyProtocolV1}, "PROXY UNKNOWN\r\n"},
+		{"TCP with v2", config.HealthCheckConfig{ProxyProtocol: config.ProxyProtocolV2}, "\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00"},
+		{"HTTP with v1", config.HealthCheckConfig{Type: config.HealthCheckHTTP, ProxyProtocol: config.ProxyProtocolV1}, "PROXY UNKNOWN\r\nGET "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Failed to create test listener: %v", err)
+			}
+			defer func() { _ = listener.Close() }()
+
+			received := make(chan string, 1)
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					received <- ""
+					return
+				}
+				defer func() { _ = conn.Close() }()
+
+				_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+				start := make([]byte, len(tt.expected))
+				n, _ := io.ReadFull(conn, start)
+				received <- string(start[:n])
+			}()
+
+			probe, err := NewProbe(tt.settings)
+			if err != nil {
+				t.Fatalf("NewProbe() error = %v", err)
+			}
+			_ = probe.Check(listener.Addr().String(), time.Second)
+
+			if got := <-received; got != tt.expected {
+				t.Errorf("Probe sent %q; want %q", got, tt.expected)
+			}
+		})
+	}
+}
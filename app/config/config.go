@@ -2,25 +2,297 @@ package config
 
 import (
 	"fmt"
+	"net/netip"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 // Config represents the overall configuration for the SLB.
 type Config struct {
 	Settings struct {
 		KubeconfigPath string `yaml:"kubeconfigPath"`
+		MetricsAddress string `yaml:"metricsAddress,omitempty"` // Address to serve metrics on, disabled when empty
 	} `yaml:"settings"`
 	BackendConfigurations []Configuration `yaml:"configurations"`
 }
 
+// Load balancing strategies that can be selected per configuration.
+const (
+	StrategyRoundRobin         = "round-robin"
+	StrategyRandom             = "random"
+	StrategyLeastConnections   = "least-connections"
+	StrategyPowerOfTwoChoices  = "power-of-two"
+	StrategyWeightedRoundRobin = "weighted-round-robin"
+	StrategyConsistentHash     = "consistent-hash"
+)
+
+// Backend modes that select how ClusterIP services are turned into backends.
+const (
+	BackendModeService   = "service"   // Send traffic to the service's cluster IP
+	BackendModeEndpoints = "endpoints" // Send traffic to the service's pods, resolved through EndpointSlices
+)
+
+// PROXY protocol versions that can be sent to backends.
+const (
+	ProxyProtocolV1   = "v1"
+	ProxyProtocolV2   = "v2"
+	ProxyProtocolNone = "none" // Sends no header, for services opting out of that of their configuration
+)
+
+// ProxyProtocolConfig controls the PROXY protocol header sent to backends at
+// the start of every connection, so that they see the client address instead
+// of that of the load balancer.
+type ProxyProtocolConfig struct {
+	Version  string `yaml:"version,omitempty"`  // PROXY protocol version, disabled when empty
+	UniqueID bool   `yaml:"uniqueId,omitempty"` // Send a PP2_TYPE_UNIQUE_ID TLV with the session ID, v2 only
+	Checksum bool   `yaml:"checksum,omitempty"` // Send a PP2_TYPE_CRC32C TLV, v2 only
+}
+
+// DefaultProxyHeaderTimeout is the time in seconds that trusted peers get to
+// send their PROXY protocol header when a configuration does not set it.
+const DefaultProxyHeaderTimeout = 5
+
+// AcceptProxyProtocolConfig controls the PROXY protocol headers read from
+// clients, for listeners behind another L4 load balancer. Connections from
+// trusted peers must start with a v1 or v2 header, whose client address is
+// then used instead of that of the peer. Other connections are taken as they
+// are.
+type AcceptProxyProtocolConfig struct {
+	TrustedCIDRs  []string `yaml:"trustedCIDRs,omitempty"`  // Peers that send a header, disabled when empty
+	HeaderTimeout int      `yaml:"headerTimeout,omitempty"` // Seconds that trusted peers get to send the header
+}
+
+// GetHeaderTimeout returns the time that trusted peers get to send their
+// header, applying the default.
+func (ac AcceptProxyProtocolConfig) GetHeaderTimeout() time.Duration {
+
+	if ac.HeaderTimeout <= 0 {
+		return DefaultProxyHeaderTimeout * time.Second
+	}
+
+	return time.Duration(ac.HeaderTimeout) * time.Second
+
+}
+
+// GetTrustedPrefixes returns the trusted CIDRs, skipping those that do not
+// parse, see Validate.
+func (ac AcceptProxyProtocolConfig) GetTrustedPrefixes() []netip.Prefix {
+
+	var prefixes []netip.Prefix
+	for _, cidr := range ac.TrustedCIDRs {
+		if prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr)); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+		}
+	}
+
+	return prefixes
+
+}
+
+// Validate checks the PROXY protocol settings of the listener.
+func (ac AcceptProxyProtocolConfig) Validate() error {
+
+	for _, cidr := range ac.TrustedCIDRs {
+		if _, err := netip.ParsePrefix(strings.TrimSpace(cidr)); err != nil {
+			return fmt.Errorf("invalid 'acceptProxyProtocol.trustedCIDRs' entry '%s': %v", cidr, err)
+		}
+	}
+
+	if ac.HeaderTimeout < 0 {
+		return fmt.Errorf("'acceptProxyProtocol.headerTimeout' cannot be negative")
+	}
+
+	return nil
+
+}
+
+// Node address types that NodePort and LoadBalancer services can be reached
+// on.
+const (
+	NodeAddressInternalIP = "InternalIP"
+	NodeAddressExternalIP = "ExternalIP"
+	NodeAddressAnnotation = "Annotation" // Address taken from a node annotation
+)
+
+// NodeConfig controls which nodes NodePort and LoadBalancer services are
+// reached through, and on which of their addresses. Nodes that are not Ready
+// or are cordoned are left out unless included explicitly.
+type NodeConfig struct {
+	Selector             string `yaml:"selector,omitempty"`             // Kubernetes label selector on nodes
+	AddressType          string `yaml:"addressType,omitempty"`          // Preferred address, falling back to the InternalIP
+	AddressAnnotation    string `yaml:"addressAnnotation,omitempty"`    // Node annotation holding the address of the Annotation type
+	IncludeNotReady      bool   `yaml:"includeNotReady,omitempty"`      // Also send traffic to nodes that are not Ready
+	IncludeUnschedulable bool   `yaml:"includeUnschedulable,omitempty"` // Also send traffic to cordoned nodes
+}
+
+// GetAddressType returns the preferred node address type, applying the default.
+func (nc NodeConfig) GetAddressType() string {
+
+	if nc.AddressType == "" {
+		return NodeAddressInternalIP
+	}
+
+	return nc.AddressType
+
+}
+
+// Validate checks the node settings.
+func (nc NodeConfig) Validate() error {
+
+	if _, err := labels.Parse(nc.Selector); err != nil {
+		return fmt.Errorf("invalid 'nodes.selector': %v", err)
+	}
+
+	switch nc.GetAddressType() {
+	case NodeAddressInternalIP, NodeAddressExternalIP:
+	case NodeAddressAnnotation:
+		if strings.TrimSpace(nc.AddressAnnotation) == "" {
+			return fmt.Errorf("'nodes.addressAnnotation' is required with 'nodes.addressType' '%s'", NodeAddressAnnotation)
+		}
+	default:
+		return fmt.Errorf("unknown 'nodes.addressType' '%s'", nc.AddressType)
+	}
+
+	return nil
+
+}
+
+// DefaultDrainTimeout is the time in seconds that sessions to a removed
+// backend, or of a listener shutting down, may keep running when a
+// configuration does not set it.
+const DefaultDrainTimeout = 30
+
+// Default session timeouts in seconds, used when a configuration does not set
+// them. Sessions have no maximum duration by default.
+const (
+	DefaultConnectTimeout = 5
+	DefaultIdleTimeout    = 3600
+)
+
+// Default retry settings used when a configuration does not set them.
+const (
+	DefaultRetryMaxAttempts = 3
+	DefaultRetryBudget      = 10 // seconds
+)
+
+// RetryConfig controls how a client connection fails over to other backends
+// when connecting to the selected backend fails.
+type RetryConfig struct {
+	MaxAttempts int `yaml:"maxAttempts,omitempty"` // Total connection attempts per client connection
+	Budget      int `yaml:"budget,omitempty"`      // Total time in seconds spent on all attempts
+}
+
+// GetMaxAttempts returns the maximum number of connection attempts, applying the default.
+func (rc RetryConfig) GetMaxAttempts() int {
+
+	if rc.MaxAttempts <= 0 {
+		return DefaultRetryMaxAttempts
+	}
+
+	return rc.MaxAttempts
+
+}
+
+// GetBudget returns the time budget for all connection attempts, applying the default.
+func (rc RetryConfig) GetBudget() time.Duration {
+
+	if rc.Budget <= 0 {
+		return DefaultRetryBudget * time.Second
+	}
+
+	return time.Duration(rc.Budget) * time.Second
+
+}
+
+// Default outlier detection settings used when a configuration does not set them.
+const (
+	DefaultOutlierConsecutiveFailures = 5
+	DefaultOutlierBaseEjectionTime    = 30  // seconds
+	DefaultOutlierMaxEjectionTime     = 300 // seconds
+	DefaultOutlierMaxEjectionPercent  = 50
+)
+
+// OutlierDetectionConfig controls passive ejection of backends that keep
+// failing live traffic: refused dials, resets and immediate closes.
+type OutlierDetectionConfig struct {
+	Disabled            bool `yaml:"disabled,omitempty"`
+	ConsecutiveFailures int  `yaml:"consecutiveFailures,omitempty"` // Failures in a row before ejecting
+	BaseEjectionTime    int  `yaml:"baseEjectionTime,omitempty"`    // Seconds, multiplied by the number of ejections
+	MaxEjectionTime     int  `yaml:"maxEjectionTime,omitempty"`     // Seconds, upper bound for a single ejection
+	MaxEjectionPercent  int  `yaml:"maxEjectionPercent,omitempty"`  // Share of the pool that may be ejected at once
+}
+
+// GetConsecutiveFailures returns the ejection threshold, applying the default.
+func (oc OutlierDetectionConfig) GetConsecutiveFailures() int {
+
+	if oc.ConsecutiveFailures <= 0 {
+		return DefaultOutlierConsecutiveFailures
+	}
+
+	return oc.ConsecutiveFailures
+
+}
+
+// GetBaseEjectionTime returns the base ejection time, applying the default.
+func (oc OutlierDetectionConfig) GetBaseEjectionTime() time.Duration {
+
+	if oc.BaseEjectionTime <= 0 {
+		return DefaultOutlierBaseEjectionTime * time.Second
+	}
+
+	return time.Duration(oc.BaseEjectionTime) * time.Second
+
+}
+
+// GetMaxEjectionTime returns the maximum ejection time, applying the default.
+func (oc OutlierDetectionConfig) GetMaxEjectionTime() time.Duration {
+
+	if oc.MaxEjectionTime <= 0 {
+		return DefaultOutlierMaxEjectionTime * time.Second
+	}
+
+	return time.Duration(oc.MaxEjectionTime) * time.Second
+
+}
+
+// GetMaxEjectionPercent returns the maximum ejected share of the pool, applying the default.
+func (oc OutlierDetectionConfig) GetMaxEjectionPercent() int {
+
+	if oc.MaxEjectionPercent <= 0 {
+		return DefaultOutlierMaxEjectionPercent
+	}
+
+	return oc.MaxEjectionPercent
+
+}
+
 // Configuration represents the configuration for a backend.
 type Configuration struct {
-	Name            string `yaml:"name"`
-	ListenerAddress string `yaml:"listenerAddress"`
-	RequestTimeout  int    `yaml:"requestTimeout,omitempty"`
-	BackendPortName string `yaml:"backendPortName"`
-	Namespace       string `yaml:"namespace,omitempty"`
+	Name                  string                    `yaml:"name"`
+	ListenerAddress       string                    `yaml:"listenerAddress"`
+	RequestTimeout        int                       `yaml:"requestTimeout,omitempty"`        // Seconds, connect timeout when connectTimeout is not set
+	ConnectTimeout        int                       `yaml:"connectTimeout,omitempty"`        // Seconds allowed for each connection attempt to a backend
+	IdleTimeout           int                       `yaml:"idleTimeout,omitempty"`           // Seconds a session may go without traffic in either direction
+	MaxConnectionDuration int                       `yaml:"maxConnectionDuration,omitempty"` // Seconds after which a session is closed, unlimited when not set
+	DrainTimeout          int                       `yaml:"drainTimeout,omitempty"`          // Seconds that sessions may keep running while draining
+	BackendPortName       string                    `yaml:"backendPortName"`
+	Namespace             string                    `yaml:"namespace,omitempty"`
+	Namespaces            []string                  `yaml:"namespaces,omitempty"`        // Namespaces to discover services in, besides Namespace
+	ExcludeNamespaces     []string                  `yaml:"excludeNamespaces,omitempty"` // Namespaces whose services are never discovered
+	LabelSelector         string                    `yaml:"labelSelector,omitempty"`     // Kubernetes label selector on services
+	NamespaceSelector     string                    `yaml:"namespaceSelector,omitempty"` // Kubernetes label selector on namespaces
+	Strategy              string                    `yaml:"strategy,omitempty"`
+	BackendMode           string                    `yaml:"backendMode,omitempty"`
+	Nodes                 NodeConfig                `yaml:"nodes,omitempty"`
+	ProxyProtocol         ProxyProtocolConfig       `yaml:"proxyProtocol,omitempty"`
+	AcceptProxyProtocol   AcceptProxyProtocolConfig `yaml:"acceptProxyProtocol,omitempty"`
+	Retry                 RetryConfig               `yaml:"retry,omitempty"`
+	OutlierDetection      OutlierDetectionConfig    `yaml:"outlierDetection,omitempty"`
+	HealthCheck           HealthCheckConfig         `yaml:"healthCheck,omitempty"`
 }
 
 // Validate validates the backend configuration.
@@ -38,6 +310,90 @@ func (bc *Configuration) Validate() error {
 		return fmt.Errorf("'backendPortName' cannot be empty")
 	}
 
+	for _, namespace := range bc.Namespaces {
+		if strings.TrimSpace(namespace) == "" {
+			return fmt.Errorf("'namespaces' cannot contain an empty namespace")
+		}
+	}
+
+	excluded := make(map[string]bool, len(bc.ExcludeNamespaces))
+	for _, namespace := range bc.ExcludeNamespaces {
+		if strings.TrimSpace(namespace) == "" {
+			return fmt.Errorf("'excludeNamespaces' cannot contain an empty namespace")
+		}
+		excluded[strings.TrimSpace(namespace)] = true
+	}
+
+	for _, namespace := range bc.GetNamespaces() {
+		if excluded[namespace] {
+			return fmt.Errorf("namespace '%s' is both included and excluded", namespace)
+		}
+	}
+
+	if _, err := labels.Parse(bc.LabelSelector); err != nil {
+		return fmt.Errorf("invalid 'labelSelector': %v", err)
+	}
+
+	if _, err := labels.Parse(bc.NamespaceSelector); err != nil {
+		return fmt.Errorf("invalid 'namespaceSelector': %v", err)
+	}
+
+	if !IsValidStrategy(bc.Strategy) {
+		return fmt.Errorf("unknown 'strategy' '%s'", bc.Strategy)
+	}
+
+	if !IsValidBackendMode(bc.BackendMode) {
+		return fmt.Errorf("unknown 'backendMode' '%s'", bc.BackendMode)
+	}
+
+	if err := bc.Nodes.Validate(); err != nil {
+		return err
+	}
+
+	if !IsValidProxyProtocol(bc.ProxyProtocol.Version) {
+		return fmt.Errorf("unknown 'proxyProtocol.version' '%s'", bc.ProxyProtocol.Version)
+	}
+
+	if err := bc.AcceptProxyProtocol.Validate(); err != nil {
+		return err
+	}
+
+	if bc.DrainTimeout < 0 {
+		return fmt.Errorf("'drainTimeout' cannot be negative")
+	}
+
+	if bc.RequestTimeout < 0 {
+		return fmt.Errorf("'requestTimeout' cannot be negative")
+	}
+
+	if bc.ConnectTimeout < 0 {
+		return fmt.Errorf("'connectTimeout' cannot be negative")
+	}
+
+	if bc.IdleTimeout < 0 {
+		return fmt.Errorf("'idleTimeout' cannot be negative")
+	}
+
+	if bc.MaxConnectionDuration < 0 {
+		return fmt.Errorf("'maxConnectionDuration' cannot be negative")
+	}
+
+	if bc.Retry.MaxAttempts < 0 {
+		return fmt.Errorf("'retry.maxAttempts' cannot be negative")
+	}
+
+	if bc.Retry.Budget < 0 {
+		return fmt.Errorf("'retry.budget' cannot be negative")
+	}
+
+	if bc.OutlierDetection.MaxEjectionPercent < 0 || bc.OutlierDetection.MaxEjectionPercent > 100 {
+		return fmt.Errorf("'outlierDetection.maxEjectionPercent' must be between 0 and 100")
+	}
+
+	if err := bc.HealthCheck.Validate(); err != nil {
+		return err
+	}
+
 	return nil
 
 }
@@ -55,3 +411,139 @@ func (bc *Configuration) GetListenerPort() (int, error) {
 	return port, nil
 
 }
+
+// GetDrainTimeout returns the time that sessions may keep running while
+// draining, applying the default.
+func (bc *Configuration) GetDrainTimeout() time.Duration {
+
+	if bc.DrainTimeout <= 0 {
+		return DefaultDrainTimeout * time.Second
+	}
+
+	return time.Duration(bc.DrainTimeout) * time.Second
+
+}
+
+// GetConnectTimeout returns the time allowed for each connection attempt to a
+// backend, falling back to the request timeout and then to the default.
+func (bc *Configuration) GetConnectTimeout() time.Duration {
+
+	switch {
+	case bc.ConnectTimeout > 0:
+		return time.Duration(bc.ConnectTimeout) * time.Second
+	case bc.RequestTimeout > 0:
+		return time.Duration(bc.RequestTimeout) * time.Second
+	}
+
+	return DefaultConnectTimeout * time.Second
+
+}
+
+// GetIdleTimeout returns the time a session may go without traffic, applying
+// the default.
+func (bc *Configuration) GetIdleTimeout() time.Duration {
+
+	if bc.IdleTimeout <= 0 {
+		return DefaultIdleTimeout * time.Second
+	}
+
+	return time.Duration(bc.IdleTimeout) * time.Second
+
+}
+
+// GetMaxConnectionDuration returns the maximum lifetime of a session, zero
+// meaning unlimited.
+func (bc *Configuration) GetMaxConnectionDuration() time.Duration {
+
+	return time.Duration(bc.MaxConnectionDuration) * time.Second
+
+}
+
+// GetNamespaces returns the namespaces to discover services in, merging
+// Namespace and Namespaces, sorted and without duplicates. An empty result
+// means all namespaces.
+func (bc *Configuration) GetNamespaces() []string {
+
+	seen := make(map[string]bool)
+	var namespaces []string
+
+	for _, namespace := range append([]string{bc.Namespace}, bc.Namespaces...) {
+		namespace = strings.TrimSpace(namespace)
+		if namespace == "" || seen[namespace] {
+			continue
+		}
+		seen[namespace] = true
+		namespaces = append(namespaces, namespace)
+	}
+
+	sort.Strings(namespaces)
+
+	return namespaces
+
+}
+
+// IsExcludedNamespace reports whether services in namespace are excluded from
+// discovery.
+func (bc *Configuration) IsExcludedNamespace(namespace string) bool {
+
+	for _, excluded := range bc.ExcludeNamespaces {
+		if strings.TrimSpace(excluded) == namespace {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+// IsValidStrategy reports whether name is a supported load balancing strategy.
+// An empty name is valid and selects the default round-robin strategy.
+func IsValidStrategy(name string) bool {
+
+	switch name {
+	case "", StrategyRoundRobin, StrategyRandom, StrategyLeastConnections, StrategyPowerOfTwoChoices,
+		StrategyWeightedRoundRobin, StrategyConsistentHash:
+		return true
+	}
+
+	return false
+
+}
+
+// GetBackendMode returns the backend mode, applying the default.
+func (bc *Configuration) GetBackendMode() string {
+
+	if bc.BackendMode == "" {
+		return BackendModeService
+	}
+
+	return bc.BackendMode
+
+}
+
+// IsValidBackendMode reports whether mode is a supported backend mode. An
+// empty mode is valid and selects the default service mode.
+func IsValidBackendMode(mode string) bool {
+
+	switch mode {
+	case "", BackendModeService, BackendModeEndpoints:
+		return true
+	}
+
+	return false
+
+}
+
+// IsValidProxyProtocol reports whether version is a supported PROXY protocol
+// version. An empty version is valid and, like ProxyProtocolNone, disables the
+// PROXY protocol.
+func IsValidProxyProtocol(version string) bool {
+
+	switch version {
+	case "", ProxyProtocolV1, ProxyProtocolV2, ProxyProtocolNone:
+		return true
+	}
+
+	return false
+
+}
@@ -1,7 +1,9 @@
 package config
 
 import (
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestConfigStructure(t *testing.T) {
@@ -51,3 +53,362 @@ func TestGetListenerPortWithoutColon(t *testing.T) {
 		t.Errorf("Expected port %d, got %d", expected, port)
 	}
 }
+
+func TestValidateStrategy(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		wantErr  bool
+	}{
+		{"Empty strategy", "", false},
+		{"Round-robin", StrategyRoundRobin, false},
+		{"Random", StrategyRandom, false},
+		{"Least connections", StrategyLeastConnections, false},
+		{"Power of two choices", StrategyPowerOfTwoChoices, false},
+		{"Weighted round-robin", StrategyWeightedRoundRobin, false},
+		{"Consistent hash", StrategyConsistentHash, false},
+		{"Unknown strategy", "fastest", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Configuration{
+				Name:            "test",
+				ListenerAddress: ":8080",
+				BackendPortName: "http",
+				Strategy:        tt.strategy,
+			}
+
+			err := config.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateBackendMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     string
+		expected string
+		wantErr  bool
+	}{
+		{"Empty mode", "", BackendModeService, false},
+		{"Service", BackendModeService, BackendModeService, false},
+		{"Endpoints", BackendModeEndpoints, BackendModeEndpoints, false},
+		{"Unknown mode", "pods", "pods", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Configuration{
+				Name:            "test",
+				ListenerAddress: ":8080",
+				BackendPortName: "http",
+				BackendMode:     tt.mode,
+			}
+
+			err := config.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v; wantErr %v", err, tt.wantErr)
+			}
+
+			if got := config.GetBackendMode(); got != tt.expected {
+				t.Errorf("GetBackendMode() = %q; want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestValidateSelectors(t *testing.T) {
+	tests := []struct {
+		name              string
+		labelSelector     string
+		namespaceSelector string
+		wantErr           bool
+	}{
+		{"No selectors", "", "", false},
+		{"Set based selectors", "app in (web, api), !canary", "env notin (dev)", false},
+		{"Invalid label selector", "app in web", "", true},
+		{"Invalid namespace selector", "", "env in (a,", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Configuration{
+				Name:              "test",
+				ListenerAddress:   ":8080",
+				BackendPortName:   "http",
+				LabelSelector:     tt.labelSelector,
+				NamespaceSelector: tt.namespaceSelector,
+			}
+
+			err := config.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateNamespaces(t *testing.T) {
+	tests := []struct {
+		name              string
+		namespace         string
+		namespaces        []string
+		excludeNamespaces []string
+		wantErr           bool
+	}{
+		{"All namespaces", "", nil, nil, false},
+		{"Namespace list", "", []string{"team-a", "team-b"}, nil, false},
+		{"Namespace and list", "team-a", []string{"team-b"}, nil, false},
+		{"Exclusions", "", nil, []string{"kube-system"}, false},
+		{"Empty namespace in list", "", []string{"team-a", " "}, nil, true},
+		{"Empty excluded namespace", "", nil, []string{""}, true},
+		{"Included and excluded", "", []string{"team-a"}, []string{"team-a"}, true},
+		{"Namespace excluded", "team-a", nil, []string{"team-a"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Configuration{
+				Name:              "test",
+				ListenerAddress:   ":8080",
+				BackendPortName:   "http",
+				Namespace:         tt.namespace,
+				Namespaces:        tt.namespaces,
+				ExcludeNamespaces: tt.excludeNamespaces,
+			}
+
+			err := config.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetNamespaces(t *testing.T) {
+	config := &Configuration{
+		Namespace:  "team-b",
+		Namespaces: []string{"team-c", "team-a", " team-b "},
+	}
+
+	got := config.GetNamespaces()
+	want := []string{"team-a", "team-b", "team-c"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("GetNamespaces() = %v; want %v", got, want)
+	}
+
+	if got := (&Configuration{}).GetNamespaces(); len(got) != 0 {
+		t.Errorf("GetNamespaces() = %v; want all namespaces", got)
+	}
+}
+
+func TestValidateNodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		nodes   NodeConfig
+		wantErr bool
+	}{
+		{"Defaults", NodeConfig{}, false},
+		{"Selector", NodeConfig{Selector: "!node-role.kubernetes.io/control-plane"}, false},
+		{"External address", NodeConfig{AddressType: NodeAddressExternalIP}, false},
+		{"Annotation address", NodeConfig{AddressType: NodeAddressAnnotation, AddressAnnotation: "example.com/public-ip"}, false},
+		{"Annotation address without annotation", NodeConfig{AddressType: NodeAddressAnnotation}, true},
+		{"Unknown address type", NodeConfig{AddressType: "Hostname"}, true},
+		{"Invalid selector", NodeConfig{Selector: "role in ingress"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Configuration{
+				Name:            "test",
+				ListenerAddress: ":8080",
+				BackendPortName: "http",
+				Nodes:           tt.nodes,
+			}
+
+			err := config.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	config := &Configuration{}
+
+	if got := config.GetDrainTimeout(); got != DefaultDrainTimeout*time.Second {
+		t.Errorf("Expected default drain timeout %v, got %v", DefaultDrainTimeout*time.Second, got)
+	}
+
+	config.DrainTimeout = 5
+	if got := config.GetDrainTimeout(); got != 5*time.Second {
+		t.Errorf("Expected drain timeout 5s, got %v", got)
+	}
+
+	config = &Configuration{Name: "test", ListenerAddress: ":8080", BackendPortName: "http", DrainTimeout: -1}
+	if err := config.Validate(); err == nil {
+		t.Error("Expected an error for a negative drain timeout")
+	}
+}
+
+func TestSessionTimeouts(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      Configuration
+		connect     time.Duration
+		idle        time.Duration
+		maxDuration time.Duration
+	}{
+		{
+			name:    "defaults",
+			config:  Configuration{},
+			connect: DefaultConnectTimeout * time.Second,
+			idle:    DefaultIdleTimeout * time.Second,
+		},
+		{
+			name:    "request timeout used to connect",
+			config:  Configuration{RequestTimeout: 7},
+			connect: 7 * time.Second,
+			idle:    DefaultIdleTimeout * time.Second,
+		},
+		{
+			name:        "explicit timeouts",
+			config:      Configuration{RequestTimeout: 7, ConnectTimeout: 2, IdleTimeout: 60, MaxConnectionDuration: 600},
+			connect:     2 * time.Second,
+			idle:        60 * time.Second,
+			maxDuration: 600 * time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.GetConnectTimeout(); got != tt.connect {
+				t.Errorf("GetConnectTimeout() = %v; want %v", got, tt.connect)
+			}
+			if got := tt.config.GetIdleTimeout(); got != tt.idle {
+				t.Errorf("GetIdleTimeout() = %v; want %v", got, tt.idle)
+			}
+			if got := tt.config.GetMaxConnectionDuration(); got != tt.maxDuration {
+				t.Errorf("GetMaxConnectionDuration() = %v; want %v", got, tt.maxDuration)
+			}
+		})
+	}
+}
+
+func TestValidateSessionTimeouts(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Configuration)
+	}{
+		{"negative request timeout", func(c *Configuration) { c.RequestTimeout = -1 }},
+		{"negative connect timeout", func(c *Configuration) { c.ConnectTimeout = -1 }},
+		{"negative idle timeout", func(c *Configuration) { c.IdleTimeout = -1 }},
+		{"negative max connection duration", func(c *Configuration) { c.MaxConnectionDuration = -1 }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Configuration{Name: "test", ListenerAddress: ":8080", BackendPortName: "http"}
+			tt.modify(config)
+			if err := config.Validate(); err == nil {
+				t.Error("Validate() = nil; want an error")
+			}
+		})
+	}
+}
+
+func TestRetryConfigDefaults(t *testing.T) {
+	retry := RetryConfig{}
+
+	if got := retry.GetMaxAttempts(); got != DefaultRetryMaxAttempts {
+		t.Errorf("Expected default max attempts %d, got %d", DefaultRetryMaxAttempts, got)
+	}
+
+	if got := retry.GetBudget(); got != DefaultRetryBudget*time.Second {
+		t.Errorf("Expected default budget %v, got %v", DefaultRetryBudget*time.Second, got)
+	}
+
+	retry = RetryConfig{MaxAttempts: 5, Budget: 2}
+
+	if got := retry.GetMaxAttempts(); got != 5 {
+		t.Errorf("Expected max attempts 5, got %d", got)
+	}
+
+	if got := retry.GetBudget(); got != 2*time.Second {
+		t.Errorf("Expected budget 2s, got %v", got)
+	}
+}
+
+func TestValidateRetry(t *testing.T) {
+	config := &Configuration{
+		Name:            "test",
+		ListenerAddress: ":8080",
+		BackendPortName: "http",
+		Retry:           RetryConfig{MaxAttempts: -1},
+	}
+
+	if err := config.Validate(); err == nil {
+		t.Error("Expected error for negative retry.maxAttempts")
+	}
+
+	config.Retry = RetryConfig{Budget: -1}
+	if err := config.Validate(); err == nil {
+		t.Error("Expected error for negative retry.budget")
+	}
+}
+
+func TestValidateProxyProtocol(t *testing.T) {
+	tests := []struct {
+		version string
+		valid   bool
+	}{
+		{"", true},
+		{ProxyProtocolV1, true},
+		{ProxyProtocolV2, true},
+		{ProxyProtocolNone, true},
+		{"v3", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			config := &Configuration{Name: "test", ListenerAddress: ":8080", BackendPortName: "http",
+				ProxyProtocol: ProxyProtocolConfig{Version: tt.version, UniqueID: true}}
+			if err := config.Validate(); (err == nil) != tt.valid {
+				t.Errorf("Validate() error = %v; want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestAcceptProxyProtocol(t *testing.T) {
+	accept := AcceptProxyProtocolConfig{TrustedCIDRs: []string{"10.0.0.1/8", " 2001:db8::/32 "}}
+
+	if err := accept.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v; want nil", err)
+	}
+
+	prefixes := accept.GetTrustedPrefixes()
+	if len(prefixes) != 2 || prefixes[0].String() != "10.0.0.0/8" || prefixes[1].String() != "2001:db8::/32" {
+		t.Errorf("GetTrustedPrefixes() = %v; want [10.0.0.0/8 2001:db8::/32]", prefixes)
+	}
+
+	if got := accept.GetHeaderTimeout(); got != DefaultProxyHeaderTimeout*time.Second {
+		t.Errorf("GetHeaderTimeout() = %v; want %v", got, DefaultProxyHeaderTimeout*time.Second)
+	}
+
+	invalid := []AcceptProxyProtocolConfig{
+		{TrustedCIDRs: []string{"10.0.0.1"}},
+		{TrustedCIDRs: []string{"not-a-cidr/8"}},
+		{HeaderTimeout: -1},
+	}
+	for _, accept := range invalid {
+		if err := accept.Validate(); err == nil {
+			t.Errorf("Validate(%+v) = nil; want an error", accept)
+		}
+	}
+}
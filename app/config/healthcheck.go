@@ -0,0 +1,322 @@
+package config
+
+import (
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Health check types that can be selected per configuration.
+const (
+	HealthCheckTCP   = "tcp"
+	HealthCheckHTTP  = "http"
+	HealthCheckHTTPS = "https"
+
+	HealthCheckRedis    = "redis"
+	HealthCheckMongoDB  = "mongodb"
+	HealthCheckAMQP     = "amqp"
+	HealthCheckMySQL    = "mysql"
+	HealthCheckPostgres = "postgres"
+
+	HealthCheckSendExpect = "send-expect"
+)
+
+// Default health check settings used when a configuration does not set them.
+const (
+	DefaultHealthCheckInterval           = 10 // seconds
+	DefaultHealthCheckTimeout            = 2  // seconds
+	DefaultHealthCheckUnhealthyThreshold = 3
+	DefaultHealthCheckHealthyThreshold   = 2
+	DefaultHealthCheckJitter             = 10 // percent of the interval
+)
+
+// HealthCheckConfig controls the active health checks run against each backend.
+type HealthCheckConfig struct {
+	Type               string `yaml:"type,omitempty"`               // Probe type, defaults to a plain TCP connect
+	Interval           int    `yaml:"interval,omitempty"`           // Seconds between two probes
+	Timeout            int    `yaml:"timeout,omitempty"`            // Seconds before a probe is considered failed
+	UnhealthyThreshold int    `yaml:"unhealthyThreshold,omitempty"` // Failed probes in a row before marking a backend unhealthy
+	HealthyThreshold   int    `yaml:"healthyThreshold,omitempty"`   // Successful probes in a row before marking a backend healthy again
+	Jitter             int    `yaml:"jitter,omitempty"`             // Random spread applied to every interval, in percent of the interval
+	DisableJitter      bool   `yaml:"disableJitter,omitempty"`      // Probe at exactly every interval
+	Port               int    `yaml:"port,omitempty"`               // Port to probe instead of the backend port
+	ProxyProtocol      string `yaml:"-"`                            // PROXY protocol version the probed port expects, set by the load balancer
+
+	HTTP       HTTPHealthCheckConfig       `yaml:"http,omitempty"`
+	SendExpect SendExpectHealthCheckConfig `yaml:"sendExpect,omitempty"`
+}
+
+// GetType returns the probe type, applying the default.
+func (hc HealthCheckConfig) GetType() string {
+
+	if hc.Type == "" {
+		return HealthCheckTCP
+	}
+
+	return hc.Type
+
+}
+
+// GetInterval returns the interval between probes, applying the default.
+func (hc HealthCheckConfig) GetInterval() time.Duration {
+
+	if hc.Interval <= 0 {
+		return DefaultHealthCheckInterval * time.Second
+	}
+
+	return time.Duration(hc.Interval) * time.Second
+
+}
+
+// GetTimeout returns the probe timeout, applying the default.
+func (hc HealthCheckConfig) GetTimeout() time.Duration {
+
+	if hc.Timeout <= 0 {
+		return DefaultHealthCheckTimeout * time.Second
+	}
+
+	return time.Duration(hc.Timeout) * time.Second
+
+}
+
+// GetUnhealthyThreshold returns the number of failures that mark a backend unhealthy, applying the default.
+func (hc HealthCheckConfig) GetUnhealthyThreshold() int {
+
+	if hc.UnhealthyThreshold <= 0 {
+		return DefaultHealthCheckUnhealthyThreshold
+	}
+
+	return hc.UnhealthyThreshold
+
+}
+
+// GetHealthyThreshold returns the number of successes that mark a backend healthy, applying the default.
+func (hc HealthCheckConfig) GetHealthyThreshold() int {
+
+	if hc.HealthyThreshold <= 0 {
+		return DefaultHealthCheckHealthyThreshold
+	}
+
+	return hc.HealthyThreshold
+
+}
+
+// GetJitter returns the jitter in percent of the interval, applying the
+// default. It is zero when jitter is disabled.
+func (hc HealthCheckConfig) GetJitter() int {
+
+	if hc.DisableJitter {
+		return 0
+	}
+
+	if hc.Jitter <= 0 {
+		return DefaultHealthCheckJitter
+	}
+
+	return hc.Jitter
+
+}
+
+// Validate validates the health check settings.
+func (hc HealthCheckConfig) Validate() error {
+
+	if hc.Interval < 0 || hc.Timeout < 0 {
+		return fmt.Errorf("'healthCheck.interval' and 'healthCheck.timeout' cannot be negative")
+	}
+
+	if hc.GetTimeout() > hc.GetInterval() {
+		return fmt.Errorf("'healthCheck.timeout' cannot be longer than 'healthCheck.interval'")
+	}
+
+	if hc.Jitter < 0 || hc.Jitter > 100 {
+		return fmt.Errorf("'healthCheck.jitter' must be between 0 and 100")
+	}
+
+	if hc.DisableJitter && hc.Jitter > 0 {
+		return fmt.Errorf("'healthCheck.jitter' cannot be set with 'healthCheck.disableJitter'")
+	}
+
+	if hc.Port < 0 || hc.Port > 65535 {
+		return fmt.Errorf("'healthCheck.port' must be between 0 and 65535")
+	}
+
+	switch hc.GetType() {
+	case HealthCheckTCP, HealthCheckRedis, HealthCheckMongoDB, HealthCheckAMQP, HealthCheckMySQL, HealthCheckPostgres:
+	case HealthCheckHTTP, HealthCheckHTTPS:
+		if _, _, err := hc.HTTP.GetExpectedStatus(); err != nil {
+			return fmt.Errorf("'healthCheck.http.expectedStatus': %v", err)
+		}
+		if hc.HTTP.BodyRegex != "" {
+			if _, err := regexp.Compile(hc.HTTP.BodyRegex); err != nil {
+				return fmt.Errorf("'healthCheck.http.bodyRegex': %v", err)
+			}
+		}
+		if hc.HTTP.Path != "" && !strings.HasPrefix(hc.HTTP.Path, "/") {
+			return fmt.Errorf("'healthCheck.http.path' must start with '/'")
+		}
+	case HealthCheckSendExpect:
+		if err := hc.SendExpect.Validate(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown 'healthCheck.type' '%s'", hc.Type)
+	}
+
+	return nil
+
+}
+
+// HTTPHealthCheckConfig holds the settings of the http and https probe types.
+type HTTPHealthCheckConfig struct {
+	Method             string `yaml:"method,omitempty"`             // Defaults to GET
+	Path               string `yaml:"path,omitempty"`               // Defaults to /
+	Host               string `yaml:"host,omitempty"`               // Host header, defaults to the backend address
+	ExpectedStatus     string `yaml:"expectedStatus,omitempty"`     // Status code or range such as "200-399", the default
+	BodyContains       string `yaml:"bodyContains,omitempty"`       // Substring the response body must contain
+	BodyRegex          string `yaml:"bodyRegex,omitempty"`          // Regular expression the response body must match
+	ServerName         string `yaml:"serverName,omitempty"`         // TLS SNI, defaults to the Host header
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify,omitempty"` // Skip TLS certificate verification
+}
+
+// GetMethod returns the HTTP method, applying the default.
+func (hc HTTPHealthCheckConfig) GetMethod() string {
+
+	if hc.Method == "" {
+		return "GET"
+	}
+
+	return strings.ToUpper(hc.Method)
+
+}
+
+// GetPath returns the request path, applying the default.
+func (hc HTTPHealthCheckConfig) GetPath() string {
+
+	if hc.Path == "" {
+		return "/"
+	}
+
+	return hc.Path
+
+}
+
+// GetExpectedStatus returns the inclusive range of accepted status codes.
+func (hc HTTPHealthCheckConfig) GetExpectedStatus() (int, int, error) {
+
+	if hc.ExpectedStatus == "" {
+		return 200, 399, nil
+	}
+
+	low, high, isRange := strings.Cut(hc.ExpectedStatus, "-")
+	if !isRange {
+		high = low
+	}
+
+	min, err := strconv.Atoi(strings.TrimSpace(low))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid expected status '%s': %v", hc.ExpectedStatus, err)
+	}
+
+	max, err := strconv.Atoi(strings.TrimSpace(high))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid expected status '%s': %v", hc.ExpectedStatus, err)
+	}
+
+	if min < 100 || max > 599 || min > max {
+		return 0, 0, fmt.Errorf("invalid expected status '%s': must be a range within 100-599", hc.ExpectedStatus)
+	}
+
+	return min, max, nil
+
+}
+
+// SendExpectHealthCheckConfig holds the settings of the send-expect probe
+// type, which writes a payload to the backend and matches the response
+// against a regular expression or a hex pattern.
+type SendExpectHealthCheckConfig struct {
+	Send        string `yaml:"send,omitempty"`        // Text payload, nothing is sent when both send and sendHex are empty
+	SendHex     string `yaml:"sendHex,omitempty"`     // Binary payload as hex, such as "0a0b0c"
+	ExpectRegex string `yaml:"expectRegex,omitempty"` // Regular expression the response must match
+	ExpectHex   string `yaml:"expectHex,omitempty"`   // Bytes the response must start with, as hex
+	Timeout     int    `yaml:"timeout,omitempty"`     // Milliseconds to wait for the response, defaults to the health check timeout
+}
+
+// GetPayload returns the bytes to send to the backend.
+func (hc SendExpectHealthCheckConfig) GetPayload() ([]byte, error) {
+
+	if hc.SendHex != "" {
+		payload, err := hex.DecodeString(strings.ReplaceAll(hc.SendHex, " ", ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex payload '%s': %v", hc.SendHex, err)
+		}
+		return payload, nil
+	}
+
+	return []byte(hc.Send), nil
+
+}
+
+// GetExpectedPrefix returns the bytes the response must start with, or nil
+// when the response is matched against a regular expression.
+func (hc SendExpectHealthCheckConfig) GetExpectedPrefix() ([]byte, error) {
+
+	if hc.ExpectHex == "" {
+		return nil, nil
+	}
+
+	prefix, err := hex.DecodeString(strings.ReplaceAll(hc.ExpectHex, " ", ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex pattern '%s': %v", hc.ExpectHex, err)
+	}
+
+	return prefix, nil
+
+}
+
+// GetTimeout returns how long to wait for the response, falling back to the
+// given health check timeout.
+func (hc SendExpectHealthCheckConfig) GetTimeout(fallback time.Duration) time.Duration {
+
+	if hc.Timeout <= 0 {
+		return fallback
+	}
+
+	return time.Duration(hc.Timeout) * time.Millisecond
+
+}
+
+// Validate validates the send-expect settings.
+func (hc SendExpectHealthCheckConfig) Validate() error {
+
+	if hc.Send != "" && hc.SendHex != "" {
+		return fmt.Errorf("'healthCheck.sendExpect.send' and 'healthCheck.sendExpect.sendHex' are mutually exclusive")
+	}
+
+	if (hc.ExpectRegex == "") == (hc.ExpectHex == "") {
+		return fmt.Errorf("exactly one of 'healthCheck.sendExpect.expectRegex' and 'healthCheck.sendExpect.expectHex' is required")
+	}
+
+	if hc.Timeout < 0 {
+		return fmt.Errorf("'healthCheck.sendExpect.timeout' cannot be negative")
+	}
+
+	if _, err := hc.GetPayload(); err != nil {
+		return fmt.Errorf("'healthCheck.sendExpect.sendHex': %v", err)
+	}
+
+	if _, err := hc.GetExpectedPrefix(); err != nil {
+		return fmt.Errorf("'healthCheck.sendExpect.expectHex': %v", err)
+	}
+
+	if hc.ExpectRegex != "" {
+		if _, err := regexp.Compile(hc.ExpectRegex); err != nil {
+			return fmt.Errorf("'healthCheck.sendExpect.expectRegex': %v", err)
+		}
+	}
+
+	return nil
+
+}
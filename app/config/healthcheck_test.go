@@ -0,0 +1,188 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHealthCheckConfigDefaults(t *testing.T) {
+	hc := HealthCheckConfig{}
+
+	if got := hc.GetInterval(); got != DefaultHealthCheckInterval*time.Second {
+		t.Errorf("Expected default interval, got %v", got)
+	}
+
+	if got := hc.GetTimeout(); got != DefaultHealthCheckTimeout*time.Second {
+		t.Errorf("Expected default timeout, got %v", got)
+	}
+
+	if got := hc.GetUnhealthyThreshold(); got != DefaultHealthCheckUnhealthyThreshold {
+		t.Errorf("Expected default unhealthy threshold, got %d", got)
+	}
+
+	if got := hc.GetHealthyThreshold(); got != DefaultHealthCheckHealthyThreshold {
+		t.Errorf("Expected default healthy threshold, got %d", got)
+	}
+
+	if got := hc.GetJitter(); got != DefaultHealthCheckJitter {
+		t.Errorf("Expected default jitter, got %d", got)
+	}
+}
+
+func TestHealthCheckConfigJitter(t *testing.T) {
+	tests := []struct {
+		name        string
+		healthCheck HealthCheckConfig
+		want        int
+	}{
+		{"Default", HealthCheckConfig{}, DefaultHealthCheckJitter},
+		{"Zero means default", HealthCheckConfig{Jitter: 0}, DefaultHealthCheckJitter},
+		{"Custom", HealthCheckConfig{Jitter: 25}, 25},
+		{"Disabled", HealthCheckConfig{DisableJitter: true}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.healthCheck.GetJitter(); got != tt.want {
+				t.Errorf("GetJitter() = %d; want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHealthCheckConfigType(t *testing.T) {
+	if got := (HealthCheckConfig{}).GetType(); got != HealthCheckTCP {
+		t.Errorf("Expected default type %q, got %q", HealthCheckTCP, got)
+	}
+
+	if got := (HealthCheckConfig{Type: HealthCheckHTTP}).GetType(); got != HealthCheckHTTP {
+		t.Errorf("Expected type %q, got %q", HealthCheckHTTP, got)
+	}
+}
+
+func TestHTTPHealthCheckConfigDefaults(t *testing.T) {
+	hc := HTTPHealthCheckConfig{}
+
+	if got := hc.GetMethod(); got != "GET" {
+		t.Errorf("Expected default method GET, got %q", got)
+	}
+
+	if got := hc.GetPath(); got != "/" {
+		t.Errorf("Expected default path /, got %q", got)
+	}
+
+	if got := (HTTPHealthCheckConfig{Method: "head"}).GetMethod(); got != "HEAD" {
+		t.Errorf("Expected method to be upper-cased, got %q", got)
+	}
+}
+
+func TestHTTPHealthCheckConfigExpectedStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		min, max int
+		wantErr  bool
+	}{
+		{"Default range", "", 200, 399, false},
+		{"Single status", "204", 204, 204, false},
+		{"Range", "200-299", 200, 299, false},
+		{"Range with spaces", "200 - 299", 200, 299, false},
+		{"Inverted range", "299-200", 0, 0, true},
+		{"Out of bounds", "99-700", 0, 0, true},
+		{"Not a number", "ok", 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			min, max, err := HTTPHealthCheckConfig{ExpectedStatus: tt.value}.GetExpectedStatus()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetExpectedStatus() error = %v; wantErr %v", err, tt.wantErr)
+			}
+			if min != tt.min || max != tt.max {
+				t.Errorf("GetExpectedStatus() = %d-%d; want %d-%d", min, max, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestValidateHealthCheck(t *testing.T) {
+	tests := []struct {
+		name        string
+		healthCheck HealthCheckConfig
+		wantErr     bool
+	}{
+		{"Defaults", HealthCheckConfig{}, false},
+		{"Custom values", HealthCheckConfig{Interval: 5, Timeout: 1, UnhealthyThreshold: 2, HealthyThreshold: 3, Jitter: 20}, false},
+		{"Negative interval", HealthCheckConfig{Interval: -1}, true},
+		{"Timeout longer than interval", HealthCheckConfig{Interval: 2, Timeout: 5}, true},
+		{"Default timeout longer than interval", HealthCheckConfig{Interval: 1}, true},
+		{"Jitter above 100", HealthCheckConfig{Jitter: 150}, true},
+		{"Jitter disabled", HealthCheckConfig{DisableJitter: true}, false},
+		{"Jitter set and disabled", HealthCheckConfig{Jitter: 20, DisableJitter: true}, true},
+		{"Probe port", HealthCheckConfig{Port: 10256}, false},
+		{"Probe port out of range", HealthCheckConfig{Port: 70000}, true},
+		{"HTTP probe", HealthCheckConfig{Type: HealthCheckHTTP, HTTP: HTTPHealthCheckConfig{Path: "/healthz", ExpectedStatus: "200"}}, false},
+		{"HTTPS probe", HealthCheckConfig{Type: HealthCheckHTTPS, HTTP: HTTPHealthCheckConfig{BodyRegex: "^ok$"}}, false},
+		{"HTTP path without slash", HealthCheckConfig{Type: HealthCheckHTTP, HTTP: HTTPHealthCheckConfig{Path: "healthz"}}, true},
+		{"HTTP invalid status", HealthCheckConfig{Type: HealthCheckHTTP, HTTP: HTTPHealthCheckConfig{ExpectedStatus: "abc"}}, true},
+		{"HTTP invalid regex", HealthCheckConfig{Type: HealthCheckHTTP, HTTP: HTTPHealthCheckConfig{BodyRegex: "("}}, true},
+		{"Redis probe", HealthCheckConfig{Type: HealthCheckRedis}, false},
+		{"MongoDB probe", HealthCheckConfig{Type: HealthCheckMongoDB}, false},
+		{"AMQP probe", HealthCheckConfig{Type: HealthCheckAMQP}, false},
+		{"MySQL probe", HealthCheckConfig{Type: HealthCheckMySQL}, false},
+		{"Postgres probe", HealthCheckConfig{Type: HealthCheckPostgres}, false},
+		{"Send-expect regex", HealthCheckConfig{Type: HealthCheckSendExpect, SendExpect: SendExpectHealthCheckConfig{Send: "PING\r\n", ExpectRegex: "^PONG"}}, false},
+		{"Send-expect hex", HealthCheckConfig{Type: HealthCheckSendExpect, SendExpect: SendExpectHealthCheckConfig{SendHex: "00 01", ExpectHex: "ff", Timeout: 500}}, false},
+		{"Send-expect without expectation", HealthCheckConfig{Type: HealthCheckSendExpect, SendExpect: SendExpectHealthCheckConfig{Send: "PING"}}, true},
+		{"Send-expect with both expectations", HealthCheckConfig{Type: HealthCheckSendExpect, SendExpect: SendExpectHealthCheckConfig{ExpectRegex: "a", ExpectHex: "61"}}, true},
+		{"Send-expect with both payloads", HealthCheckConfig{Type: HealthCheckSendExpect, SendExpect: SendExpectHealthCheckConfig{Send: "a", SendHex: "61", ExpectRegex: "a"}}, true},
+		{"Send-expect invalid hex", HealthCheckConfig{Type: HealthCheckSendExpect, SendExpect: SendExpectHealthCheckConfig{SendHex: "zz", ExpectRegex: "a"}}, true},
+		{"Send-expect invalid regex", HealthCheckConfig{Type: HealthCheckSendExpect, SendExpect: SendExpectHealthCheckConfig{ExpectRegex: "("}}, true},
+		{"Send-expect negative timeout", HealthCheckConfig{Type: HealthCheckSendExpect, SendExpect: SendExpectHealthCheckConfig{ExpectRegex: "a", Timeout: -1}}, true},
+		{"Unknown type", HealthCheckConfig{Type: "icmp"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Configuration{
+				Name:            "test",
+				ListenerAddress: ":8080",
+				BackendPortName: "http",
+				HealthCheck:     tt.healthCheck,
+			}
+
+			err := config.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSendExpectHealthCheckConfig(t *testing.T) {
+	settings := SendExpectHealthCheckConfig{SendHex: "de ad be ef", ExpectHex: "CAFE"}
+
+	payload, err := settings.GetPayload()
+	if err != nil || string(payload) != "\xde\xad\xbe\xef" {
+		t.Errorf("GetPayload() = %x, %v; want deadbeef", payload, err)
+	}
+
+	prefix, err := settings.GetExpectedPrefix()
+	if err != nil || string(prefix) != "\xca\xfe" {
+		t.Errorf("GetExpectedPrefix() = %x, %v; want cafe", prefix, err)
+	}
+
+	if got := settings.GetTimeout(2 * time.Second); got != 2*time.Second {
+		t.Errorf("GetTimeout() = %v; want the fallback 2s", got)
+	}
+
+	settings.Timeout = 250
+	if got := settings.GetTimeout(2 * time.Second); got != 250*time.Millisecond {
+		t.Errorf("GetTimeout() = %v; want 250ms", got)
+	}
+
+	text := SendExpectHealthCheckConfig{Send: "PING\r\n"}
+	if payload, _ := text.GetPayload(); string(payload) != "PING\r\n" {
+		t.Errorf("GetPayload() = %q; want %q", payload, "PING\r\n")
+	}
+}
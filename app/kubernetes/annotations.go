@@ -0,0 +1,238 @@
+package kubernetes
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/cloudresty/nautiluslb/backend"
+	"github.com/cloudresty/nautiluslb/config"
+)
+
+// Annotations read from Kubernetes services. Apart from EnabledAnnotation they
+// are all optional and override a setting of the configuration for the
+// backends of the service only.
+const (
+	// EnabledAnnotation marks a service for discovery by NautilusLB.
+	EnabledAnnotation = "nautiluslb.cloudresty.io/enabled"
+
+	// WeightAnnotation sets the relative weight of a service's backends for
+	// the weighted-round-robin strategy.
+	WeightAnnotation = "nautiluslb.cloudresty.io/weight"
+
+	// AlgorithmAnnotation sets the load balancing strategy, see
+	// config.IsValidStrategy.
+	AlgorithmAnnotation = "nautiluslb.cloudresty.io/algorithm"
+
+	// BackendModeAnnotation overrides the backend mode of the configuration
+	// for a ClusterIP service, see config.BackendModeEndpoints.
+	BackendModeAnnotation = "nautiluslb.cloudresty.io/backend-mode"
+
+	// HealthTypeAnnotation sets the health check type.
+	HealthTypeAnnotation = "nautiluslb.cloudresty.io/health-type"
+
+	// HealthPathAnnotation switches the service's backends to an HTTP health
+	// check against the given path.
+	HealthPathAnnotation = "nautiluslb.cloudresty.io/health-path"
+
+	// HealthIntervalAnnotation sets the seconds between two health checks.
+	HealthIntervalAnnotation = "nautiluslb.cloudresty.io/health-interval"
+
+	// IdleTimeoutAnnotation sets the seconds after which a session without
+	// traffic in either direction is closed.
+	IdleTimeoutAnnotation = "nautiluslb.cloudresty.io/idle-timeout"
+
+	// ProxyProtocolAnnotation sets the PROXY protocol version sent to the
+	// backends, "v1" or "v2", or "none" to send no header.
+	ProxyProtocolAnnotation = "nautiluslb.cloudresty.io/proxy-protocol"
+
+	// MaxConnectionsAnnotation caps the active connections of each backend.
+	MaxConnectionsAnnotation = "nautiluslb.cloudresty.io/max-connections"
+)
+
+// serviceOverrides holds the settings a service overrides through its
+// annotations.
+type serviceOverrides struct {
+	weight         int
+	strategy       string
+	backendMode    string
+	healthCheck    *config.HealthCheckConfig
+	idleTimeout    time.Duration
+	proxyProtocol  string
+	maxConnections int
+}
+
+// parseServiceOverrides reads the annotations of service. Every invalid
+// annotation is returned as an error and leaves its setting to cfg.
+func parseServiceOverrides(service corev1.Service, cfg config.Configuration) (serviceOverrides, []error) {
+	var overrides serviceOverrides
+	var errs []error
+
+	collect := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	var err error
+
+	overrides.weight, err = serviceWeight(service)
+	collect(err)
+
+	overrides.strategy, err = serviceStrategy(service)
+	collect(err)
+
+	overrides.backendMode, err = serviceBackendMode(service, cfg)
+	collect(err)
+
+	overrides.healthCheck, err = serviceHealthCheck(service, cfg)
+	collect(err)
+
+	idleTimeout, err := positiveIntAnnotation(service, IdleTimeoutAnnotation)
+	overrides.idleTimeout = time.Duration(idleTimeout) * time.Second
+	collect(err)
+
+	overrides.proxyProtocol, err = serviceProxyProtocol(service)
+	collect(err)
+
+	overrides.maxConnections, err = positiveIntAnnotation(service, MaxConnectionsAnnotation)
+	collect(err)
+
+	return overrides, errs
+}
+
+// positiveIntAnnotation returns the value of the annotation key, or 0 when it
+// is missing or invalid.
+func positiveIntAnnotation(service corev1.Service, key string) (int, error) {
+	value, ok := service.Annotations[key]
+	if !ok {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid %s annotation '%s': must be a positive integer", key, value)
+	}
+
+	return n, nil
+}
+
+// serviceWeight returns the backend weight set through WeightAnnotation, up
+// to backend.MaxWeight. Missing or invalid weights fall back to 1.
+func serviceWeight(service corev1.Service) (int, error) {
+	weight, err := positiveIntAnnotation(service, WeightAnnotation)
+	if weight == 0 {
+		return 1, err
+	}
+
+	if weight > backend.MaxWeight {
+		return 1, fmt.Errorf("invalid %s annotation '%s': must be at most %d",
+			WeightAnnotation, service.Annotations[WeightAnnotation], backend.MaxWeight)
+	}
+
+	return weight, nil
+}
+
+// serviceStrategy returns the load balancing strategy set through
+// AlgorithmAnnotation, or an empty string to use that of the configuration.
+func serviceStrategy(service corev1.Service) (string, error) {
+	value, ok := service.Annotations[AlgorithmAnnotation]
+	if !ok {
+		return "", nil
+	}
+
+	strategy := strings.TrimSpace(value)
+	if strategy == "" || !config.IsValidStrategy(strategy) {
+		return "", fmt.Errorf("invalid %s annotation '%s': unknown strategy", AlgorithmAnnotation, value)
+	}
+
+	return strategy, nil
+}
+
+// serviceBackendMode returns the backend mode set through
+// BackendModeAnnotation, falling back to the mode of the configuration.
+func serviceBackendMode(service corev1.Service, cfg config.Configuration) (string, error) {
+	value, ok := service.Annotations[BackendModeAnnotation]
+	if !ok {
+		return cfg.GetBackendMode(), nil
+	}
+
+	mode := strings.TrimSpace(value)
+	if mode == "" || !config.IsValidBackendMode(mode) {
+		return cfg.GetBackendMode(), fmt.Errorf("invalid %s annotation '%s': must be '%s' or '%s'",
+			BackendModeAnnotation, value, config.BackendModeService, config.BackendModeEndpoints)
+	}
+
+	return mode, nil
+}
+
+// serviceProxyProtocol returns the PROXY protocol version set through
+// ProxyProtocolAnnotation, or an empty string to use that of the
+// configuration.
+func serviceProxyProtocol(service corev1.Service) (string, error) {
+	value, ok := service.Annotations[ProxyProtocolAnnotation]
+	if !ok {
+		return "", nil
+	}
+
+	version := strings.ToLower(strings.TrimSpace(value))
+	if version == "" || !config.IsValidProxyProtocol(version) {
+		return "", fmt.Errorf("invalid %s annotation '%s': must be '%s', '%s' or '%s'",
+			ProxyProtocolAnnotation, value, config.ProxyProtocolV1, config.ProxyProtocolV2, config.ProxyProtocolNone)
+	}
+
+	return version, nil
+}
+
+// serviceHealthCheck returns the health check settings set through annotations
+// on the service, layered over those of the configuration. It returns nil when
+// the service does not override anything or when the result is invalid.
+func serviceHealthCheck(service corev1.Service, cfg config.Configuration) (*config.HealthCheckConfig, error) {
+	healthType, hasType := service.Annotations[HealthTypeAnnotation]
+	path, hasPath := service.Annotations[HealthPathAnnotation]
+	if !hasType && !hasPath {
+		if _, hasInterval := service.Annotations[HealthIntervalAnnotation]; !hasInterval {
+			return nil, nil
+		}
+	}
+
+	healthCheck := cfg.HealthCheck
+
+	if hasType {
+		healthCheck.Type = strings.ToLower(strings.TrimSpace(healthType))
+	}
+
+	if hasPath {
+		path = strings.TrimSpace(path)
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("invalid %s annotation '%s': must start with '/'", HealthPathAnnotation, path)
+		}
+
+		switch healthCheck.GetType() {
+		case config.HealthCheckHTTP, config.HealthCheckHTTPS:
+		default:
+			if hasType {
+				return nil, fmt.Errorf("invalid %s annotation '%s': requires an http or https health check", HealthPathAnnotation, path)
+			}
+			healthCheck.Type = config.HealthCheckHTTP
+		}
+		healthCheck.HTTP.Path = path
+	}
+
+	interval, err := positiveIntAnnotation(service, HealthIntervalAnnotation)
+	if err != nil {
+		return nil, err
+	}
+	if interval > 0 {
+		healthCheck.Interval = interval
+	}
+
+	if err := healthCheck.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid health check annotations: %v", err)
+	}
+
+	return &healthCheck, nil
+}
@@ -0,0 +1,186 @@
+package kubernetes
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/cloudresty/nautiluslb/config"
+)
+
+func TestParseServiceOverrides(t *testing.T) {
+	cfg := config.Configuration{
+		Name:            "test-config",
+		BackendPortName: "http",
+		HealthCheck:     config.HealthCheckConfig{Interval: 5},
+	}
+
+	service := corev1.Service{}
+	service.Name = "web"
+	service.Annotations = map[string]string{
+		AlgorithmAnnotation:      config.StrategyLeastConnections,
+		HealthTypeAnnotation:     "HTTP",
+		HealthPathAnnotation:     "/ready",
+		HealthIntervalAnnotation: "2",
+		IdleTimeoutAnnotation:    "300",
+		ProxyProtocolAnnotation:  "V2",
+		MaxConnectionsAnnotation: "100",
+	}
+
+	overrides, errs := parseServiceOverrides(service, cfg)
+	if len(errs) != 0 {
+		t.Fatalf("parseServiceOverrides() errors = %v; want none", errs)
+	}
+
+	if overrides.strategy != config.StrategyLeastConnections {
+		t.Errorf("strategy = %q; want %q", overrides.strategy, config.StrategyLeastConnections)
+	}
+
+	if overrides.healthCheck == nil || overrides.healthCheck.Type != config.HealthCheckHTTP ||
+		overrides.healthCheck.HTTP.Path != "/ready" || overrides.healthCheck.Interval != 2 {
+		t.Errorf("healthCheck = %+v; want HTTP check on /ready every 2s", overrides.healthCheck)
+	}
+
+	if overrides.idleTimeout != 300*time.Second {
+		t.Errorf("idleTimeout = %v; want %v", overrides.idleTimeout, 300*time.Second)
+	}
+
+	if overrides.proxyProtocol != config.ProxyProtocolV2 {
+		t.Errorf("proxyProtocol = %q; want %q", overrides.proxyProtocol, config.ProxyProtocolV2)
+	}
+
+	if overrides.maxConnections != 100 {
+		t.Errorf("maxConnections = %d; want 100", overrides.maxConnections)
+	}
+}
+
+func TestParseServiceOverridesInvalid(t *testing.T) {
+	cfg := config.Configuration{
+		Name:            "test-config",
+		BackendPortName: "http",
+	}
+
+	tests := []struct {
+		name       string
+		annotation string
+		value      string
+	}{
+		{"Unknown algorithm", AlgorithmAnnotation, "fastest"},
+		{"Unknown health type", HealthTypeAnnotation, "udp"},
+		{"Health path on a TCP check", HealthPathAnnotation, "/ready"},
+		{"Zero health interval", HealthIntervalAnnotation, "0"},
+		{"Non-numeric idle timeout", IdleTimeoutAnnotation, "5m"},
+		{"Unknown PROXY protocol version", ProxyProtocolAnnotation, "v3"},
+		{"Negative max connections", MaxConnectionsAnnotation, "-1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := corev1.Service{}
+			service.Name = "web"
+			service.Annotations = map[string]string{tt.annotation: tt.value}
+
+			// A path alone switches the check to HTTP, pin it to TCP
+			if tt.annotation == HealthPathAnnotation {
+				service.Annotations[HealthTypeAnnotation] = config.HealthCheckTCP
+			}
+
+			overrides, errs := parseServiceOverrides(service, cfg)
+			if len(errs) != 1 {
+				t.Fatalf("parseServiceOverrides() errors = %v; want 1", errs)
+			}
+
+			if overrides.strategy != "" || overrides.healthCheck != nil || overrides.idleTimeout != 0 ||
+				overrides.proxyProtocol != "" || overrides.maxConnections != 0 || overrides.weight != 1 {
+				t.Errorf("Expected the configuration to be kept, got %+v", overrides)
+			}
+		})
+	}
+}
+
+func TestReportInvalidAnnotations(t *testing.T) {
+	cfg := config.Configuration{
+		Name:            "test-config",
+		BackendPortName: "http",
+	}
+
+	service := corev1.Service{}
+	service.Name = "web"
+	service.Namespace = "default"
+	service.Annotations = map[string]string{
+		EnabledAnnotation:   "true",
+		AlgorithmAnnotation: "fastest",
+	}
+	service.Spec.Ports = []corev1.ServicePort{{Name: "http", Port: 80}}
+
+	disabled := service
+	disabled.Name = "disabled"
+	disabled.Annotations = map[string]string{AlgorithmAnnotation: "fastest"}
+
+	recorder := record.NewFakeRecorder(10)
+	w := &Watcher{recorder: recorder, reported: make(map[string]bool)}
+
+	report := func(services ...corev1.Service) {
+		reported := make(map[string]bool)
+		w.reportInvalidAnnotations(cfg, services, reported)
+		w.reported = reported
+	}
+
+	report(service, disabled)
+	if len(recorder.Events) != 1 {
+		t.Fatalf("Expected 1 event for the enabled service, got %d", len(recorder.Events))
+	}
+	<-recorder.Events
+
+	// The same problem is only published once
+	report(service, disabled)
+	if len(recorder.Events) != 0 {
+		t.Errorf("Expected no event for an unchanged problem, got %d", len(recorder.Events))
+	}
+
+	// A fixed annotation that breaks again is published again
+	fixed := service
+	fixed.Annotations = map[string]string{EnabledAnnotation: "true"}
+	report(fixed)
+	report(service)
+	if len(recorder.Events) != 1 {
+		t.Errorf("Expected 1 event once the problem came back, got %d", len(recorder.Events))
+	}
+}
+
+func TestReportInvalidAnnotationsOncePerService(t *testing.T) {
+	service := corev1.Service{}
+	service.Name = "web"
+	service.Namespace = "default"
+	service.Annotations = map[string]string{
+		EnabledAnnotation:   "true",
+		AlgorithmAnnotation: "fastest",
+	}
+	service.Spec.Ports = []corev1.ServicePort{{Name: "http", Port: 80}}
+
+	recorder := record.NewFakeRecorder(10)
+	w := &Watcher{recorder: recorder, reported: make(map[string]bool)}
+
+	configs := []config.Configuration{
+		{Name: "web", BackendPortName: "http"},
+		{Name: "web-internal", BackendPortName: "http"},
+		{Name: "grpc", BackendPortName: "grpc"}, // Not exposed by the service
+	}
+
+	reported := make(map[string]bool)
+	for _, cfg := range configs {
+		w.reportInvalidAnnotations(cfg, []corev1.Service{service}, reported)
+	}
+
+	if len(recorder.Events) != 1 {
+		t.Errorf("Expected 1 event for the service, got %d", len(recorder.Events))
+	}
+
+	reported = make(map[string]bool)
+	w.reportInvalidAnnotations(configs[2], []corev1.Service{service}, reported)
+	if len(reported) != 0 {
+		t.Errorf("Expected no problem reported for a configuration the service has no port for, got %v", reported)
+	}
+}
@@ -0,0 +1,239 @@
+package kubernetes
+
+import (
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// endpoint is a single pod address resolved from an EndpointSlice.
+type endpoint struct {
+	ip       string
+	port     int
+	nodeName string // Empty when the EndpointSlice does not say
+}
+
+// serviceKey returns the key under which the EndpointSlices of a service are
+// grouped in clusterState.
+func serviceKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// groupEndpointSlices groups EndpointSlices by the service they belong to.
+// Slices that are not managed for a service are ignored.
+func groupEndpointSlices(slices []*discoveryv1.EndpointSlice) map[string][]*discoveryv1.EndpointSlice {
+	grouped := make(map[string][]*discoveryv1.EndpointSlice)
+
+	for _, slice := range slices {
+		serviceName := slice.Labels[discoveryv1.LabelServiceName]
+		if serviceName == "" {
+			continue
+		}
+
+		key := serviceKey(slice.Namespace, serviceName)
+		grouped[key] = append(grouped[key], slice)
+	}
+
+	return grouped
+}
+
+// serviceEndpoints returns the pod addresses behind the port of service named
+// portName. Ready endpoints are preferred; when there are none, endpoints
+// that are terminating but still serving are returned so that connections
+// keep flowing while a workload is being replaced, as kube-proxy does.
+func serviceEndpoints(service corev1.Service, portName string, state clusterState) []endpoint {
+	var ready, terminating []endpoint
+	seenReady := make(map[endpoint]bool)
+	seenTerminating := make(map[endpoint]bool)
+
+	for _, slice := range state.endpointSlices[serviceKey(service.Namespace, service.Name)] {
+		if slice.AddressType != discoveryv1.AddressTypeIPv4 && slice.AddressType != discoveryv1.AddressTypeIPv6 {
+			continue
+		}
+
+		port, ok := endpointSlicePort(slice, portName)
+		if !ok {
+			continue
+		}
+
+		for _, ep := range slice.Endpoints {
+			if len(ep.Addresses) == 0 {
+				continue
+			}
+
+			// All addresses of an endpoint are fungible, the first one is enough
+			e := endpoint{ip: ep.Addresses[0], port: port}
+			if ep.NodeName != nil {
+				e.nodeName = *ep.NodeName
+			}
+
+			switch {
+			case isReady(ep.Conditions):
+				if !seenReady[e] {
+					seenReady[e] = true
+					ready = append(ready, e)
+				}
+			case isServing(ep.Conditions) && isTerminating(ep.Conditions):
+				if !seenTerminating[e] {
+					seenTerminating[e] = true
+					terminating = append(terminating, e)
+				}
+			}
+		}
+	}
+
+	endpoints := ready
+	if len(endpoints) == 0 {
+		endpoints = terminating
+	}
+
+	sort.Slice(endpoints, func(i, j int) bool {
+		if endpoints[i].ip != endpoints[j].ip {
+			return endpoints[i].ip < endpoints[j].ip
+		}
+		return endpoints[i].port < endpoints[j].port
+	})
+
+	return endpoints
+}
+
+// endpointSlicePort returns the port number that slice publishes for the
+// service port named portName.
+func endpointSlicePort(slice *discoveryv1.EndpointSlice, portName string) (int, bool) {
+	for _, port := range slice.Ports {
+		name := ""
+		if port.Name != nil {
+			name = *port.Name
+		}
+
+		if name == portName && port.Port != nil && *port.Port > 0 {
+			return int(*port.Port), true
+		}
+	}
+
+	return 0, false
+}
+
+// isReady reports whether an endpoint can receive new traffic. An unset
+// condition means ready.
+func isReady(conditions discoveryv1.EndpointConditions) bool {
+	return conditions.Ready == nil || *conditions.Ready
+}
+
+// isServing reports whether an endpoint is serving, regardless of whether it
+// is terminating. An unset condition means serving.
+func isServing(conditions discoveryv1.EndpointConditions) bool {
+	return conditions.Serving == nil || *conditions.Serving
+}
+
+// isTerminating reports whether an endpoint is shutting down. An unset
+// condition means not terminating.
+func isTerminating(conditions discoveryv1.EndpointConditions) bool {
+	return conditions.Terminating != nil && *conditions.Terminating
+}
+
+// resolveTargetPort returns the port number that port of service targets on
+// its pods. A named targetPort is looked up in the service's EndpointSlices,
+// which carry the resolved number, and then in the container ports of the
+// pods the service selects. An unset targetPort defaults to the service port.
+func resolveTargetPort(service corev1.Service, port corev1.ServicePort, state clusterState) (int, bool) {
+	if port.TargetPort.Type == intstr.Int {
+		if port.TargetPort.IntVal > 0 {
+			return int(port.TargetPort.IntVal), true
+		}
+		return int(port.Port), port.Port > 0
+	}
+
+	if port.TargetPort.StrVal == "" {
+		return int(port.Port), port.Port > 0
+	}
+
+	for _, slice := range state.endpointSlices[serviceKey(service.Namespace, service.Name)] {
+		if targetPort, ok := endpointSlicePort(slice, port.Name); ok {
+			return targetPort, true
+		}
+	}
+
+	if len(service.Spec.Selector) == 0 {
+		return 0, false
+	}
+
+	if state.podLookups != nil {
+		state.podLookups[service.Namespace] = true
+	}
+
+	selector := labels.SelectorFromSet(service.Spec.Selector)
+
+	for _, pod := range state.pods[service.Namespace] {
+		if !selector.Matches(labels.Set(pod.Labels)) {
+			continue
+		}
+
+		for _, container := range pod.Spec.Containers {
+			for _, containerPort := range container.Ports {
+				if containerPort.Name == port.TargetPort.StrVal && protocol(containerPort.Protocol) == protocol(port.Protocol) {
+					return int(containerPort.ContainerPort), true
+				}
+			}
+		}
+	}
+
+	return 0, false
+}
+
+// protocol returns p, defaulting to TCP as the API server does.
+func protocol(p corev1.Protocol) corev1.Protocol {
+	if p == "" {
+		return corev1.ProtocolTCP
+	}
+	return p
+}
+
+// groupPods groups pods by namespace, in a stable order.
+func groupPods(pods []*corev1.Pod) map[string][]*corev1.Pod {
+	grouped := make(map[string][]*corev1.Pod)
+
+	for _, pod := range pods {
+		grouped[pod.Namespace] = append(grouped[pod.Namespace], pod)
+	}
+
+	for _, namespacePods := range grouped {
+		sort.Slice(namespacePods, func(i, j int) bool {
+			return namespacePods[i].Name < namespacePods[j].Name
+		})
+	}
+
+	return grouped
+}
+
+// trimPod strips a pod down to what resolveTargetPort needs before it enters
+// the informer cache, which otherwise holds every pod of the cluster in full.
+func trimPod(obj interface{}) (interface{}, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return obj, nil
+	}
+
+	trimmed := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            pod.Name,
+			Namespace:       pod.Namespace,
+			UID:             pod.UID,
+			ResourceVersion: pod.ResourceVersion,
+			Labels:          pod.Labels,
+		},
+	}
+
+	for _, container := range pod.Spec.Containers {
+		trimmed.Spec.Containers = append(trimmed.Spec.Containers, corev1.Container{
+			Name:  container.Name,
+			Ports: container.Ports,
+		})
+	}
+
+	return trimmed, nil
+}
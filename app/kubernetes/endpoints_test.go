@@ -0,0 +1,363 @@
+package kubernetes
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+
+	"github.com/cloudresty/nautiluslb/config"
+)
+
+func testClusterIPService(namespace, name string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   namespace,
+			Name:        name,
+			Annotations: map[string]string{EnabledAnnotation: "true"},
+		},
+		Spec: corev1.ServiceSpec{
+			Type:      corev1.ServiceTypeClusterIP,
+			ClusterIP: "10.96.0.10",
+			Ports:     []corev1.ServicePort{{Name: "http", Port: 80, TargetPort: intstr.FromInt32(8080)}},
+		},
+	}
+}
+
+// testEndpointSlice returns an EndpointSlice of service publishing port 8080
+// as "http" for the given endpoints.
+func testEndpointSlice(namespace, service, name string, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    map[string]string{discoveryv1.LabelServiceName: service},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Ports:       []discoveryv1.EndpointPort{{Name: ptr.To("http"), Port: ptr.To(int32(8080))}},
+		Endpoints:   endpoints,
+	}
+}
+
+func testEndpoint(ip string, ready, serving, terminating *bool) discoveryv1.Endpoint {
+	return discoveryv1.Endpoint{
+		Addresses: []string{ip},
+		Conditions: discoveryv1.EndpointConditions{
+			Ready:       ready,
+			Serving:     serving,
+			Terminating: terminating,
+		},
+	}
+}
+
+func endpointIPs(endpoints []endpoint) []string {
+	var ips []string
+	for _, ep := range endpoints {
+		ips = append(ips, ep.ip)
+	}
+	return ips
+}
+
+func TestServiceEndpoints(t *testing.T) {
+	service := *testClusterIPService("default", "web")
+
+	tests := []struct {
+		name     string
+		slices   []*discoveryv1.EndpointSlice
+		expected []string
+	}{
+		{
+			name: "Ready endpoints only",
+			slices: []*discoveryv1.EndpointSlice{
+				testEndpointSlice("default", "web", "web-a",
+					testEndpoint("10.1.0.2", ptr.To(true), ptr.To(true), ptr.To(false)),
+					testEndpoint("10.1.0.1", nil, nil, nil),
+					testEndpoint("10.1.0.3", ptr.To(false), ptr.To(false), ptr.To(false)),
+				),
+			},
+			expected: []string{"10.1.0.1", "10.1.0.2"},
+		},
+		{
+			name: "Terminating endpoints are skipped while others are ready",
+			slices: []*discoveryv1.EndpointSlice{
+				testEndpointSlice("default", "web", "web-a",
+					testEndpoint("10.1.0.1", ptr.To(true), ptr.To(true), ptr.To(false)),
+					testEndpoint("10.1.0.2", ptr.To(false), ptr.To(true), ptr.To(true)),
+				),
+			},
+			expected: []string{"10.1.0.1"},
+		},
+		{
+			name: "Serving terminating endpoints when none are ready",
+			slices: []*discoveryv1.EndpointSlice{
+				testEndpointSlice("default", "web", "web-a",
+					testEndpoint("10.1.0.1", ptr.To(false), ptr.To(false), ptr.To(true)),
+					testEndpoint("10.1.0.2", ptr.To(false), ptr.To(true), ptr.To(true)),
+				),
+			},
+			expected: []string{"10.1.0.2"},
+		},
+		{
+			name: "Duplicates across slices",
+			slices: []*discoveryv1.EndpointSlice{
+				testEndpointSlice("default", "web", "web-a", testEndpoint("10.1.0.1", nil, nil, nil)),
+				testEndpointSlice("default", "web", "web-b", testEndpoint("10.1.0.1", nil, nil, nil)),
+			},
+			expected: []string{"10.1.0.1"},
+		},
+		{
+			name: "Slices of other services",
+			slices: []*discoveryv1.EndpointSlice{
+				testEndpointSlice("default", "api", "api-a", testEndpoint("10.1.0.1", nil, nil, nil)),
+				testEndpointSlice("staging", "web", "web-a", testEndpoint("10.1.0.2", nil, nil, nil)),
+			},
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := clusterState{endpointSlices: groupEndpointSlices(tt.slices)}
+
+			got := endpointIPs(serviceEndpoints(service, "http", state))
+			if len(got) != len(tt.expected) || (len(got) > 0 && !equalStrings(got, tt.expected)) {
+				t.Errorf("serviceEndpoints() = %v; want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestServiceEndpointsPort(t *testing.T) {
+	service := *testClusterIPService("default", "web")
+
+	slice := testEndpointSlice("default", "web", "web-a", testEndpoint("10.1.0.1", nil, nil, nil))
+	slice.Ports = []discoveryv1.EndpointPort{
+		{Name: ptr.To("metrics"), Port: ptr.To(int32(9090))},
+		{Name: ptr.To("http"), Port: ptr.To(int32(8081))},
+	}
+
+	state := clusterState{endpointSlices: groupEndpointSlices([]*discoveryv1.EndpointSlice{slice})}
+
+	endpoints := serviceEndpoints(service, "http", state)
+	if len(endpoints) != 1 || endpoints[0].port != 8081 {
+		t.Errorf("serviceEndpoints() = %v; want the pod port of http", endpoints)
+	}
+}
+
+func TestServiceBackendMode(t *testing.T) {
+	tests := []struct {
+		name        string
+		configMode  string
+		annotations map[string]string
+		expected    string
+		wantErr     bool
+	}{
+		{"Configuration default", "", nil, config.BackendModeService, false},
+		{"Configuration endpoints", config.BackendModeEndpoints, nil, config.BackendModeEndpoints, false},
+		{"Annotation overrides", "", map[string]string{BackendModeAnnotation: "endpoints"}, config.BackendModeEndpoints, false},
+		{"Annotation back to service", config.BackendModeEndpoints, map[string]string{BackendModeAnnotation: " service "}, config.BackendModeService, false},
+		{"Invalid annotation", config.BackendModeEndpoints, map[string]string{BackendModeAnnotation: "pods"}, config.BackendModeEndpoints, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := corev1.Service{}
+			service.Name = "web"
+			service.Annotations = tt.annotations
+
+			cfg := config.Configuration{BackendMode: tt.configMode}
+			got, err := serviceBackendMode(service, cfg)
+			if got != tt.expected || (err != nil) != tt.wantErr {
+				t.Errorf("serviceBackendMode() = %q, %v; want %q, wantErr %v", got, err, tt.expected, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProcessServicesForConfigEndpoints(t *testing.T) {
+	cfg := config.Configuration{Name: "web", BackendPortName: "http", BackendMode: config.BackendModeEndpoints}
+
+	service := *testClusterIPService("default", "web")
+	headless := *testClusterIPService("default", "headless")
+	headless.Spec.ClusterIP = corev1.ClusterIPNone
+
+	state := clusterState{endpointSlices: groupEndpointSlices([]*discoveryv1.EndpointSlice{
+		testEndpointSlice("default", "web", "web-a", testEndpoint("10.1.0.1", nil, nil, nil)),
+		testEndpointSlice("default", "headless", "headless-a", testEndpoint("10.1.0.2", nil, nil, nil)),
+	})}
+
+	backends := processServicesForConfig([]corev1.Service{service}, cfg, state)
+	if len(backends) != 1 || backends[0].Address() != "10.1.0.1:8080" {
+		t.Errorf("Expected the pod backend in endpoints mode, got %v", backends)
+	}
+
+	cfg.BackendMode = config.BackendModeService
+	backends = processServicesForConfig([]corev1.Service{service, headless}, cfg, state)
+
+	var got []string
+	for _, server := range backends {
+		got = append(got, server.Address())
+	}
+
+	expected := []string{"10.96.0.10:8080", "10.1.0.2:8080"}
+	if len(got) != len(expected) || !equalStrings(got, expected) {
+		t.Errorf("Backends = %v; want %v", got, expected)
+	}
+}
+
+func TestWatcherPushesEndpointChanges(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewClientset(testClusterIPService("default", "web"))
+
+	lb := startWatcher(t, client, config.Configuration{Name: "web", BackendPortName: "http", BackendMode: config.BackendModeEndpoints})
+
+	slices := client.DiscoveryV1().EndpointSlices("default")
+
+	slice := testEndpointSlice("default", "web", "web-a", testEndpoint("10.1.0.1", nil, nil, nil))
+	if _, err := slices.Create(ctx, slice, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create endpoint slice: %v", err)
+	}
+	waitForBackends(t, lb, "10.1.0.1:8080")
+
+	slice.Endpoints = append(slice.Endpoints, testEndpoint("10.1.0.2", nil, nil, nil))
+	if _, err := slices.Update(ctx, slice, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update endpoint slice: %v", err)
+	}
+	waitForBackends(t, lb, "10.1.0.1:8080", "10.1.0.2:8080")
+
+	slice.Endpoints[0].Conditions.Ready = ptr.To(false)
+	if _, err := slices.Update(ctx, slice, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update endpoint slice: %v", err)
+	}
+	waitForBackends(t, lb, "10.1.0.2:8080")
+}
+
+func TestResolveTargetPort(t *testing.T) {
+	service := *testClusterIPService("default", "web")
+	service.Spec.Selector = map[string]string{"app": "web"}
+
+	pod := func(namespace, name, app string, portName string, port int32) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: map[string]string{"app": app}},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{
+					Name:  "app",
+					Ports: []corev1.ContainerPort{{Name: portName, ContainerPort: port, Protocol: corev1.ProtocolTCP}},
+				}},
+			},
+		}
+	}
+
+	slices := groupEndpointSlices([]*discoveryv1.EndpointSlice{
+		testEndpointSlice("default", "web", "web-a", testEndpoint("10.1.0.1", nil, nil, nil)),
+	})
+
+	pods := groupPods([]*corev1.Pod{
+		pod("default", "api-1", "api", "web", 7070),
+		pod("staging", "web-1", "web", "web", 6060),
+		pod("default", "web-1", "web", "web", 9090),
+	})
+
+	tests := []struct {
+		name       string
+		targetPort intstr.IntOrString
+		state      clusterState
+		expected   int
+		ok         bool
+	}{
+		{"Numeric", intstr.FromInt32(8080), clusterState{}, 8080, true},
+		{"Unset", intstr.IntOrString{}, clusterState{}, 80, true},
+		{"Empty name", intstr.FromString(""), clusterState{}, 80, true},
+		{"Named from endpoint slices", intstr.FromString("web"), clusterState{endpointSlices: slices, pods: pods}, 8080, true},
+		{"Named from pods", intstr.FromString("web"), clusterState{pods: pods}, 9090, true},
+		{"Named without match", intstr.FromString("grpc"), clusterState{pods: pods}, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := corev1.ServicePort{Name: "http", Port: 80, TargetPort: tt.targetPort}
+
+			got, ok := resolveTargetPort(service, port, tt.state)
+			if got != tt.expected || ok != tt.ok {
+				t.Errorf("resolveTargetPort() = %d, %v; want %d, %v", got, ok, tt.expected, tt.ok)
+			}
+		})
+	}
+}
+
+func TestResolveTargetPortWithoutSelector(t *testing.T) {
+	service := *testClusterIPService("default", "external")
+
+	pods := groupPods([]*corev1.Pod{{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Ports: []corev1.ContainerPort{{Name: "web", ContainerPort: 9090}}}},
+		},
+	}})
+
+	port := corev1.ServicePort{Name: "http", Port: 80, TargetPort: intstr.FromString("web")}
+	if _, ok := resolveTargetPort(service, port, clusterState{pods: pods}); ok {
+		t.Error("Services without a selector should not match every pod")
+	}
+}
+
+func TestTrimPod(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "web-1",
+			Labels:      map[string]string{"app": "web"},
+			Annotations: map[string]string{"large": "value"},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{{
+				Name:  "app",
+				Image: "web:1.0",
+				Ports: []corev1.ContainerPort{{Name: "web", ContainerPort: 9090}},
+			}},
+		},
+	}
+
+	obj, err := trimPod(pod)
+	if err != nil {
+		t.Fatalf("trimPod() error = %v", err)
+	}
+
+	trimmed := obj.(*corev1.Pod)
+	if trimmed.Labels["app"] != "web" || trimmed.Spec.Containers[0].Ports[0].ContainerPort != 9090 {
+		t.Errorf("trimPod() dropped labels or ports: %+v", trimmed)
+	}
+
+	if trimmed.Annotations != nil || trimmed.Spec.NodeName != "" || trimmed.Spec.Containers[0].Image != "" {
+		t.Errorf("trimPod() kept fields it does not need: %+v", trimmed)
+	}
+}
+
+func TestUnresolvedTargetPortIsRecorded(t *testing.T) {
+	service := *testClusterIPService("default", "web")
+	service.Generation = 3
+	service.Spec.Ports[0].TargetPort = intstr.FromString("grpc")
+
+	cfg := config.Configuration{Name: "web", BackendPortName: "http"}
+	state := clusterState{unresolvedPorts: make(map[string]bool)}
+
+	if backends := processServicesForConfig([]corev1.Service{service}, cfg, state); len(backends) != 0 {
+		t.Fatalf("Expected no backends for an unresolved target port, got %d", len(backends))
+	}
+
+	key := unresolvedPortKey(service, service.Spec.Ports[0])
+	if !state.unresolvedPorts[key] {
+		t.Errorf("Expected %q to be recorded as unresolved, got %v", key, state.unresolvedPorts)
+	}
+
+	service.Generation++
+	if unresolvedPortKey(service, service.Spec.Ports[0]) == key {
+		t.Error("Expected a new generation of the service to be logged again")
+	}
+}
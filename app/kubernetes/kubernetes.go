@@ -5,12 +5,11 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
+	"reflect"
 	"sync"
-	"time"
 
 	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -27,7 +26,7 @@ var (
 	sharedK8sClient *kubernetes.Clientset
 )
 
-// LoadBalancerInterface defines the methods that DiscoverK8sServices needs from the LoadBalancer.
+// LoadBalancerInterface defines the methods that service discovery needs from the LoadBalancer.
 type LoadBalancerInterface interface {
 	StartHealthChecks()
 	GetMu() *sync.RWMutex
@@ -107,278 +106,25 @@ func GetK8sClient(kubeconfigPath string) (*kubernetes.Clientset, string, error)
 
 }
 
-// defaultHealthCheckInterval is the interval in seconds between health checks.
-var defaultHealthCheckInterval int = 30
-
-// matchesLabelSelector checks if service labels match the given label selector
+// matchesLabelSelector checks if service labels match the given label selector,
+// written in Kubernetes selector syntax. Invalid selectors match nothing.
 func matchesLabelSelector(serviceLabels map[string]string, labelSelector string) bool {
 	if labelSelector == "" {
 		return true // Empty selector matches everything
 	}
 
-	// Parse label selector (format: "key1=value1,key2=value2")
-	pairs := strings.Split(labelSelector, ",")
-	for _, pair := range pairs {
-		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
-		if len(parts) != 2 {
-			continue
-		}
-		key := strings.TrimSpace(parts[0])
-		value := strings.TrimSpace(parts[1])
-
-		if serviceLabels[key] != value {
-			return false
-		}
-	}
-	return true
-}
-
-// DiscoverK8sServices discovers services in Kubernetes and adds them as backends.
-func DiscoverK8sServices(lb LoadBalancerInterface, config config.Configuration) {
-
-	// Get the shared Kubernetes client, it should already be initialized
-	k8sClient, err := GetSharedClient()
-
-	if err != nil {
-		return
-	}
-
-	backendCache := make(map[string]backend.BackendServer)
-
-	watchServices := func() {
-
-		for {
-
-			sleepDuration := time.Duration(defaultHealthCheckInterval) * time.Second
-
-			// The sleep duration is now always the default interval
-			// since we removed config.HealthCheckInterval
-			// If you want to make this configurable in the future, you'll need to
-
-			// Use the namespace from config, default to all namespaces if empty
-			namespace := config.Namespace
-			if namespace == "" {
-				namespace = "" // All namespaces (empty string means all namespaces)
-			}
-
-			services, err := k8sClient.CoreV1().Services(namespace).List(context.TODO(), metav1.ListOptions{})
-
-			if err != nil {
-				emit.Error.StructuredFields("Failed to list services",
-					emit.ZString("namespace", namespace),
-					emit.ZString("error", err.Error()))
-				continue
-			}
-
-			lb.GetMu().Lock()
-
-			// Create a map to track the new backends
-			newBackends := make(map[string]*backend.BackendServer)
-			nextBackendID := 1
-
-			// Iterate over all services
-			for _, service := range services.Items { // Check for the custom annotation
-				if enabled, ok := service.Annotations["nautiluslb.cloudresty.io/enabled"]; ok && enabled == "true" {
-
-					// Skip label selector check - just use annotation + namespace + port name
-					// This allows services without specific labels to be discovered
-
-					switch service.Spec.Type {
-					case corev1.ServiceTypeNodePort, corev1.ServiceTypeLoadBalancer:
-
-						// For NodePort and LoadBalancer services, we can use the NodePort directly.
-						for _, port := range service.Spec.Ports {
-
-							nodeIPs := getNodeIPs()
-
-							for _, nodeIP := range nodeIPs {
-								backend := &backend.BackendServer{
-									ID:       nextBackendID,
-									IP:       nodeIP,
-									Port:     int(port.NodePort),
-									PortName: port.Name,
-									Weight:   1,
-									Healthy:  true,
-								}
-								newBackends[fmt.Sprintf("%s:%d", backend.IP, backend.Port)] = backend
-								nextBackendID++
-
-								// Use the service name from the Kubernetes API object
-								serviceType := "NodePort" // or "LoadBalancer" depending on the actual type
-
-								// Check if the backend is already in the cache
-								if _, exists := backendCache[fmt.Sprintf("%s:%d", backend.IP, backend.Port)]; !exists {
-									backendCache[fmt.Sprintf("%s:%d", backend.IP, backend.Port)] = *backend
-								}
-
-								// Update the cache with the new backend information
-								existingBackend, ok := backendCache[fmt.Sprintf("%s:%d", backend.IP, backend.Port)]
-								if ok && (existingBackend.IP != backend.IP || existingBackend.Port != backend.Port) {
-									emit.Debug.StructuredFields("Updating backend",
-										emit.ZString("service_name", service.Name),
-										emit.ZString("service_type", serviceType),
-										emit.ZString("backend_ip", backend.IP),
-										emit.ZInt("backend_port", backend.Port))
-									backendCache[fmt.Sprintf("%s:%d", backend.IP, backend.Port)] = *backend
-								}
-
-							}
-
-							// Simplified: Use NodePort directly without pod discovery
-							// This works with annotation-only approach
-
-						}
-
-					case corev1.ServiceTypeClusterIP:
-
-						// For ClusterIP services, we use the ClusterIP and the target port.
-						if len(service.Spec.Ports) > 0 {
-
-							for _, port := range service.Spec.Ports {
-
-								emit.Debug.StructuredFields("Found ClusterIP port",
-									emit.ZString("port_name", port.Name),
-									emit.ZInt("target_port", int(port.TargetPort.IntVal)))
-
-								if port.TargetPort.IntVal > 0 {
-
-									// Create a backend for each port of the ClusterIP service
-									backend := &backend.BackendServer{
-										ID:       nextBackendID,
-										IP:       service.Spec.ClusterIP,
-										Port:     int(port.TargetPort.IntVal),
-										PortName: port.Name,
-										Weight:   1,
-										Healthy:  true,
-									}
-
-									newBackends[fmt.Sprintf("%s:%d", backend.IP, backend.Port)] = backend
-									nextBackendID++
-
-								} else {
-
-									emit.Warn.StructuredFields("Skipping port - TargetPort not defined",
-										emit.ZString("port_name", port.Name))
-
-								}
-
-							}
-
-						} else {
-
-							emit.Warn.StructuredFields("No ports found for ClusterIP service",
-								emit.ZString("service_name", service.Name))
-
-						}
-
-					default:
-						emit.Warn.StructuredFields("Service type not supported",
-							emit.ZString("service_type", string(service.Spec.Type)),
-							emit.ZString("service_name", service.Name))
-
-					}
-
-				}
-
-			}
-
-			// Compare new backends with existing backends
-			existingBackends := lb.GetBackendServers()
-			backendsChanged := false
-
-			if len(newBackends) != len(existingBackends) {
-
-				backendsChanged = true
-
-			} else {
-
-				for _, newBackend := range newBackends {
-
-					found := false
-
-					for _, existingBackend := range existingBackends {
-
-						if newBackend.IP == existingBackend.IP && newBackend.Port == existingBackend.Port {
-							found = true
-							break
-						}
-
-					}
-
-					if !found {
-						backendsChanged = true
-						break
-					}
-
-				}
-
-			}
-
-			if backendsChanged {
-
-				// Clear existing backends before adding new ones from K8s
-				lb.SetBackendServers([]*backend.BackendServer{})
-
-				// Accumulate the new backends in a temporary list
-				var backendList []*backend.BackendServer
-
-				// Add the new backends to the list
-				for _, backend := range newBackends {
-					backendList = append(backendList, backend)
-				}
-
-				lb.SetBackendServers(backendList)
-
-			}
-
-			lb.GetMu().Unlock()
-
-			time.Sleep(sleepDuration) // Sleep before re-listing
-
-			if backendsChanged {
-
-				emit.Info.Msg("Backend servers changed, updating background health checks")
-				lb.StartHealthChecks()
-				emit.Info.Msg("Background health checks configuration updated")
-
-			} else {
-				// Backend servers unchanged, skipping background health checks configuration update
-				emit.Debug.Msg("Backend servers unchanged")
-			}
-		}
-
-	}
-
-	go watchServices()
-
-}
-
-func getNodeIPs() []string {
-
-	nodes, err := sharedK8sClient.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
+	selector, err := labels.Parse(labelSelector)
 	if err != nil {
-		emit.Error.StructuredFields("Failed to list nodes",
-			emit.ZString("error", err.Error()))
-		return []string{}
-	}
-
-	var ips []string
-
-	for _, node := range nodes.Items {
-		for _, addr := range node.Status.Addresses {
-			if addr.Type == corev1.NodeInternalIP {
-				ips = append(ips, addr.Address)
-				break
-			}
-		}
+		return false
 	}
 
-	return ips
-
+	return selector.Matches(labels.Set(serviceLabels))
 }
 
-// DiscoverK8sServicesForAll discovers services for all load balancers centrally
-func DiscoverK8sServicesForAll(loadBalancers []LoadBalancerInterface, configs []config.Configuration) {
+// DiscoverK8sServicesForAll keeps the backends of all load balancers in sync
+// with the cluster until ctx is done. It returns an error when discovery
+// cannot run or stops before that.
+func DiscoverK8sServicesForAll(ctx context.Context, loadBalancers []LoadBalancerInterface, configs []config.Configuration) error {
 
 	emit.Info.Msg("Starting centralized service discovery for all load balancers")
 
@@ -387,94 +133,41 @@ func DiscoverK8sServicesForAll(loadBalancers []LoadBalancerInterface, configs []
 	if err != nil {
 		emit.Error.StructuredFields("Failed to get K8s client in centralized discovery",
 			emit.ZString("error", err.Error()))
-		return
-	}
-
-	// Create a map of config name to load balancer for quick lookup
-	configToLB := make(map[string]LoadBalancerInterface)
-	for i, config := range configs {
-		if i < len(loadBalancers) {
-			configToLB[config.Name] = loadBalancers[i]
-		}
-	}
-
-	// Main discovery loop
-	for {
-		sleepDuration := time.Duration(defaultHealthCheckInterval) * time.Second
-
-		// Group configs by namespace for efficient API calls
-		namespaceConfigs := make(map[string][]config.Configuration)
-		for _, cfg := range configs {
-			namespace := cfg.Namespace
-			if namespace == "" {
-				namespace = "all" // Special key for all namespaces
-			}
-			namespaceConfigs[namespace] = append(namespaceConfigs[namespace], cfg)
-		}
-
-		// Discover services per namespace
-		for namespace, nsConfigs := range namespaceConfigs {
-			discoverServicesForNamespace(k8sClient, namespace, nsConfigs, configToLB)
-		}
-
-		time.Sleep(sleepDuration)
-	}
-}
-
-// discoverServicesForNamespace discovers services in a specific namespace for centralized discovery
-func discoverServicesForNamespace(k8sClient *Clientset, namespace string, configs []config.Configuration, configToLB map[string]LoadBalancerInterface) {
-	// Use empty string for all namespaces
-	searchNamespace := namespace
-	if namespace == "all" {
-		searchNamespace = ""
+		return err
 	}
 
-	services, err := k8sClient.CoreV1().Services(searchNamespace).List(context.TODO(), metav1.ListOptions{})
-	if err != nil {
-		emit.Error.StructuredFields("Failed to list services in centralized discovery",
-			emit.ZString("namespace", namespace),
+	watcher := NewWatcher(k8sClient, loadBalancers, configs)
+	if err := watcher.Run(ctx); err != nil {
+		emit.Error.StructuredFields("Service discovery stopped",
 			emit.ZString("error", err.Error()))
-		return
+		return err
 	}
 
-	// Process each configuration
-	for _, cfg := range configs {
-		backends := processServicesForConfig(services.Items, cfg)
-
-		// Update the corresponding LoadBalancer
-		if lb, exists := configToLB[cfg.Name]; exists {
-			currentBackends := lb.GetBackendServers()
+	emit.Info.Msg("Service discovery stopped")
 
-			// Only update if backends changed
-			if !backendsEqual(currentBackends, backends) {
-				lb.SetBackendServers(backends)
-				emit.Info.StructuredFields("Updated backends for config",
-					emit.ZInt("backend_count", len(backends)),
-					emit.ZString("config_name", cfg.Name))
+	return nil
 
-				// Start health checks
-				go lb.StartHealthChecks()
-			}
-		}
-	}
 }
 
 // processServicesForConfig processes services for a specific configuration in centralized discovery
-func processServicesForConfig(services []corev1.Service, cfg config.Configuration) []*backend.BackendServer {
+func processServicesForConfig(services []corev1.Service, cfg config.Configuration, state clusterState) []*backend.BackendServer {
 	var backends []*backend.BackendServer
 	backendID := 1
 
 	for _, service := range services {
 		// Check for annotation
-		if enabled, ok := service.Annotations["nautiluslb.cloudresty.io/enabled"]; !ok || enabled != "true" {
+		if enabled, ok := service.Annotations[EnabledAnnotation]; !ok || enabled != "true" {
 			continue
 		}
 
-		// Skip label selector check - just use annotation + namespace + port name
-		// This allows services without specific labels to be discovered
+		// Informers already filter on the selector, this keeps the result
+		// correct whatever the services come from
+		if !matchesLabelSelector(service.Labels, cfg.LabelSelector) {
+			continue
+		}
 
 		// Process the service based on type
-		serviceBackends := processServiceForConfig(service, cfg, &backendID)
+		serviceBackends := processServiceForConfig(service, cfg, state, &backendID)
 		backends = append(backends, serviceBackends...)
 	}
 
@@ -482,9 +175,32 @@ func processServicesForConfig(services []corev1.Service, cfg config.Configuratio
 }
 
 // processServiceForConfig processes a single service for centralized discovery
-func processServiceForConfig(service corev1.Service, cfg config.Configuration, backendID *int) []*backend.BackendServer {
+func processServiceForConfig(service corev1.Service, cfg config.Configuration, state clusterState, backendID *int) []*backend.BackendServer {
 	var backends []*backend.BackendServer
 
+	// Invalid annotations are reported by the watcher
+	overrides, _ := parseServiceOverrides(service, cfg)
+
+	addBackend := func(ip string, port int, portName string) *backend.BackendServer {
+		server := &backend.BackendServer{
+			ID:                  *backendID,
+			IP:                  ip,
+			Port:                port,
+			PortName:            portName,
+			Weight:              overrides.weight,
+			Healthy:             true,
+			HealthCheckOverride: overrides.healthCheck,
+			Strategy:            overrides.strategy,
+			IdleTimeout:         overrides.idleTimeout,
+			ProxyProtocol:       overrides.proxyProtocol,
+			MaxConnections:      overrides.maxConnections,
+		}
+		backends = append(backends, server)
+		*backendID++
+
+		return server
+	}
+
 	switch service.Spec.Type {
 	case corev1.ServiceTypeNodePort, corev1.ServiceTypeLoadBalancer:
 		for _, port := range service.Spec.Ports {
@@ -492,39 +208,71 @@ func processServiceForConfig(service corev1.Service, cfg config.Configuration, b
 				continue
 			}
 
-			nodeIPs := getNodeIPs()
-			for _, nodeIP := range nodeIPs {
-				backend := &backend.BackendServer{
-					ID:       *backendID,
-					IP:       nodeIP,
-					Port:     int(port.NodePort),
-					PortName: port.Name,
-					Weight:   1,
-					Healthy:  true,
+			nodes := state.nodes
+			var healthCheck *config.HealthCheckConfig
+
+			// Only nodes running an endpoint answer when the traffic policy
+			// is Local, kube-proxy tells which ones when the slices do not
+			if service.Spec.ExternalTrafficPolicy == corev1.ServiceExternalTrafficPolicyLocal {
+				if local, ok := localNodes(service, port.Name, state); ok {
+					nodes = local
+				} else if service.Spec.HealthCheckNodePort > 0 {
+					settings := cfg.HealthCheck
+					if overrides.healthCheck != nil {
+						settings = *overrides.healthCheck
+					}
+					healthCheck = localHealthCheck(service, settings)
+				}
+			}
+
+			for _, node := range nodes {
+				server := addBackend(node.ip, int(port.NodePort), port.Name)
+				if healthCheck != nil {
+					server.HealthCheckOverride = healthCheck
 				}
-				backends = append(backends, backend)
-				*backendID++
 			}
 		}
 
 	case corev1.ServiceTypeClusterIP:
+		// Headless services have no cluster IP to send traffic to
+		useEndpoints := overrides.backendMode == config.BackendModeEndpoints ||
+			service.Spec.ClusterIP == corev1.ClusterIPNone
+
 		for _, port := range service.Spec.Ports {
 			if port.Name != cfg.BackendPortName {
 				continue
 			}
 
-			if port.TargetPort.IntVal > 0 {
-				backend := &backend.BackendServer{
-					ID:       *backendID,
-					IP:       service.Spec.ClusterIP,
-					Port:     int(port.TargetPort.IntVal),
-					PortName: port.Name,
-					Weight:   1,
-					Healthy:  true,
+			if useEndpoints {
+				for _, ep := range serviceEndpoints(service, port.Name, state) {
+					addBackend(ep.ip, ep.port, port.Name)
 				}
-				backends = append(backends, backend)
-				*backendID++
+				continue
 			}
+
+			targetPort, ok := resolveTargetPort(service, port, state)
+			if !ok {
+				// Logged once per service change rather than on every
+				// reconciliation, and not before the pods are known
+				key := unresolvedPortKey(service, port)
+				pending := state.podLookups[service.Namespace] && !state.podsWatched
+				log := emit.Warn.StructuredFields
+				if pending || state.unresolvedPorts[key] || state.loggedUnresolvedPorts[key] {
+					log = emit.Debug.StructuredFields
+				}
+				if state.unresolvedPorts != nil && !pending {
+					state.unresolvedPorts[key] = true
+				}
+
+				log("Skipping port - TargetPort could not be resolved",
+					emit.ZString("service_name", service.Name),
+					emit.ZString("namespace", service.Namespace),
+					emit.ZString("port_name", port.Name),
+					emit.ZString("target_port", port.TargetPort.String()))
+				continue
+			}
+
+			addBackend(service.Spec.ClusterIP, targetPort, port.Name)
 		}
 
 	default:
@@ -536,6 +284,12 @@ func processServiceForConfig(service corev1.Service, cfg config.Configuration, b
 	return backends
 }
 
+// unresolvedPortKey identifies a port of a given generation of service, see
+// clusterState.unresolvedPorts.
+func unresolvedPortKey(service corev1.Service, port corev1.ServicePort) string {
+	return fmt.Sprintf("%s/%s/%d", serviceKey(service.Namespace, service.Name), port.Name, service.Generation)
+}
+
 // backendsEqual compares two backend slices for centralized discovery
 func backendsEqual(old, new []*backend.BackendServer) bool {
 	if len(old) != len(new) {
@@ -550,7 +304,15 @@ func backendsEqual(old, new []*backend.BackendServer) bool {
 
 	for _, b := range new {
 		key := fmt.Sprintf("%s:%d", b.IP, b.Port)
-		if _, exists := oldMap[key]; !exists {
+		existing, exists := oldMap[key]
+		if !exists || existing.Weight != b.Weight {
+			return false
+		}
+		if !reflect.DeepEqual(existing.HealthCheckOverride, b.HealthCheckOverride) {
+			return false
+		}
+		if existing.Strategy != b.Strategy || existing.IdleTimeout != b.IdleTimeout ||
+			existing.ProxyProtocol != b.ProxyProtocol || existing.MaxConnections != b.MaxConnections {
 			return false
 		}
 	}
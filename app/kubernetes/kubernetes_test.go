@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 
 	"github.com/cloudresty/nautiluslb/backend"
 	"github.com/cloudresty/nautiluslb/config"
@@ -74,6 +75,42 @@ func TestMatchesLabelSelector(t *testing.T) {
 			labelSelector:  "app=nginx,env=dev",
 			expectedResult: false,
 		},
+		{
+			name:           "Set based in",
+			serviceLabels:  map[string]string{"env": "prod"},
+			labelSelector:  "env in (prod, staging)",
+			expectedResult: true,
+		},
+		{
+			name:           "Set based notin",
+			serviceLabels:  map[string]string{"env": "prod"},
+			labelSelector:  "env notin (prod)",
+			expectedResult: false,
+		},
+		{
+			name:           "Key exists",
+			serviceLabels:  map[string]string{"canary": "yes"},
+			labelSelector:  "canary",
+			expectedResult: true,
+		},
+		{
+			name:           "Key does not exist",
+			serviceLabels:  map[string]string{"canary": "yes"},
+			labelSelector:  "!canary",
+			expectedResult: false,
+		},
+		{
+			name:           "Inequality",
+			serviceLabels:  map[string]string{"app": "nginx"},
+			labelSelector:  "app!=apache",
+			expectedResult: true,
+		},
+		{
+			name:           "Invalid selector",
+			serviceLabels:  map[string]string{"app": "nginx"},
+			labelSelector:  "app in nginx",
+			expectedResult: false,
+		},
 		{
 			name: "Extra service labels should not affect match",
 			serviceLabels: map[string]string{
@@ -187,6 +224,16 @@ func TestBackendsEqual(t *testing.T) {
 			},
 			expected: true, // The current implementation is order-independent
 		},
+		{
+			name: "Different weights",
+			old: []*backend.BackendServer{
+				{ID: 1, IP: "192.168.1.1", Port: 8080, PortName: "http", Weight: 1},
+			},
+			new: []*backend.BackendServer{
+				{ID: 1, IP: "192.168.1.1", Port: 8080, PortName: "http", Weight: 5},
+			},
+			expected: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -210,18 +257,118 @@ func TestProcessServicesForConfig(t *testing.T) {
 	}
 
 	// Test with empty services
-	backends := processServicesForConfig(nil, cfg)
+	backends := processServicesForConfig(nil, cfg, clusterState{})
 	if len(backends) != 0 {
 		t.Errorf("Expected 0 backends for nil services, got %d", len(backends))
 	}
 
 	// Test with empty slice
-	backends = processServicesForConfig([]corev1.Service{}, cfg)
+	backends = processServicesForConfig([]corev1.Service{}, cfg, clusterState{})
 	if len(backends) != 0 {
 		t.Errorf("Expected 0 backends for empty services, got %d", len(backends))
 	}
 }
 
+func TestServiceWeight(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		expected    int
+		wantErr     bool
+	}{
+		{"No annotation", nil, 1, false},
+		{"Valid weight", map[string]string{WeightAnnotation: "5"}, 5, false},
+		{"Weight with whitespace", map[string]string{WeightAnnotation: " 3 "}, 3, false},
+		{"Zero weight", map[string]string{WeightAnnotation: "0"}, 1, true},
+		{"Negative weight", map[string]string{WeightAnnotation: "-2"}, 1, true},
+		{"Non-numeric weight", map[string]string{WeightAnnotation: "heavy"}, 1, true},
+		{"Largest weight", map[string]string{WeightAnnotation: "1000"}, 1000, false},
+		{"Weight too large", map[string]string{WeightAnnotation: "10000000"}, 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := corev1.Service{}
+			service.Name = "test-service"
+			service.Annotations = tt.annotations
+
+			got, err := serviceWeight(service)
+			if got != tt.expected || (err != nil) != tt.wantErr {
+				t.Errorf("serviceWeight() = %d, %v; want %d, wantErr %v", got, err, tt.expected, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProcessServicesForConfigWeight(t *testing.T) {
+	cfg := config.Configuration{
+		Name:            "test-config",
+		BackendPortName: "http",
+		ListenerAddress: ":80",
+	}
+
+	service := corev1.Service{}
+	service.Name = "canary"
+	service.Annotations = map[string]string{
+		EnabledAnnotation: "true",
+		WeightAnnotation:  "10",
+	}
+	service.Spec.Type = corev1.ServiceTypeClusterIP
+	service.Spec.ClusterIP = "10.96.0.10"
+	service.Spec.Ports = []corev1.ServicePort{
+		{Name: "http", Port: 80, TargetPort: intstr.FromInt32(8080)},
+	}
+
+	backends := processServicesForConfig([]corev1.Service{service}, cfg, clusterState{})
+	if len(backends) != 1 {
+		t.Fatalf("Expected 1 backend, got %d", len(backends))
+	}
+
+	if backends[0].Weight != 10 {
+		t.Errorf("Expected weight 10 from annotation, got %d", backends[0].Weight)
+	}
+}
+
+func TestServiceHealthCheck(t *testing.T) {
+	cfg := config.Configuration{
+		Name:            "test-config",
+		BackendPortName: "http",
+		HealthCheck:     config.HealthCheckConfig{Interval: 5},
+	}
+
+	service := corev1.Service{}
+	service.Name = "web"
+
+	if got, err := serviceHealthCheck(service, cfg); got != nil || err != nil {
+		t.Errorf("Expected no override without annotation, got %+v, %v", got, err)
+	}
+
+	service.Annotations = map[string]string{HealthPathAnnotation: "/healthz"}
+	got, err := serviceHealthCheck(service, cfg)
+	if got == nil || err != nil {
+		t.Fatal("Expected an override from the health path annotation")
+	}
+
+	if got.Type != config.HealthCheckHTTP || got.HTTP.Path != "/healthz" {
+		t.Errorf("Expected HTTP check on /healthz, got type %q path %q", got.Type, got.HTTP.Path)
+	}
+
+	if got.Interval != 5 {
+		t.Errorf("Expected configuration settings to be kept, got interval %d", got.Interval)
+	}
+
+	// An HTTPS check from the configuration stays HTTPS
+	cfg.HealthCheck.Type = config.HealthCheckHTTPS
+	if got, _ := serviceHealthCheck(service, cfg); got.Type != config.HealthCheckHTTPS {
+		t.Errorf("Expected HTTPS check to be kept, got %q", got.Type)
+	}
+
+	service.Annotations[HealthPathAnnotation] = "healthz"
+	if got, err := serviceHealthCheck(service, cfg); got != nil || err == nil {
+		t.Errorf("Expected invalid path to be ignored and reported, got %+v, %v", got, err)
+	}
+}
+
 // Mock LoadBalancer interface for testing
 type MockLoadBalancer struct {
 	mu             *sync.RWMutex
@@ -246,6 +393,8 @@ func (m *MockLoadBalancer) SetBackendServers(servers []*backend.BackendServer) {
 	m.backendServers = servers
 }
 
+func (m *MockLoadBalancer) StartHealthChecks() {}
+
 func TestMockLoadBalancer(t *testing.T) {
 	// Test our mock implementation
 	mock := &MockLoadBalancer{}
@@ -0,0 +1,139 @@
+package kubernetes
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/cloudresty/nautiluslb/config"
+)
+
+// kubeProxyHealthPath is the path on which kube-proxy answers the health
+// check node port of a service, with 200 when the node runs a ready endpoint
+// of the service.
+const kubeProxyHealthPath = "/healthz"
+
+// clusterNode is a node that NodePort and LoadBalancer services are reached
+// through.
+type clusterNode struct {
+	name string
+	ip   string
+}
+
+// selectNodes returns the nodes that NodePort and LoadBalancer services are
+// reached through, with the address selected by cfg, ordered by address. An
+// invalid node selector selects no nodes.
+func selectNodes(nodes []*corev1.Node, cfg config.NodeConfig) []clusterNode {
+	selector, err := labels.Parse(cfg.Selector)
+	if err != nil {
+		return nil
+	}
+
+	var selected []clusterNode
+
+	for _, node := range nodes {
+		if !selector.Matches(labels.Set(node.Labels)) {
+			continue
+		}
+
+		if !cfg.IncludeNotReady && !isNodeReady(node) {
+			continue
+		}
+
+		if !cfg.IncludeUnschedulable && node.Spec.Unschedulable {
+			continue
+		}
+
+		if ip, ok := nodeAddress(node, cfg); ok {
+			selected = append(selected, clusterNode{name: node.Name, ip: ip})
+		}
+	}
+
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].ip < selected[j].ip
+	})
+
+	return selected
+}
+
+// localNodes returns the nodes of state that run an endpoint behind the port
+// of service named portName. Only these nodes answer a service whose external
+// traffic policy is Local. It returns false when the EndpointSlices of the
+// service do not tell which nodes its endpoints run on.
+func localNodes(service corev1.Service, portName string, state clusterState) ([]clusterNode, bool) {
+	hosting := make(map[string]bool)
+
+	for _, ep := range serviceEndpoints(service, portName, state) {
+		if ep.nodeName == "" {
+			return nil, false
+		}
+		hosting[ep.nodeName] = true
+	}
+
+	var local []clusterNode
+	for _, node := range state.nodes {
+		if hosting[node.name] {
+			local = append(local, node)
+		}
+	}
+
+	return local, true
+}
+
+// localHealthCheck returns the health check of a service whose external
+// traffic policy is Local, probing kube-proxy on the health check node port
+// of the service so that nodes without a ready endpoint are marked unhealthy.
+// The timing settings of healthCheck are kept.
+func localHealthCheck(service corev1.Service, healthCheck config.HealthCheckConfig) *config.HealthCheckConfig {
+	healthCheck.Type = config.HealthCheckHTTP
+	healthCheck.Port = int(service.Spec.HealthCheckNodePort)
+	healthCheck.HTTP = config.HTTPHealthCheckConfig{Path: kubeProxyHealthPath}
+	healthCheck.SendExpect = config.SendExpectHealthCheckConfig{}
+
+	return &healthCheck
+}
+
+// isNodeReady reports whether the kubelet of node reports it Ready. Nodes
+// that have not reported yet are not ready.
+func isNodeReady(node *corev1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+
+	return false
+}
+
+// nodeAddress returns the address of node of the type preferred by cfg,
+// falling back to its internal IP.
+func nodeAddress(node *corev1.Node, cfg config.NodeConfig) (string, bool) {
+	switch cfg.GetAddressType() {
+	case config.NodeAddressExternalIP:
+		if ip, ok := nodeStatusAddress(node, corev1.NodeExternalIP); ok {
+			return ip, true
+		}
+	case config.NodeAddressAnnotation:
+		ip := strings.TrimSpace(node.Annotations[cfg.AddressAnnotation])
+		if net.ParseIP(ip) != nil {
+			return ip, true
+		}
+	}
+
+	return nodeStatusAddress(node, corev1.NodeInternalIP)
+}
+
+// nodeStatusAddress returns the first address of addressType reported by
+// node.
+func nodeStatusAddress(node *corev1.Node, addressType corev1.NodeAddressType) (string, bool) {
+	for _, addr := range node.Status.Addresses {
+		if addr.Type == addressType {
+			return addr.Address, true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,171 @@
+package kubernetes
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/utils/ptr"
+
+	"github.com/cloudresty/nautiluslb/backend"
+	"github.com/cloudresty/nautiluslb/config"
+)
+
+func TestSelectNodes(t *testing.T) {
+	ready := testNode("ready", "10.0.0.1")
+
+	notReady := testNode("not-ready", "10.0.0.2")
+	notReady.Status.Conditions[0].Status = corev1.ConditionFalse
+
+	unknown := testNode("unknown", "10.0.0.3")
+	unknown.Status.Conditions = nil
+
+	cordoned := testNode("cordoned", "10.0.0.4")
+	cordoned.Spec.Unschedulable = true
+
+	controlPlane := testNode("control-plane", "10.0.0.5")
+	controlPlane.Labels = map[string]string{"node-role.kubernetes.io/control-plane": ""}
+
+	nodes := []*corev1.Node{ready, notReady, unknown, cordoned, controlPlane}
+
+	tests := []struct {
+		name     string
+		cfg      config.NodeConfig
+		expected []string
+	}{
+		{"Ready and schedulable nodes", config.NodeConfig{}, []string{"10.0.0.1", "10.0.0.5"}},
+		{"Selector", config.NodeConfig{Selector: "!node-role.kubernetes.io/control-plane"}, []string{"10.0.0.1"}},
+		{"Including not ready nodes", config.NodeConfig{IncludeNotReady: true}, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.5"}},
+		{"Including cordoned nodes", config.NodeConfig{IncludeUnschedulable: true}, []string{"10.0.0.1", "10.0.0.4", "10.0.0.5"}},
+		{"Invalid selector", config.NodeConfig{Selector: "role in ingress"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, node := range selectNodes(nodes, tt.cfg) {
+				got = append(got, node.ip)
+			}
+
+			if len(got) != len(tt.expected) || !equalStrings(got, tt.expected) {
+				t.Errorf("selectNodes() = %v; want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNodeAddress(t *testing.T) {
+	node := testNode("node-1", "10.0.0.1")
+	node.Status.Addresses = append(node.Status.Addresses, corev1.NodeAddress{Type: corev1.NodeExternalIP, Address: "203.0.113.1"})
+	node.Annotations = map[string]string{"example.com/public-ip": "198.51.100.1", "example.com/invalid": "public"}
+
+	internalOnly := testNode("node-2", "10.0.0.2")
+
+	tests := []struct {
+		name     string
+		node     *corev1.Node
+		cfg      config.NodeConfig
+		expected string
+	}{
+		{"Internal IP by default", node, config.NodeConfig{}, "10.0.0.1"},
+		{"External IP", node, config.NodeConfig{AddressType: config.NodeAddressExternalIP}, "203.0.113.1"},
+		{"Missing external IP", internalOnly, config.NodeConfig{AddressType: config.NodeAddressExternalIP}, "10.0.0.2"},
+		{"Annotation", node, config.NodeConfig{AddressType: config.NodeAddressAnnotation, AddressAnnotation: "example.com/public-ip"}, "198.51.100.1"},
+		{"Invalid annotation", node, config.NodeConfig{AddressType: config.NodeAddressAnnotation, AddressAnnotation: "example.com/invalid"}, "10.0.0.1"},
+		{"Missing annotation", internalOnly, config.NodeConfig{AddressType: config.NodeAddressAnnotation, AddressAnnotation: "example.com/public-ip"}, "10.0.0.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, ok := nodeAddress(tt.node, tt.cfg); !ok || got != tt.expected {
+				t.Errorf("nodeAddress() = %q, %v; want %q", got, ok, tt.expected)
+			}
+		})
+	}
+}
+
+func TestProcessServicesForConfigLocalTrafficPolicy(t *testing.T) {
+	cfg := config.Configuration{
+		Name:            "test-config",
+		BackendPortName: "http",
+		ListenerAddress: ":80",
+		HealthCheck:     config.HealthCheckConfig{Interval: 5},
+	}
+
+	service := *testNodePortService("default", "web", 30080)
+	service.Spec.ExternalTrafficPolicy = corev1.ServiceExternalTrafficPolicyLocal
+
+	nodes := []clusterNode{{name: "node-1", ip: "10.0.0.1"}, {name: "node-2", ip: "10.0.0.2"}, {name: "node-3", ip: "10.0.0.3"}}
+
+	onNode := func(ip, nodeName string, ready bool) discoveryv1.Endpoint {
+		endpoint := testEndpoint(ip, ptr.To(ready), ptr.To(ready), nil)
+		endpoint.NodeName = ptr.To(nodeName)
+		return endpoint
+	}
+
+	t.Run("Nodes with ready endpoints", func(t *testing.T) {
+		state := clusterState{
+			nodes: nodes,
+			endpointSlices: groupEndpointSlices([]*discoveryv1.EndpointSlice{
+				testEndpointSlice("default", "web", "web-a",
+					onNode("10.244.1.1", "node-1", true),
+					onNode("10.244.1.2", "node-1", true),
+					onNode("10.244.3.1", "node-3", true),
+					onNode("10.244.2.1", "node-2", false)),
+			}),
+		}
+
+		backends := processServicesForConfig([]corev1.Service{service}, cfg, state)
+		if got := backendAddresses(backends); !equalStrings(got, []string{"10.0.0.1:30080", "10.0.0.3:30080"}) || len(got) != 2 {
+			t.Errorf("Backends = %v; want [10.0.0.1:30080 10.0.0.3:30080]", got)
+		}
+	})
+
+	t.Run("No ready endpoints", func(t *testing.T) {
+		backends := processServicesForConfig([]corev1.Service{service}, cfg, clusterState{nodes: nodes})
+		if len(backends) != 0 {
+			t.Errorf("Expected no backends, got %v", backendAddresses(backends))
+		}
+	})
+
+	t.Run("Health check node port", func(t *testing.T) {
+		unplaced := service
+		unplaced.Spec.HealthCheckNodePort = 32000
+
+		state := clusterState{
+			nodes: nodes,
+			endpointSlices: groupEndpointSlices([]*discoveryv1.EndpointSlice{
+				testEndpointSlice("default", "web", "web-a", testEndpoint("10.244.1.1", nil, nil, nil)),
+			}),
+		}
+
+		backends := processServicesForConfig([]corev1.Service{unplaced}, cfg, state)
+		if len(backends) != len(nodes) {
+			t.Fatalf("Expected a backend per node, got %v", backendAddresses(backends))
+		}
+
+		healthCheck := backends[0].HealthCheckOverride
+		if healthCheck == nil || healthCheck.Type != config.HealthCheckHTTP || healthCheck.Port != 32000 ||
+			healthCheck.HTTP.Path != kubeProxyHealthPath || healthCheck.Interval != 5 {
+			t.Errorf("HealthCheckOverride = %+v; want kube-proxy health check on port 32000", healthCheck)
+		}
+	})
+
+	t.Run("Cluster traffic policy", func(t *testing.T) {
+		cluster := service
+		cluster.Spec.ExternalTrafficPolicy = corev1.ServiceExternalTrafficPolicyCluster
+
+		backends := processServicesForConfig([]corev1.Service{cluster}, cfg, clusterState{nodes: nodes})
+		if len(backends) != len(nodes) {
+			t.Errorf("Expected a backend per node, got %v", backendAddresses(backends))
+		}
+	})
+}
+
+func backendAddresses(backends []*backend.BackendServer) []string {
+	var addresses []string
+	for _, server := range backends {
+		addresses = append(addresses, server.Address())
+	}
+	return addresses
+}
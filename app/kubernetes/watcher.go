@@ -0,0 +1,790 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/cloudresty/emit"
+	"github.com/cloudresty/nautiluslb/backend"
+	"github.com/cloudresty/nautiluslb/config"
+)
+
+const (
+	// discoveryDebounce coalesces bursts of cluster events, such as a
+	// rollout replacing many pods, into a single reconciliation.
+	discoveryDebounce = 100 * time.Millisecond
+
+	// discoveryResync is the period after which the informers replay their
+	// whole cache, as a safety net against missed events.
+	discoveryResync = 5 * time.Minute
+
+	// eventComponent is the source of the Kubernetes events published by
+	// NautilusLB.
+	eventComponent = "nautiluslb"
+
+	// eventReasonInvalidAnnotation is the reason of the events published
+	// for invalid service annotations.
+	eventReasonInvalidAnnotation = "InvalidAnnotation"
+)
+
+// clusterState is the snapshot of the cluster that service backends are
+// resolved against.
+type clusterState struct {
+	// nodes holds the nodes selected by the configuration being resolved,
+	// see selectNodes.
+	nodes []clusterNode
+
+	// endpointSlices holds the EndpointSlices of every service, keyed by
+	// serviceKey.
+	endpointSlices map[string][]*discoveryv1.EndpointSlice
+
+	// pods holds the pods of every namespace, trimmed by trimPod, once
+	// podsWatched. podLookups records the namespaces whose pods
+	// resolveTargetPort looked for, which starts the pod informers.
+	pods        map[string][]*corev1.Pod
+	podsWatched bool
+	podLookups  map[string]bool
+
+	// unresolvedPorts records the service ports whose target port could not
+	// be resolved, see unresolvedPortKey. Those already in
+	// loggedUnresolvedPorts, from the previous reconciliation, are not
+	// logged again.
+	unresolvedPorts       map[string]bool
+	loggedUnresolvedPorts map[string]bool
+}
+
+// watchedInformer is an informer whose cache is waited for before
+// reconciling, unless listing its objects is denied, see waitForCacheSync.
+type watchedInformer struct {
+	resource  string
+	namespace string // Empty for cluster-wide objects or all namespaces
+	impact    string // What is missing while listing is denied
+	informer  cache.SharedIndexInformer
+	forbidden chan struct{} // Closed once listing was denied
+	once      sync.Once
+}
+
+// watchError handles the failures to list and watch, recording when they are
+// denied.
+func (i *watchedInformer) watchError(r *cache.Reflector, err error) {
+	if apierrors.IsForbidden(err) {
+		i.once.Do(func() { close(i.forbidden) })
+	}
+
+	cache.DefaultWatchErrorHandler(context.Background(), r, err)
+}
+
+// informerScope identifies the objects listed and watched by one informer
+// factory.
+type informerScope struct {
+	namespace string // Empty for all namespaces
+	selector  string // Label selector, see selectorKey
+}
+
+// Watcher keeps the backends of the load balancers in sync with the cluster.
+// It watches Services, EndpointSlices and Nodes through shared informers and
+// reconciles every configuration shortly after a relevant change.
+type Watcher struct {
+	client     kubernetes.Interface
+	configs    []config.Configuration
+	configToLB map[string]LoadBalancerInterface
+
+	// factories holds one informer factory per namespace and label
+	// selector in use, so that both are applied by the API server and
+	// configurations limited to namespaces only need namespaced access.
+	// nodeFactory watches the nodes, which are cluster-wide and only needed
+	// by NodePort and LoadBalancer services.
+	factories   map[informerScope]informers.SharedInformerFactory
+	nodeFactory informers.SharedInformerFactory
+	services    map[informerScope]corelisters.ServiceLister
+	namespaces  map[string]corelisters.NamespaceLister // Keyed by namespace selector
+	nodes       corelisters.NodeLister
+	pods        map[string]corelisters.PodLister                // Keyed by namespace, empty for all, see watchPods
+	slices      map[string]discoverylisters.EndpointSliceLister // Keyed by namespace, empty for all
+	trigger     chan struct{}
+	debounce    time.Duration
+
+	// informers holds the informers registered by watch, stop is closed once
+	// the watcher stops and podsSynced is set once the pods are cached.
+	informers  []*watchedInformer
+	stop       <-chan struct{}
+	podsSynced atomic.Bool
+
+	// broadcaster and recorder publish Kubernetes events about services,
+	// reported remembers the problems already published, see
+	// reportInvalidAnnotations.
+	broadcaster record.EventBroadcaster
+	recorder    record.EventRecorder
+	reported    map[string]bool
+
+	// unresolvedPorts remembers the unresolved target ports already logged,
+	// see clusterState.
+	unresolvedPorts map[string]bool
+}
+
+// NewWatcher creates a watcher that updates loadBalancers, matched with
+// configs by position, from the cluster reached through client.
+func NewWatcher(client kubernetes.Interface, loadBalancers []LoadBalancerInterface, configs []config.Configuration) *Watcher {
+	configToLB := make(map[string]LoadBalancerInterface)
+	for i, cfg := range configs {
+		if i < len(loadBalancers) {
+			configToLB[cfg.Name] = loadBalancers[i]
+		}
+	}
+
+	nodeFactory := informers.NewSharedInformerFactory(client, discoveryResync)
+	broadcaster := record.NewBroadcaster()
+
+	w := &Watcher{
+		client:      client,
+		configs:     configs,
+		configToLB:  configToLB,
+		factories:   make(map[informerScope]informers.SharedInformerFactory),
+		nodeFactory: nodeFactory,
+		services:    make(map[informerScope]corelisters.ServiceLister),
+		namespaces:  make(map[string]corelisters.NamespaceLister),
+		nodes:       nodeFactory.Core().V1().Nodes().Lister(),
+		pods:        make(map[string]corelisters.PodLister),
+		slices:      make(map[string]discoverylisters.EndpointSliceLister),
+		trigger:     make(chan struct{}, 1),
+		debounce:    discoveryDebounce,
+
+		broadcaster: broadcaster,
+		recorder:    broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent}),
+		reported:    make(map[string]bool),
+	}
+
+	for _, cfg := range configs {
+		for _, scope := range serviceScopes(cfg) {
+			if _, exists := w.services[scope]; !exists {
+				w.services[scope] = w.factoryFor(client, scope).Core().V1().Services().Lister()
+			}
+		}
+
+		if cfg.NamespaceSelector == "" {
+			continue
+		}
+
+		namespaceSelector := selectorKey(cfg.NamespaceSelector)
+		if _, exists := w.namespaces[namespaceSelector]; !exists {
+			scope := informerScope{selector: namespaceSelector}
+			w.namespaces[namespaceSelector] = w.factoryFor(client, scope).Core().V1().Namespaces().Lister()
+		}
+	}
+
+	for _, namespace := range watchedNamespaces(configs) {
+		factory := w.factoryFor(client, informerScope{namespace: namespace})
+		w.slices[namespace] = factory.Discovery().V1().EndpointSlices().Lister()
+	}
+
+	return w
+}
+
+// serviceScopes returns the scopes of the service informers that cfg lists
+// its services from: one per namespace of cfg, or a single cluster-wide one.
+func serviceScopes(cfg config.Configuration) []informerScope {
+	selector := selectorKey(cfg.LabelSelector)
+
+	namespaces := cfg.GetNamespaces()
+	if len(namespaces) == 0 {
+		return []informerScope{{selector: selector}}
+	}
+
+	scopes := make([]informerScope, 0, len(namespaces))
+	for _, namespace := range namespaces {
+		scopes = append(scopes, informerScope{namespace: namespace, selector: selector})
+	}
+
+	return scopes
+}
+
+// watchedNamespaces returns the namespaces whose pods and EndpointSlices
+// backends are resolved against. It returns a single empty namespace, for
+// all namespaces, as soon as one configuration is not limited to namespaces.
+func watchedNamespaces(configs []config.Configuration) []string {
+	seen := make(map[string]bool)
+	var namespaces []string
+
+	for _, cfg := range configs {
+		cfgNamespaces := cfg.GetNamespaces()
+		if len(cfgNamespaces) == 0 {
+			return []string{metav1.NamespaceAll}
+		}
+
+		for _, namespace := range cfgNamespaces {
+			if !seen[namespace] {
+				seen[namespace] = true
+				namespaces = append(namespaces, namespace)
+			}
+		}
+	}
+
+	sort.Strings(namespaces)
+
+	return namespaces
+}
+
+// factoryFor returns the informer factory whose list and watch calls are
+// limited to scope, creating it on first use.
+func (w *Watcher) factoryFor(client kubernetes.Interface, scope informerScope) informers.SharedInformerFactory {
+	if factory, exists := w.factories[scope]; exists {
+		return factory
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(client, discoveryResync,
+		informers.WithNamespace(scope.namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = scope.selector
+		}))
+	w.factories[scope] = factory
+
+	return factory
+}
+
+// selectorKey returns the canonical form of a label selector, so that
+// configurations spelling the same selector differently share informers.
+func selectorKey(selector string) string {
+	parsed, err := labels.Parse(selector)
+	if err != nil {
+		return selector
+	}
+
+	return parsed.String()
+}
+
+// Run starts the informers, performs an initial reconciliation once their
+// caches are synced and then reconciles on every change until ctx is done.
+func (w *Watcher) Run(ctx context.Context) error {
+	if err := w.registerHandlers(); err != nil {
+		return err
+	}
+
+	w.broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: w.client.CoreV1().Events("")})
+	defer w.broadcaster.Shutdown()
+
+	defer w.shutdown()
+	if err := w.start(ctx); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+
+	emit.Info.Msg("Service discovery caches synced")
+
+	w.reconcile()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-w.trigger:
+		}
+
+		// Let the burst of events settle before reconciling once
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(w.debounce):
+		}
+
+		select {
+		case <-w.trigger:
+		default:
+		}
+
+		w.reconcile()
+	}
+}
+
+// start starts all informers and waits for their caches to sync, see
+// waitForCacheSync.
+func (w *Watcher) start(ctx context.Context) error {
+	w.stop = ctx.Done()
+
+	w.nodeFactory.Start(w.stop)
+	for _, factory := range w.factories {
+		factory.Start(w.stop)
+	}
+
+	for _, watched := range w.informers {
+		if !w.waitForCacheSync(watched) {
+			return fmt.Errorf("failed to sync informer cache for %s", watched.resource)
+		}
+	}
+
+	return nil
+}
+
+// waitForCacheSync waits for the cache of watched to sync and returns false
+// when the watcher stops first. Namespaced access does not grant every list,
+// so when listing is denied the cache is not waited for: what goes missing is
+// logged, and the informer keeps retrying until the permission is granted.
+func (w *Watcher) waitForCacheSync(watched *watchedInformer) bool {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer close(stop)
+		select {
+		case <-w.stop:
+		case <-watched.forbidden:
+		case <-done:
+		}
+	}()
+
+	if cache.WaitForCacheSync(stop, watched.informer.HasSynced) {
+		return true
+	}
+
+	select {
+	case <-w.stop:
+		return false
+	default:
+	}
+
+	emit.Error.StructuredFields("Not allowed to list resource, continuing without it",
+		emit.ZString("resource", watched.resource),
+		emit.ZString("namespace", watched.namespace),
+		emit.ZString("impact", watched.impact))
+
+	return true
+}
+
+// shutdown stops all informers once the context passed to start is done.
+func (w *Watcher) shutdown() {
+	w.nodeFactory.Shutdown()
+	for _, factory := range w.factories {
+		factory.Shutdown()
+	}
+}
+
+// registerHandlers hooks the informers up to the reconciliation trigger.
+// Pods are only watched once needed, see watchPods.
+func (w *Watcher) registerHandlers() error {
+	nodes := w.nodeFactory.Core().V1().Nodes().Informer()
+	if _, err := w.watch("nodes", "", "NodePort and LoadBalancer services get no backends", nodes, w.eventHandler(w.nodeChanged)); err != nil {
+		return err
+	}
+
+	for namespace := range w.slices {
+		informer := w.factories[informerScope{namespace: namespace}].Discovery().V1().EndpointSlices().Informer()
+		if _, err := w.watch("endpointslices", namespace, "endpoints mode services get no backends", informer, w.eventHandler(w.endpointSliceChanged)); err != nil {
+			return err
+		}
+	}
+
+	for scope := range w.services {
+		informer := w.factories[scope].Core().V1().Services().Informer()
+		if _, err := w.watch("services", scope.namespace, "services are not discovered", informer, w.eventHandler(w.serviceChanged)); err != nil {
+			return err
+		}
+	}
+
+	for selector := range w.namespaces {
+		informer := w.factories[informerScope{selector: selector}].Core().V1().Namespaces().Informer()
+		if _, err := w.watch("namespaces", "", "namespace selectors match no namespace", informer, w.eventHandler(namespaceChanged)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// watch registers informer, whose cache start waits for, calling handler on
+// changes when it is not nil.
+func (w *Watcher) watch(resource, namespace, impact string, informer cache.SharedIndexInformer, handler cache.ResourceEventHandler) (*watchedInformer, error) {
+	watched := &watchedInformer{
+		resource:  resource,
+		namespace: namespace,
+		impact:    impact,
+		informer:  informer,
+		forbidden: make(chan struct{}),
+	}
+
+	if err := informer.SetWatchErrorHandler(watched.watchError); err != nil {
+		return nil, fmt.Errorf("failed to watch %s: %v", resource, err)
+	}
+
+	if handler != nil {
+		if _, err := informer.AddEventHandler(handler); err != nil {
+			return nil, fmt.Errorf("failed to watch %s: %v", resource, err)
+		}
+	}
+
+	w.informers = append(w.informers, watched)
+
+	return watched, nil
+}
+
+// watchPods starts caching the pods of the watched namespaces, which only
+// named target ports that EndpointSlices do not resolve need, and reconciles
+// again once they are synced. Pods are only cached, changes that matter also
+// show in EndpointSlices.
+func (w *Watcher) watchPods() {
+	var watching []*watchedInformer
+
+	for namespace := range w.slices {
+		factory := w.factories[informerScope{namespace: namespace}]
+
+		informer := factory.Core().V1().Pods().Informer()
+		if err := informer.SetTransform(trimPod); err != nil {
+			emit.Error.StructuredFields("Failed to watch pods",
+				emit.ZString("namespace", namespace),
+				emit.ZString("error", err.Error()))
+			continue
+		}
+
+		watched, err := w.watch("pods", namespace, "named target ports are only resolved through EndpointSlices", informer, nil)
+		if err != nil {
+			emit.Error.StructuredFields("Failed to watch pods",
+				emit.ZString("namespace", namespace),
+				emit.ZString("error", err.Error()))
+			continue
+		}
+
+		w.pods[namespace] = factory.Core().V1().Pods().Lister()
+		watching = append(watching, watched)
+		factory.Start(w.stop)
+	}
+
+	go func() {
+		for _, watched := range watching {
+			if !w.waitForCacheSync(watched) {
+				return
+			}
+		}
+
+		w.podsSynced.Store(true)
+		w.enqueue()
+	}()
+}
+
+// eventHandler returns an event handler that triggers a reconciliation when
+// relevant reports that the change from oldObj to newObj matters. For
+// additions and deletions one of the two objects is nil.
+func (w *Watcher) eventHandler(relevant func(oldObj, newObj interface{}) bool) cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if relevant(nil, obj) {
+				w.enqueue()
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if relevant(oldObj, newObj) {
+				w.enqueue()
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if relevant(obj, nil) {
+				w.enqueue()
+			}
+		},
+	}
+}
+
+// enqueue requests a reconciliation without blocking.
+func (w *Watcher) enqueue() {
+	select {
+	case w.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// serviceChanged reports whether a service event can affect any backend,
+// which is the case when the service is, or was, enabled for discovery.
+func (w *Watcher) serviceChanged(oldObj, newObj interface{}) bool {
+	for _, obj := range []interface{}{oldObj, newObj} {
+		if service, ok := obj.(*corev1.Service); ok && service.Annotations[EnabledAnnotation] == "true" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// endpointSliceChanged reports whether an EndpointSlice belongs to a service
+// enabled for discovery.
+func (w *Watcher) endpointSliceChanged(oldObj, newObj interface{}) bool {
+	for _, obj := range []interface{}{oldObj, newObj} {
+		slice, ok := obj.(*discoveryv1.EndpointSlice)
+		if !ok {
+			continue
+		}
+
+		serviceName := slice.Labels[discoveryv1.LabelServiceName]
+		if serviceName == "" {
+			continue
+		}
+
+		for _, services := range w.services {
+			service, err := services.Services(slice.Namespace).Get(serviceName)
+			if err == nil && service.Annotations[EnabledAnnotation] == "true" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// nodeChanged reports whether a node event can affect any backend. Nodes
+// update their status often, so only changes to what node selection looks at
+// count, besides additions, deletions and periodic resyncs: addresses,
+// readiness, cordoning, labels and the address annotations in use.
+func (w *Watcher) nodeChanged(oldObj, newObj interface{}) bool {
+	oldNode, oldOK := oldObj.(*corev1.Node)
+	newNode, newOK := newObj.(*corev1.Node)
+	if !oldOK || !newOK {
+		return true
+	}
+
+	if oldNode.ResourceVersion == newNode.ResourceVersion {
+		return true
+	}
+
+	for _, cfg := range w.configs {
+		if key := cfg.Nodes.AddressAnnotation; key != "" && oldNode.Annotations[key] != newNode.Annotations[key] {
+			return true
+		}
+	}
+
+	return !reflect.DeepEqual(oldNode.Status.Addresses, newNode.Status.Addresses) ||
+		isNodeReady(oldNode) != isNodeReady(newNode) ||
+		oldNode.Spec.Unschedulable != newNode.Spec.Unschedulable ||
+		!reflect.DeepEqual(oldNode.Labels, newNode.Labels)
+}
+
+// namespaceChanged reports whether a namespace event can affect any backend,
+// which is the case when it enters or leaves a namespace selector.
+func namespaceChanged(oldObj, newObj interface{}) bool {
+	oldNamespace, oldOK := oldObj.(*corev1.Namespace)
+	newNamespace, newOK := newObj.(*corev1.Namespace)
+	if !oldOK || !newOK {
+		return true
+	}
+
+	if oldNamespace.ResourceVersion == newNamespace.ResourceVersion {
+		return true
+	}
+
+	return !reflect.DeepEqual(oldNamespace.Labels, newNamespace.Labels)
+}
+
+// reconcile resolves the backends of every configuration from the informer
+// caches and hands them to the load balancers whose backends changed.
+func (w *Watcher) reconcile() {
+	nodes, err := w.nodes.List(labels.Everything())
+	if err != nil {
+		emit.Error.StructuredFields("Failed to list nodes from cache",
+			emit.ZString("error", err.Error()))
+		return
+	}
+
+	var slices []*discoveryv1.EndpointSlice
+	var pods []*corev1.Pod
+
+	for namespace := range w.slices {
+		namespaceSlices, err := w.slices[namespace].List(labels.Everything())
+		if err != nil {
+			emit.Error.StructuredFields("Failed to list endpoint slices from cache",
+				emit.ZString("namespace", namespace),
+				emit.ZString("error", err.Error()))
+			return
+		}
+		slices = append(slices, namespaceSlices...)
+	}
+
+	for namespace := range w.pods {
+		namespacePods, err := w.pods[namespace].List(labels.Everything())
+		if err != nil {
+			emit.Error.StructuredFields("Failed to list pods from cache",
+				emit.ZString("namespace", namespace),
+				emit.ZString("error", err.Error()))
+			return
+		}
+		pods = append(pods, namespacePods...)
+	}
+
+	state := clusterState{
+		endpointSlices:        groupEndpointSlices(slices),
+		pods:                  groupPods(pods),
+		podsWatched:           w.podsSynced.Load(),
+		podLookups:            make(map[string]bool),
+		unresolvedPorts:       make(map[string]bool),
+		loggedUnresolvedPorts: w.unresolvedPorts,
+	}
+
+	reported := make(map[string]bool)
+
+	for _, cfg := range w.configs {
+		lb, exists := w.configToLB[cfg.Name]
+		if !exists {
+			continue
+		}
+
+		services, err := w.listServices(cfg)
+		if err != nil {
+			emit.Error.StructuredFields("Failed to list services from cache",
+				emit.ZString("config_name", cfg.Name),
+				emit.ZString("error", err.Error()))
+			continue
+		}
+
+		w.reportInvalidAnnotations(cfg, services, reported)
+		state.nodes = selectNodes(nodes, cfg.Nodes)
+		updateBackends(lb, cfg, processServicesForConfig(services, cfg, state))
+	}
+
+	w.reported = reported
+	w.unresolvedPorts = state.unresolvedPorts
+
+	if len(state.podLookups) > 0 && len(w.pods) == 0 {
+		w.watchPods()
+	}
+}
+
+// reportInvalidAnnotations publishes a warning event for every invalid
+// annotation of the enabled services that cfg gets backends from. The
+// problems found are recorded in reported by service and message, which holds
+// the invalid value, so that a problem is published once whatever the number
+// of configurations, and again only once it changes.
+func (w *Watcher) reportInvalidAnnotations(cfg config.Configuration, services []corev1.Service, reported map[string]bool) {
+	for i := range services {
+		service := &services[i]
+		if service.Annotations[EnabledAnnotation] != "true" || !exposesPort(*service, cfg.BackendPortName) {
+			continue
+		}
+
+		_, errs := parseServiceOverrides(*service, cfg)
+
+		for _, err := range errs {
+			message := err.Error()
+
+			key := serviceKey(service.Namespace, service.Name) + "\n" + message
+			if reported[key] {
+				continue
+			}
+			reported[key] = true
+			if w.reported[key] {
+				continue
+			}
+
+			emit.Warn.StructuredFields("Invalid service annotation",
+				emit.ZString("service_name", service.Name),
+				emit.ZString("namespace", service.Namespace),
+				emit.ZString("config_name", cfg.Name),
+				emit.ZString("error", message))
+			w.recorder.Event(service, corev1.EventTypeWarning, eventReasonInvalidAnnotation, message)
+		}
+	}
+}
+
+// exposesPort reports whether service has a port named name.
+func exposesPort(service corev1.Service, name string) bool {
+	for _, port := range service.Spec.Ports {
+		if port.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// listServices returns the cached services selected by cfg, in a stable
+// order. Services are taken from the namespaces of cfg, or from all
+// namespaces when it has none, leaving out its excluded namespaces and, when
+// it has a namespace selector, the namespaces that do not match it.
+func (w *Watcher) listServices(cfg config.Configuration) ([]corev1.Service, error) {
+	var cached []*corev1.Service
+
+	for _, scope := range serviceScopes(cfg) {
+		lister := w.services[scope]
+		if lister == nil {
+			return nil, fmt.Errorf("no service informer for namespace '%s' and label selector '%s'", scope.namespace, cfg.LabelSelector)
+		}
+
+		scoped, err := lister.List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		cached = append(cached, scoped...)
+	}
+
+	var selected map[string]bool
+	if cfg.NamespaceSelector != "" {
+		namespaces, err := w.namespaces[selectorKey(cfg.NamespaceSelector)].List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+
+		selected = make(map[string]bool, len(namespaces))
+		for _, namespace := range namespaces {
+			selected[namespace.Name] = true
+		}
+	}
+
+	services := make([]corev1.Service, 0, len(cached))
+	for _, service := range cached {
+		if cfg.IsExcludedNamespace(service.Namespace) {
+			continue
+		}
+		if selected != nil && !selected[service.Namespace] {
+			continue
+		}
+		services = append(services, *service)
+	}
+
+	sort.Slice(services, func(i, j int) bool {
+		if services[i].Namespace != services[j].Namespace {
+			return services[i].Namespace < services[j].Namespace
+		}
+		return services[i].Name < services[j].Name
+	})
+
+	return services, nil
+}
+
+// updateBackends replaces the backends of lb when they differ from backends
+// and reconciles its health checks.
+func updateBackends(lb LoadBalancerInterface, cfg config.Configuration, backends []*backend.BackendServer) {
+	lb.GetMu().Lock()
+	changed := !backendsEqual(lb.GetBackendServers(), backends)
+	if changed {
+		lb.SetBackendServers(backends)
+	}
+	lb.GetMu().Unlock()
+
+	if !changed {
+		return
+	}
+
+	emit.Info.StructuredFields("Updated backends for config",
+		emit.ZInt("backend_count", len(backends)),
+		emit.ZString("config_name", cfg.Name))
+
+	lb.StartHealthChecks()
+}
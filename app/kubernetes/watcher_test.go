@@ -0,0 +1,473 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/cloudresty/nautiluslb/config"
+)
+
+func testNode(name, ip string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: corev1.NodeStatus{
+			Addresses: []corev1.NodeAddress{
+				{Type: corev1.NodeHostName, Address: name},
+				{Type: corev1.NodeInternalIP, Address: ip},
+			},
+			Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+		},
+	}
+}
+
+func testNodePortService(namespace, name string, nodePort int32) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   namespace,
+			Name:        name,
+			Annotations: map[string]string{EnabledAnnotation: "true"},
+		},
+		Spec: corev1.ServiceSpec{
+			Type:  corev1.ServiceTypeNodePort,
+			Ports: []corev1.ServicePort{{Name: "http", Port: 80, NodePort: nodePort}},
+		},
+	}
+}
+
+// startWatcher runs a watcher for a single configuration against client and
+// returns the load balancer it updates.
+func startWatcher(t *testing.T, client *fake.Clientset, cfg config.Configuration) *MockLoadBalancer {
+	t.Helper()
+
+	lb := &MockLoadBalancer{mu: &sync.RWMutex{}}
+	watcher := NewWatcher(client, []LoadBalancerInterface{lb}, []config.Configuration{cfg})
+	watcher.debounce = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- watcher.Run(ctx) }()
+
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run() error = %v", err)
+		}
+	})
+
+	return lb
+}
+
+// waitForBackends waits until lb has the expected backend addresses.
+func waitForBackends(t *testing.T, lb *MockLoadBalancer, expected ...string) {
+	t.Helper()
+
+	sort.Strings(expected)
+
+	var got []string
+	deadline := time.Now().Add(5 * time.Second)
+
+	for time.Now().Before(deadline) {
+		lb.GetMu().RLock()
+		got = got[:0]
+		for _, server := range lb.GetBackendServers() {
+			got = append(got, server.Address())
+		}
+		lb.GetMu().RUnlock()
+
+		sort.Strings(got)
+		if len(got) == len(expected) && (len(got) == 0 || equalStrings(got, expected)) {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("Backends = %v; want %v", got, expected)
+}
+
+func equalStrings(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestWatcherPushesChanges(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewClientset(testNode("node-1", "10.0.0.1"))
+
+	lb := startWatcher(t, client, config.Configuration{Name: "web", BackendPortName: "http"})
+
+	if _, err := client.CoreV1().Services("default").Create(ctx, testNodePortService("default", "web", 30080), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	waitForBackends(t, lb, "10.0.0.1:30080")
+
+	if _, err := client.CoreV1().Nodes().Create(ctx, testNode("node-2", "10.0.0.2"), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	waitForBackends(t, lb, "10.0.0.1:30080", "10.0.0.2:30080")
+
+	if err := client.CoreV1().Services("default").Delete(ctx, "web", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("Failed to delete service: %v", err)
+	}
+	waitForBackends(t, lb)
+}
+
+func TestWatcherHonoursNamespace(t *testing.T) {
+	client := fake.NewClientset(
+		testNode("node-1", "10.0.0.1"),
+		testNodePortService("production", "web", 30080),
+		testNodePortService("staging", "web", 30081),
+	)
+
+	lb := startWatcher(t, client, config.Configuration{Name: "web", BackendPortName: "http", Namespace: "staging"})
+
+	waitForBackends(t, lb, "10.0.0.1:30081")
+}
+
+func TestWatcherHonoursNamespaceLists(t *testing.T) {
+	client := fake.NewClientset(
+		testNode("node-1", "10.0.0.1"),
+		testNodePortService("team-a", "web", 30080),
+		testNodePortService("team-b", "web", 30081),
+		testNodePortService("team-c", "web", 30082),
+		testNodePortService("kube-system", "web", 30083),
+	)
+
+	included := startWatcher(t, client, config.Configuration{Name: "web", BackendPortName: "http", Namespaces: []string{"team-a", "team-b"}})
+	waitForBackends(t, included, "10.0.0.1:30080", "10.0.0.1:30081")
+
+	excluded := startWatcher(t, client, config.Configuration{Name: "web", BackendPortName: "http", ExcludeNamespaces: []string{"kube-system", "team-c"}})
+	waitForBackends(t, excluded, "10.0.0.1:30080", "10.0.0.1:30081")
+}
+
+func TestWatcherWithNamespacedAccess(t *testing.T) {
+	ctx := context.Background()
+
+	client := fake.NewClientset(testClusterIPService("team-a", "web"), testNodePortService("team-b", "web", 30081))
+
+	// Deny cluster-wide access to namespaced resources, as a Role would
+	client.PrependReactor("list", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetResource().Resource != "nodes" && action.GetNamespace() == metav1.NamespaceAll {
+			return true, nil, apierrors.NewForbidden(action.GetResource().GroupResource(), "", fmt.Errorf("cluster-wide access denied"))
+		}
+		return false, nil, nil
+	})
+
+	lb := startWatcher(t, client, config.Configuration{
+		Name:            "web",
+		BackendPortName: "http",
+		BackendMode:     config.BackendModeEndpoints,
+		Namespaces:      []string{"team-a"},
+	})
+
+	slice := testEndpointSlice("team-a", "web", "web-a", testEndpoint("10.244.0.1", nil, nil, nil))
+	if _, err := client.DiscoveryV1().EndpointSlices("team-a").Create(ctx, slice, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create endpoint slice: %v", err)
+	}
+	waitForBackends(t, lb, "10.244.0.1:8080")
+}
+
+func TestWatcherWithoutNodeAccess(t *testing.T) {
+	ctx := context.Background()
+
+	client := fake.NewClientset(testClusterIPService("team-a", "web"), testNode("node-1", "10.0.0.1"))
+
+	// Deny every cluster-wide list, nodes included, as a Role alone would
+	client.PrependReactor("list", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetNamespace() == metav1.NamespaceAll {
+			return true, nil, apierrors.NewForbidden(action.GetResource().GroupResource(), "", fmt.Errorf("cluster-wide access denied"))
+		}
+		return false, nil, nil
+	})
+
+	lb := startWatcher(t, client, config.Configuration{
+		Name:            "web",
+		BackendPortName: "http",
+		BackendMode:     config.BackendModeEndpoints,
+		Namespaces:      []string{"team-a"},
+	})
+
+	slice := testEndpointSlice("team-a", "web", "web-a", testEndpoint("10.244.0.1", nil, nil, nil))
+	if _, err := client.DiscoveryV1().EndpointSlices("team-a").Create(ctx, slice, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create endpoint slice: %v", err)
+	}
+	waitForBackends(t, lb, "10.244.0.1:8080")
+}
+
+func TestWatcherWithoutOptionalAccess(t *testing.T) {
+	client := fake.NewClientset(testClusterIPService("team-a", "web"))
+
+	// Only services may be listed, and only in their namespace
+	client.PrependReactor("list", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetResource().Resource != "services" || action.GetNamespace() == metav1.NamespaceAll {
+			return true, nil, apierrors.NewForbidden(action.GetResource().GroupResource(), "", fmt.Errorf("access denied"))
+		}
+		return false, nil, nil
+	})
+
+	selected := &MockLoadBalancer{mu: &sync.RWMutex{}}
+	lb := &MockLoadBalancer{mu: &sync.RWMutex{}}
+	watcher := NewWatcher(client, []LoadBalancerInterface{selected, lb}, []config.Configuration{
+		{Name: "selected", BackendPortName: "http", Namespaces: []string{"team-a"}, NamespaceSelector: "team=a"},
+		{Name: "web", BackendPortName: "http", Namespaces: []string{"team-a"}},
+	})
+	watcher.debounce = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- watcher.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run() error = %v", err)
+		}
+	})
+
+	waitForBackends(t, lb, "10.96.0.10:8080")
+	waitForBackends(t, selected)
+
+	// A numeric target port needs no pods
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "list" && action.GetResource().Resource == "pods" {
+			t.Fatal("Expected pods not to be listed without named target ports")
+		}
+	}
+}
+
+func TestWatcherWatchesPodsForNamedTargetPorts(t *testing.T) {
+	service := testClusterIPService("team-a", "web")
+	service.Spec.Selector = map[string]string{"app": "web"}
+	service.Spec.Ports[0].TargetPort = intstr.FromString("web")
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "web-1", Labels: map[string]string{"app": "web"}},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Ports: []corev1.ContainerPort{{Name: "web", ContainerPort: 9090}}}},
+		},
+	}
+
+	client := fake.NewClientset(service, pod)
+
+	lb := startWatcher(t, client, config.Configuration{
+		Name:            "web",
+		BackendPortName: "http",
+		Namespaces:      []string{"team-a"},
+	})
+
+	waitForBackends(t, lb, "10.96.0.10:9090")
+}
+
+func TestWatchedNamespaces(t *testing.T) {
+	namespaced := []config.Configuration{
+		{Name: "a", Namespace: "team-b"},
+		{Name: "b", Namespaces: []string{"team-a", "team-b"}},
+	}
+
+	if got := watchedNamespaces(namespaced); !equalStrings(got, []string{"team-a", "team-b"}) || len(got) != 2 {
+		t.Errorf("watchedNamespaces() = %v; want [team-a team-b]", got)
+	}
+
+	clusterWide := append(namespaced, config.Configuration{Name: "c"})
+	if got := watchedNamespaces(clusterWide); len(got) != 1 || got[0] != metav1.NamespaceAll {
+		t.Errorf("watchedNamespaces() = %v; want all namespaces", got)
+	}
+}
+
+func TestServiceChanged(t *testing.T) {
+	w := &Watcher{}
+
+	enabled := testNodePortService("default", "web", 30080)
+	disabled := enabled.DeepCopy()
+	disabled.Annotations = nil
+
+	tests := []struct {
+		name     string
+		oldObj   interface{}
+		newObj   interface{}
+		expected bool
+	}{
+		{"Enabled service added", nil, enabled, true},
+		{"Disabled service added", nil, disabled, false},
+		{"Service disabled", enabled, disabled, true},
+		{"Enabled service deleted", enabled, nil, true},
+		{"Disabled service updated", disabled, disabled, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := w.serviceChanged(tt.oldObj, tt.newObj); got != tt.expected {
+				t.Errorf("serviceChanged() = %v; want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNodeChanged(t *testing.T) {
+	w := &Watcher{configs: []config.Configuration{
+		{Name: "web", Nodes: config.NodeConfig{AddressType: config.NodeAddressAnnotation, AddressAnnotation: "example.com/public-ip"}},
+	}}
+
+	node := testNode("node-1", "10.0.0.1")
+	node.ResourceVersion = "1"
+
+	update := func(change func(node *corev1.Node)) *corev1.Node {
+		updated := node.DeepCopy()
+		updated.ResourceVersion = "2"
+		change(updated)
+		return updated
+	}
+
+	tests := []struct {
+		name     string
+		oldObj   interface{}
+		newObj   interface{}
+		expected bool
+	}{
+		{"Node added", nil, node, true},
+		{"Node deleted", node, nil, true},
+		{"Resync", node, node, true},
+		{"Heartbeat", node, update(func(n *corev1.Node) {
+			n.Status.Conditions = append(n.Status.Conditions, corev1.NodeCondition{Type: corev1.NodeMemoryPressure, Status: corev1.ConditionFalse})
+		}), false},
+		{"Unrelated annotation", node, update(func(n *corev1.Node) {
+			n.Annotations = map[string]string{"example.com/other": "x"}
+		}), false},
+		{"Address changed", node, update(func(n *corev1.Node) { n.Status.Addresses[1].Address = "10.0.0.9" }), true},
+		{"Node not ready", node, update(func(n *corev1.Node) { n.Status.Conditions[0].Status = corev1.ConditionUnknown }), true},
+		{"Node cordoned", node, update(func(n *corev1.Node) { n.Spec.Unschedulable = true }), true},
+		{"Labels changed", node, update(func(n *corev1.Node) { n.Labels = map[string]string{"role": "ingress"} }), true},
+		{"Address annotation changed", node, update(func(n *corev1.Node) {
+			n.Annotations = map[string]string{"example.com/public-ip": "203.0.113.1"}
+		}), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := w.nodeChanged(tt.oldObj, tt.newObj); got != tt.expected {
+				t.Errorf("nodeChanged() = %v; want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWatcherSelectsNodes(t *testing.T) {
+	ctx := context.Background()
+
+	ingress := testNode("node-2", "10.0.0.2")
+	ingress.Labels = map[string]string{"role": "ingress"}
+
+	client := fake.NewClientset(testNode("node-1", "10.0.0.1"), ingress, testNodePortService("default", "web", 30080))
+
+	lb := startWatcher(t, client, config.Configuration{Name: "web", BackendPortName: "http", Nodes: config.NodeConfig{Selector: "role=ingress"}})
+	waitForBackends(t, lb, "10.0.0.2:30080")
+
+	ingress = ingress.DeepCopy()
+	ingress.Status.Conditions[0].Status = corev1.ConditionFalse
+	if _, err := client.CoreV1().Nodes().Update(ctx, ingress, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update node: %v", err)
+	}
+	waitForBackends(t, lb)
+}
+
+func TestEndpointSliceChanged(t *testing.T) {
+	client := fake.NewClientset(testNodePortService("default", "web", 30080))
+	w := NewWatcher(client, nil, []config.Configuration{{Name: "web", BackendPortName: "http"}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer w.shutdown()
+	defer cancel()
+
+	if err := w.registerHandlers(); err != nil {
+		t.Fatalf("registerHandlers() error = %v", err)
+	}
+
+	if err := w.start(ctx); err != nil {
+		t.Fatalf("start() error = %v", err)
+	}
+
+	slice := func(service string) *discoveryv1.EndpointSlice {
+		return &discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      service + "-abc",
+				Labels:    map[string]string{discoveryv1.LabelServiceName: service},
+			},
+		}
+	}
+
+	if !w.endpointSliceChanged(nil, slice("web")) {
+		t.Error("Slices of enabled services should count")
+	}
+
+	if w.endpointSliceChanged(nil, slice("other")) {
+		t.Error("Slices of unknown services should not count")
+	}
+}
+
+func TestWatcherHonoursLabelSelector(t *testing.T) {
+	canary := testNodePortService("default", "web-canary", 30081)
+	canary.Labels = map[string]string{"track": "canary", "team": "web"}
+
+	stable := testNodePortService("default", "web", 30080)
+	stable.Labels = map[string]string{"track": "stable", "team": "web"}
+
+	unlabelled := testNodePortService("default", "other", 30082)
+
+	client := fake.NewClientset(testNode("node-1", "10.0.0.1"), canary, stable, unlabelled)
+
+	lb := startWatcher(t, client, config.Configuration{Name: "web", BackendPortName: "http", LabelSelector: "team, track notin (canary)"})
+
+	waitForBackends(t, lb, "10.0.0.1:30080")
+}
+
+func TestWatcherHonoursNamespaceSelector(t *testing.T) {
+	ctx := context.Background()
+
+	namespace := func(name string, labels map[string]string) *corev1.Namespace {
+		return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+	}
+
+	client := fake.NewClientset(
+		testNode("node-1", "10.0.0.1"),
+		namespace("production", map[string]string{"env": "production"}),
+		namespace("staging", map[string]string{"env": "staging"}),
+		testNodePortService("production", "web", 30080),
+		testNodePortService("staging", "web", 30081),
+	)
+
+	lb := startWatcher(t, client, config.Configuration{Name: "web", BackendPortName: "http", NamespaceSelector: "env in (production)"})
+
+	waitForBackends(t, lb, "10.0.0.1:30080")
+
+	if _, err := client.CoreV1().Namespaces().Update(ctx, namespace("staging", map[string]string{"env": "production"}), metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update namespace: %v", err)
+	}
+	waitForBackends(t, lb, "10.0.0.1:30080", "10.0.0.1:30081")
+}
+
+func TestSelectorKey(t *testing.T) {
+	if selectorKey("b=2,a=1") != selectorKey("a=1, b=2") {
+		t.Error("Equivalent selectors should share a key")
+	}
+
+	if selectorKey("") != "" {
+		t.Error("The empty selector should map to the unfiltered factory")
+	}
+}
@@ -0,0 +1,148 @@
+package loadbalancer
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cloudresty/nautiluslb/backend"
+)
+
+// pointsPerWeight is the number of ring points placed for each unit of backend
+// weight. Ketama uses 160 (40 MD5 digests of 4 points each) to keep the spread
+// even with a handful of backends.
+const pointsPerWeight = 160
+
+// maxPointsPerBackend caps the ring points of a backend, so that weights above
+// 100 count as 100 and the ring stays small whatever the weights.
+const maxPointsPerBackend = 100 * pointsPerWeight
+
+// KeyedStrategy is implemented by strategies that map a client key, such as
+// the client IP, onto a backend so the same client keeps landing on it. The
+// key is mapped over pool, all the backends that could serve it, and the
+// result is one of candidates, those available right now.
+type KeyedStrategy interface {
+	Strategy
+	NextForKey(key string, pool, candidates []*backend.BackendServer) *backend.BackendServer
+}
+
+// ringPoint is a single position on the hash ring.
+type ringPoint struct {
+	hash    uint32
+	address string
+}
+
+// consistentHashStrategy hashes the client key onto a ketama ring built over
+// the pool, and walks the ring past the points of unavailable backends. Adding
+// or removing a backend only moves the clients whose points it owned, so most
+// clients keep their backend across pool changes, and the ring is only rebuilt
+// when the pool changes.
+type consistentHashStrategy struct {
+	fallback  roundRobinStrategy
+	mu        sync.Mutex
+	signature string
+	ring      []ringPoint
+}
+
+// Next is used when no client key is available and falls back to round-robin.
+func (s *consistentHashStrategy) Next(backends []*backend.BackendServer) *backend.BackendServer {
+
+	return s.fallback.Next(backends)
+
+}
+
+// NextForKey returns the first candidate at or after the position of key on
+// the hash ring of pool.
+func (s *consistentHashStrategy) NextForKey(key string, pool, candidates []*backend.BackendServer) *backend.BackendServer {
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	if key == "" {
+		return s.Next(candidates)
+	}
+
+	byAddress := make(map[string]*backend.BackendServer, len(candidates))
+	for _, server := range candidates {
+		byAddress[server.Address()] = server
+	}
+
+	ring := s.ringFor(pool)
+	hash := ketamaHash(key)
+
+	start := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= hash })
+	for n := range len(ring) {
+		if server, ok := byAddress[ring[(start+n)%len(ring)].address]; ok {
+			return server
+		}
+	}
+
+	// The candidates are not on the ring, which only happens when the pool
+	// changed since they were selected
+	return s.Next(candidates)
+
+}
+
+// ringFor returns the ring for pool, rebuilding it only when the set of
+// addresses or their weights changed since the last call.
+func (s *consistentHashStrategy) ringFor(pool []*backend.BackendServer) []ringPoint {
+
+	entries := make([]string, 0, len(pool))
+	for _, server := range pool {
+		entries = append(entries, fmt.Sprintf("%s/%d", server.Address(), effectiveWeight(server)))
+	}
+	sort.Strings(entries)
+	signature := strings.Join(entries, ",")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if signature == s.signature {
+		return s.ring
+	}
+
+	ring := make([]ringPoint, 0, len(pool)*pointsPerWeight)
+
+	for _, server := range pool {
+
+		address := server.Address()
+		digests := min(effectiveWeight(server)*pointsPerWeight, maxPointsPerBackend) / 4
+
+		for i := range digests {
+			digest := md5.Sum([]byte(fmt.Sprintf("%s-%d", address, i)))
+			for j := range 4 {
+				ring = append(ring, ringPoint{
+					hash:    binary.LittleEndian.Uint32(digest[j*4 : j*4+4]),
+					address: address,
+				})
+			}
+		}
+
+	}
+
+	sort.Slice(ring, func(i, j int) bool {
+		if ring[i].hash == ring[j].hash {
+			return ring[i].address < ring[j].address
+		}
+		return ring[i].hash < ring[j].hash
+	})
+
+	s.signature = signature
+	s.ring = ring
+
+	return ring
+
+}
+
+// ketamaHash returns the ring position for key.
+func ketamaHash(key string) uint32 {
+
+	digest := md5.Sum([]byte(key))
+
+	return binary.LittleEndian.Uint32(digest[0:4])
+
+}
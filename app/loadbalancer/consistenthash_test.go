@@ -0,0 +1,129 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cloudresty/nautiluslb/backend"
+	"github.com/cloudresty/nautiluslb/config"
+)
+
+func TestConsistentHashStrategyIsSticky(t *testing.T) {
+	servers := testBackends(1, 1, 1)
+	strategy := NewStrategy(config.StrategyConsistentHash).(KeyedStrategy)
+
+	for i := 0; i < 50; i++ {
+		clientIP := fmt.Sprintf("203.0.113.%d", i)
+		first := strategy.NextForKey(clientIP, servers, servers)
+		for j := 0; j < 5; j++ {
+			if got := strategy.NextForKey(clientIP, servers, servers); got != first {
+				t.Fatalf("Client %s moved from server %d to %d", clientIP, first.ID, got.ID)
+			}
+		}
+	}
+}
+
+func TestConsistentHashStrategyMinimalDisruption(t *testing.T) {
+	servers := testBackends(1, 1, 1, 1, 1)
+	strategy := NewStrategy(config.StrategyConsistentHash).(KeyedStrategy)
+
+	const clients = 2000
+
+	before := make(map[string]string, clients)
+	for i := 0; i < clients; i++ {
+		clientIP := fmt.Sprintf("10.%d.%d.%d", i/65536, (i/256)%256, i%256)
+		before[clientIP] = strategy.NextForKey(clientIP, servers, servers).Address()
+	}
+
+	// Remove one backend; only clients on it should move
+	removed := servers[2].Address()
+	remaining := append([]*backend.BackendServer{}, servers[:2]...)
+	remaining = append(remaining, servers[3:]...)
+
+	tests := []struct {
+		name string
+		pool []*backend.BackendServer
+	}{
+		{"Unavailable", servers},
+		{"Removed from the pool", remaining},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			moved := 0
+			for clientIP, address := range before {
+				got := strategy.NextForKey(clientIP, tt.pool, remaining).Address()
+				if got == removed {
+					t.Fatalf("Client %s was sent to removed backend", clientIP)
+				}
+				if address != removed && got != address {
+					moved++
+				}
+			}
+
+			if moved != 0 {
+				t.Errorf("Expected only clients of the removed backend to move, %d others moved", moved)
+			}
+		})
+	}
+}
+
+func TestConsistentHashStrategyKeepsRingAcrossCandidates(t *testing.T) {
+	servers := testBackends(1, 1, 1)
+	strategy := NewStrategy(config.StrategyConsistentHash).(*consistentHashStrategy)
+
+	strategy.NextForKey("203.0.113.1", servers, servers)
+	ring := strategy.ring
+
+	// Excluding backends, as retries and ejections do, keeps the ring
+	strategy.NextForKey("203.0.113.1", servers, servers[:1])
+	if &strategy.ring[0] != &ring[0] {
+		t.Error("Expected the ring to be kept when only the candidates change")
+	}
+
+	strategy.NextForKey("203.0.113.1", servers[:2], servers[:1])
+	if &strategy.ring[0] == &ring[0] {
+		t.Error("Expected the ring to be rebuilt when the pool changes")
+	}
+}
+
+func TestConsistentHashStrategyCapsPoints(t *testing.T) {
+	servers := testBackends(1, backend.MaxWeight)
+	strategy := NewStrategy(config.StrategyConsistentHash).(*consistentHashStrategy)
+
+	if got, want := len(strategy.ringFor(servers)), pointsPerWeight+maxPointsPerBackend; got != want {
+		t.Errorf("Ring points = %d; want %d", got, want)
+	}
+}
+
+func TestConsistentHashStrategySpread(t *testing.T) {
+	servers := testBackends(1, 1, 1, 1)
+	strategy := NewStrategy(config.StrategyConsistentHash).(KeyedStrategy)
+
+	counts := make(map[int]int)
+	for i := 0; i < 4000; i++ {
+		counts[strategy.NextForKey(fmt.Sprintf("client-%d", i), servers, servers).ID]++
+	}
+
+	for id, count := range counts {
+		if count < 600 || count > 1400 {
+			t.Errorf("Server %d received %d of 4000 clients, ring is badly skewed: %v", id, count, counts)
+		}
+	}
+}
+
+func TestConsistentHashStrategyWithoutKey(t *testing.T) {
+	servers := testBackends(1, 1)
+	strategy := NewStrategy(config.StrategyConsistentHash).(KeyedStrategy)
+
+	first := strategy.NextForKey("", servers, servers)
+	second := strategy.NextForKey("", servers, servers)
+
+	if first == second {
+		t.Error("Expected round-robin fallback when no client key is available")
+	}
+
+	if got := strategy.NextForKey("198.51.100.1", nil, nil); got != nil {
+		t.Error("Expected nil for empty backends")
+	}
+}
@@ -0,0 +1,280 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cloudresty/emit"
+	"github.com/cloudresty/nautiluslb/backend"
+)
+
+// shutdownPollInterval is how often Shutdown checks whether the sessions of
+// the load balancer have all ended.
+const shutdownPollInterval = 100 * time.Millisecond
+
+// session is a client connection being handled by the load balancer, and the
+// backend connection it is proxied to once there is one.
+type session struct {
+	client  net.Conn
+	backend net.Conn
+	address string // Backend address, empty until connected
+	closed  bool   // Force-closed, see closeSessions
+}
+
+// sessionTracker keeps the sessions of a load balancer, so that they can be
+// drained when their backend is removed or the load balancer shuts down.
+type sessionTracker struct {
+	mu       sync.Mutex
+	sessions map[*session]struct{}
+	draining map[string]*time.Timer // Drain deadlines of removed backends, by address
+}
+
+// newSessionTracker creates an empty session tracker.
+func newSessionTracker() *sessionTracker {
+
+	return &sessionTracker{
+		sessions: make(map[*session]struct{}),
+		draining: make(map[string]*time.Timer),
+	}
+
+}
+
+// add starts tracking the session of client.
+func (t *sessionTracker) add(client net.Conn) *session {
+
+	s := &session{client: client}
+
+	t.mu.Lock()
+	t.sessions[s] = struct{}{}
+	t.mu.Unlock()
+
+	return s
+
+}
+
+// connect records that s is proxied to the backend at address over conn. It
+// returns false when s was force-closed while connecting, in which case the
+// caller must close conn.
+func (t *sessionTracker) connect(s *session, address string, conn net.Conn) bool {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	s.address, s.backend = address, conn
+
+	return true
+
+}
+
+// remove stops tracking s.
+func (t *sessionTracker) remove(s *session) {
+
+	t.mu.Lock()
+	delete(t.sessions, s)
+	t.mu.Unlock()
+
+}
+
+// count returns the number of sessions, or of sessions to the backend at
+// address when it is not empty.
+func (t *sessionTracker) count(address string) int {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if address == "" {
+		return len(t.sessions)
+	}
+
+	n := 0
+	for s := range t.sessions {
+		if s.address == address {
+			n++
+		}
+	}
+
+	return n
+
+}
+
+// closeSessions force-closes the sessions to the backend at address, or all
+// sessions when it is empty, and returns how many were closed. Closing both
+// connections ends the copy loops of the session handlers.
+func (t *sessionTracker) closeSessions(address string) int {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	closed := 0
+	for s := range t.sessions {
+		if address != "" && s.address != address {
+			continue
+		}
+
+		s.closed = true
+		closeQuietly(s.client)
+		if s.backend != nil {
+			closeQuietly(s.backend)
+		}
+		closed++
+	}
+
+	return closed
+
+}
+
+// drain gives the sessions to the backend at address until timeout to end
+// on their own, after which expire is called to close what is left. A backend
+// that is already draining keeps its deadline.
+func (t *sessionTracker) drain(address string, timeout time.Duration, expire func()) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, exists := t.draining[address]; exists {
+		return
+	}
+
+	t.draining[address] = time.AfterFunc(timeout, func() {
+		t.mu.Lock()
+		delete(t.draining, address)
+		t.mu.Unlock()
+
+		expire()
+	})
+
+}
+
+// undrain cancels the drain of the backend at address, which is back in use.
+func (t *sessionTracker) undrain(address string) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if timer, exists := t.draining[address]; exists {
+		timer.Stop()
+		delete(t.draining, address)
+	}
+
+}
+
+// closeQuietly closes conn, ignoring connections that are already closed.
+func closeQuietly(conn net.Conn) {
+
+	if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		emit.Warn.StructuredFields("Failed to close connection",
+			emit.ZString("error", err.Error()))
+	}
+
+}
+
+// connectSession records that s is proxied to server over conn. It returns
+// false when s was force-closed while connecting, or when server was removed
+// meanwhile: a backend removed with no sessions is not drained, so nothing
+// would end the session, and the caller must close conn.
+func (lb *LoadBalancer) connectSession(s *session, server *backend.BackendServer, conn net.Conn) bool {
+
+	// Holding lb.mu orders this against drainRemovedBackends, which either
+	// counts the session or has already removed the backend
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	address := server.Address()
+	if !slices.ContainsFunc(lb.backendServers, func(b *backend.BackendServer) bool { return b.Address() == address }) {
+		emit.Warn.StructuredFields("Backend removed while connecting, closing client connection",
+			emit.ZString("listener_addr", lb.listenerAddr),
+			emit.ZString("backend_address", address))
+		return false
+	}
+
+	return lb.sessions.connect(s, address, conn)
+
+}
+
+// drainRemovedBackends starts draining the backends of old that are not in
+// servers: they get no new connections and their sessions are closed once the
+// drain timeout passes. Backends that came back stop draining. The caller
+// must hold lb.mu.
+func (lb *LoadBalancer) drainRemovedBackends(old, servers []*backend.BackendServer) {
+
+	current := make(map[string]bool, len(servers))
+	for _, server := range servers {
+		current[server.Address()] = true
+		lb.sessions.undrain(server.Address())
+	}
+
+	timeout := lb.config.GetDrainTimeout()
+
+	for _, server := range old {
+
+		address := server.Address()
+		if current[address] {
+			continue
+		}
+
+		active := lb.sessions.count(address)
+		if active == 0 {
+			continue
+		}
+
+		emit.Info.StructuredFields("Draining removed backend",
+			emit.ZString("listener_addr", lb.listenerAddr),
+			emit.ZString("backend_address", address),
+			emit.ZInt("sessions", active),
+			emit.ZString("drain_timeout", timeout.String()))
+
+		lb.sessions.drain(address, timeout, func() {
+			if closed := lb.sessions.closeSessions(address); closed > 0 {
+				emit.Warn.StructuredFields("Drain timeout reached, closing sessions",
+					emit.ZString("listener_addr", lb.listenerAddr),
+					emit.ZString("backend_address", address),
+					emit.ZInt("sessions", closed))
+			}
+		})
+
+	}
+
+}
+
+// Shutdown stops accepting connections and waits for the running sessions to
+// end. When ctx is done first, the remaining sessions are force-closed and the
+// error of ctx is returned once their handlers have returned.
+func (lb *LoadBalancer) Shutdown(ctx context.Context) error {
+
+	lb.Stop()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+
+		active := lb.sessions.count("")
+		if active == 0 {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			emit.Warn.StructuredFields("Shutdown deadline reached, closing sessions",
+				emit.ZString("listener_addr", lb.listenerAddr),
+				emit.ZInt("sessions", lb.sessions.closeSessions("")))
+
+			for lb.sessions.count("") > 0 {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			return ctx.Err()
+		}
+
+	}
+
+}
@@ -0,0 +1,250 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudresty/nautiluslb/backend"
+	"github.com/cloudresty/nautiluslb/config"
+)
+
+// echoListener returns a local listener that echoes what it receives and
+// closes a connection once the client stops sending.
+func echoListener(t *testing.T) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create test listener: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return listener
+}
+
+// startSession opens a client connection handled by lb and returns the client
+// side and a channel closed once HandleConnection has returned.
+func startSession(t *testing.T, lb *LoadBalancer) (net.Conn, chan struct{}) {
+	t.Helper()
+
+	front, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create test listener: %v", err)
+	}
+	defer func() { _ = front.Close() }()
+
+	client, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+
+	conn, err := front.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		lb.HandleConnection(conn)
+		close(done)
+	}()
+
+	// Wait for the session to reach the backend
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for lb.sessions.count("") == 0 || lb.sessions.count(lb.backendServers[0].Address()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Session did not connect to the backend")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	return client, done
+}
+
+func newDrainTestLoadBalancer(t *testing.T, backendListener net.Listener, drainTimeout int) *LoadBalancer {
+	t.Helper()
+
+	cfg := config.Configuration{
+		Name:            "test-lb",
+		ListenerAddress: "127.0.0.1:0",
+		BackendPortName: "http",
+		DrainTimeout:    drainTimeout,
+	}
+
+	lb := NewLoadBalancer(cfg)
+	lb.SetBackendServers([]*backend.BackendServer{
+		{ID: 1, IP: "127.0.0.1", Port: backendListener.Addr().(*net.TCPAddr).Port, PortName: "http", Healthy: true},
+	})
+
+	return lb
+}
+
+func TestShutdownWaitsForSessions(t *testing.T) {
+	lb := newDrainTestLoadBalancer(t, echoListener(t), 0)
+	client, done := startSession(t, lb)
+
+	result := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		result <- lb.Shutdown(ctx)
+	}()
+
+	select {
+	case err := <-result:
+		t.Fatalf("Shutdown() returned %v while a session was running", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// The session still works while draining
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(client, reply); err != nil || string(reply) != "ping" {
+		t.Fatalf("Expected the session to keep working, got %q, %v", reply, err)
+	}
+
+	_ = client.Close()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("Shutdown() error = %v; want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown() did not return once the session ended")
+	}
+
+	<-done
+}
+
+func TestShutdownForceClosesSessions(t *testing.T) {
+	lb := newDrainTestLoadBalancer(t, acceptingListener(t), 0)
+	_, done := startSession(t, lb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := lb.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown() error = %v; want %v", err, context.DeadlineExceeded)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Session was not closed after the shutdown deadline")
+	}
+}
+
+func TestRemovedBackendIsDrained(t *testing.T) {
+	lb := newDrainTestLoadBalancer(t, acceptingListener(t), 1)
+	_, done := startSession(t, lb)
+
+	lb.mu.Lock()
+	lb.SetBackendServers(nil)
+	lb.mu.Unlock()
+
+	if lb.getNextBackend() != nil {
+		t.Error("A removed backend should not get new connections")
+	}
+
+	select {
+	case <-done:
+		t.Fatal("Session was closed before the drain timeout")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Session was not closed after the drain timeout")
+	}
+}
+
+func TestBackendRemovedWhileConnecting(t *testing.T) {
+	lb := newDrainTestLoadBalancer(t, echoListener(t), 60)
+	server := lb.backendServers[0]
+
+	client, _ := net.Pipe()
+	t.Cleanup(func() { _ = client.Close() })
+	s := lb.sessions.add(client)
+
+	conn, err := net.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Failed to connect to the backend: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	// The backend goes away while the session is dialing it, when it has no
+	// sessions yet and so no drain timeout
+	lb.mu.Lock()
+	lb.SetBackendServers(nil)
+	lb.mu.Unlock()
+
+	if lb.connectSession(s, server, conn) {
+		t.Error("connectSession() = true; want false for a removed backend")
+	}
+
+	if got := lb.sessions.count(server.Address()); got != 0 {
+		t.Errorf("Sessions to the removed backend = %d; want 0", got)
+	}
+}
+
+func TestConnectSession(t *testing.T) {
+	lb := newDrainTestLoadBalancer(t, echoListener(t), 60)
+	server := lb.backendServers[0]
+
+	client, _ := net.Pipe()
+	t.Cleanup(func() { _ = client.Close() })
+	s := lb.sessions.add(client)
+
+	conn, err := net.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Failed to connect to the backend: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	if !lb.connectSession(s, server, conn) {
+		t.Fatal("connectSession() = false; want true for a current backend")
+	}
+
+	if got := lb.sessions.count(server.Address()); got != 1 {
+		t.Errorf("Sessions to the backend = %d; want 1", got)
+	}
+}
+
+func TestSessionTrackerUndrain(t *testing.T) {
+	tracker := newSessionTracker()
+
+	var expired atomic.Bool
+	tracker.drain("10.0.0.1:80", 50*time.Millisecond, func() { expired.Store(true) })
+	tracker.undrain("10.0.0.1:80")
+
+	time.Sleep(100 * time.Millisecond)
+	if expired.Load() {
+		t.Error("A backend that came back should not be drained")
+	}
+
+	tracker.drain("10.0.0.1:80", 10*time.Millisecond, func() { expired.Store(true) })
+	time.Sleep(100 * time.Millisecond)
+	if !expired.Load() {
+		t.Error("Expected the drain to expire")
+	}
+}
@@ -0,0 +1,187 @@
+package loadbalancer
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cloudresty/emit"
+	"github.com/cloudresty/nautiluslb/backend"
+	"github.com/cloudresty/nautiluslb/config"
+)
+
+// healthChecker is the subscription of a load balancer to the shared health
+// check of a single backend address.
+type healthChecker struct {
+	settings     config.HealthCheckConfig
+	subscription *healthSubscription
+}
+
+// healthCheckManager tracks the health checks of a load balancer. It holds
+// exactly one subscription to the shared health registry per backend address,
+// drops the subscriptions of backends that disappeared and remembers the last
+// known health of every address so that backend objects recreated by
+// discovery inherit it.
+type healthCheckManager struct {
+	mu       sync.Mutex
+	registry *healthRegistry
+	stopped  bool
+	checkers map[string]*healthChecker
+	status   map[string]bool
+	onChange func(address string, healthy bool)
+}
+
+// newHealthCheckManager creates a health check manager subscribing to
+// registry and calling onChange whenever a backend address changes health.
+func newHealthCheckManager(registry *healthRegistry, onChange func(address string, healthy bool)) *healthCheckManager {
+
+	return &healthCheckManager{
+		registry: registry,
+		checkers: make(map[string]*healthChecker),
+		status:   make(map[string]bool),
+		onChange: onChange,
+	}
+
+}
+
+// Sync subscribes to the health check of every backend that does not have
+// one yet, resubscribes backends whose settings changed and unsubscribes the
+// backends that are gone. Backends take over the known health of their
+// address, so the caller must hold the lock guarding servers for writing. It
+// does nothing once the manager is stopped.
+func (m *healthCheckManager) Sync(servers []*backend.BackendServer, settingsFor func(*backend.BackendServer) config.HealthCheckConfig) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopped {
+		return
+	}
+
+	current := make(map[string]bool, len(servers))
+
+	for _, server := range servers {
+
+		address := server.Address()
+		settings := settingsFor(server)
+
+		if !current[address] {
+
+			current[address] = true
+
+			checker, ok := m.checkers[address]
+			if ok && !reflect.DeepEqual(checker.settings, settings) {
+				m.registry.Unsubscribe(address, checker.settings, checker.subscription)
+				ok = false
+			}
+
+			if !ok {
+				if healthy, known := m.status[address]; known {
+					server.Healthy = healthy
+				}
+				checker = &healthChecker{settings: settings}
+				checker.subscription, m.status[address] = m.registry.Subscribe(server, settings, func(healthy bool) {
+					m.report(address, checker, healthy)
+				})
+				m.checkers[address] = checker
+			}
+
+		}
+
+		server.Healthy = m.status[address]
+
+	}
+
+	for address, checker := range m.checkers {
+		if !current[address] {
+			m.registry.Unsubscribe(address, checker.settings, checker.subscription)
+			delete(m.checkers, address)
+			delete(m.status, address)
+			emit.Info.StructuredFields("Stopped health check for removed backend",
+				emit.ZString("backend_address", address))
+		}
+	}
+
+}
+
+// report records the health of address and forwards it, unless checker is no
+// longer the subscription for that address.
+func (m *healthCheckManager) report(address string, checker *healthChecker, healthy bool) {
+
+	m.mu.Lock()
+	if m.checkers[address] != checker {
+		m.mu.Unlock()
+		return
+	}
+	m.status[address] = healthy
+	m.mu.Unlock()
+
+	m.onChange(address, healthy)
+
+}
+
+// Status returns the last known health of address and whether it is known.
+func (m *healthCheckManager) Status(address string) (bool, bool) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	healthy, ok := m.status[address]
+
+	return healthy, ok
+
+}
+
+// Active returns the sorted addresses that currently have a health check.
+func (m *healthCheckManager) Active() []string {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	addresses := make([]string, 0, len(m.checkers))
+	for address := range m.checkers {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+
+	return addresses
+
+}
+
+// Stop drops all subscriptions and waits up to timeout for the health checks
+// no other load balancer uses to return. It returns false if some were still
+// running when the timeout expired.
+func (m *healthCheckManager) Stop(timeout time.Duration) bool {
+
+	m.mu.Lock()
+	m.stopped = true
+	var pending []<-chan struct{}
+	for address, checker := range m.checkers {
+		pending = append(pending, m.registry.Unsubscribe(address, checker.settings, checker.subscription))
+	}
+	m.checkers = make(map[string]*healthChecker)
+	m.mu.Unlock()
+
+	deadline := time.After(timeout)
+	for _, done := range pending {
+		select {
+		case <-done:
+		case <-deadline:
+			return false
+		}
+	}
+
+	return true
+
+}
+
+// Stopped reports whether Stop has been called.
+func (m *healthCheckManager) Stopped() bool {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.stopped
+
+}
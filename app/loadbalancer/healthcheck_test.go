@@ -0,0 +1,118 @@
+package loadbalancer
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cloudresty/nautiluslb/backend"
+	"github.com/cloudresty/nautiluslb/config"
+)
+
+// fastHealthCheck probes every second and flips health on the first result.
+var fastHealthCheck = config.HealthCheckConfig{
+	Interval:           1,
+	Timeout:            1,
+	UnhealthyThreshold: 1,
+	HealthyThreshold:   1,
+}
+
+func fastHealthCheckSettings(*backend.BackendServer) config.HealthCheckConfig {
+	return fastHealthCheck
+}
+
+func TestHealthCheckManagerSync(t *testing.T) {
+	m := newHealthCheckManager(newHealthRegistry(), func(string, bool) {})
+
+	first := &backend.BackendServer{IP: "127.0.0.1", Port: closedPort(t), Healthy: true}
+	second := &backend.BackendServer{IP: "127.0.0.1", Port: closedPort(t), Healthy: true}
+
+	m.Sync([]*backend.BackendServer{first, second}, fastHealthCheckSettings)
+
+	if got := len(m.Active()); got != 2 {
+		t.Fatalf("Expected 2 active checkers, got %d", got)
+	}
+
+	// A recreated object for the same address keeps its checker
+	recreated := &backend.BackendServer{IP: first.IP, Port: first.Port, Healthy: true}
+	m.Sync([]*backend.BackendServer{recreated}, fastHealthCheckSettings)
+
+	if got, want := m.Active(), []string{first.Address()}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Active() = %v; want %v", got, want)
+	}
+
+	if !m.Stop(5 * time.Second) {
+		t.Fatal("Checkers did not stop in time")
+	}
+
+	if len(m.Active()) != 0 || !m.Stopped() {
+		t.Error("No checker should be active after Stop()")
+	}
+
+	m.Sync([]*backend.BackendServer{first}, fastHealthCheckSettings)
+	if len(m.Active()) != 0 {
+		t.Error("Sync() should not start checkers after Stop()")
+	}
+}
+
+func TestHealthCheckManagerReportsChanges(t *testing.T) {
+	changes := make(chan bool, 1)
+	m := newHealthCheckManager(newHealthRegistry(), func(address string, healthy bool) {
+		changes <- healthy
+	})
+	defer m.Stop(5 * time.Second)
+
+	server := &backend.BackendServer{IP: "127.0.0.1", Port: closedPort(t), Healthy: true}
+	m.Sync([]*backend.BackendServer{server}, fastHealthCheckSettings)
+
+	select {
+	case healthy := <-changes:
+		if healthy {
+			t.Error("A closed port should be reported unhealthy")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No health change reported")
+	}
+
+	if healthy, ok := m.Status(server.Address()); !ok || healthy {
+		t.Errorf("Status() = %v, %v; want false, true", healthy, ok)
+	}
+}
+
+func TestHealthChecksFollowBackends(t *testing.T) {
+	lb := NewLoadBalancer(config.Configuration{Name: "test", BackendPortName: "http", HealthCheck: fastHealthCheck})
+	defer lb.StopHealthChecks()
+
+	server := &backend.BackendServer{IP: "127.0.0.1", Port: closedPort(t), PortName: "http", Healthy: true}
+
+	lb.SetBackendServers([]*backend.BackendServer{server})
+	lb.StartHealthChecks()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for lb.getNextBackend() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Backend on a closed port was never marked unhealthy")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Discovery recreates the backend object, which must inherit the known health
+	recreated := &backend.BackendServer{IP: server.IP, Port: server.Port, PortName: "http", Healthy: true}
+	lb.mu.Lock()
+	lb.SetBackendServers([]*backend.BackendServer{recreated})
+	lb.mu.Unlock()
+
+	if lb.getNextBackend() != nil {
+		t.Error("Recreated backend should inherit the unhealthy status")
+	}
+
+	// Removing the backend stops its checker
+	lb.mu.Lock()
+	lb.SetBackendServers(nil)
+	lb.mu.Unlock()
+	lb.StartHealthChecks()
+
+	if active := lb.ActiveHealthChecks(); len(active) != 0 {
+		t.Errorf("Expected no active health checks, got %v", active)
+	}
+}
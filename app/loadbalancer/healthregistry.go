@@ -0,0 +1,164 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/cloudresty/emit"
+	"github.com/cloudresty/nautiluslb/backend"
+	"github.com/cloudresty/nautiluslb/config"
+)
+
+// sharedHealthRegistry is the process-wide registry every load balancer
+// subscribes to, so that backends shared by several listeners are probed once.
+var sharedHealthRegistry = newHealthRegistry()
+
+// healthProbeKey identifies a probe stream: one backend address probed with
+// one set of health check settings.
+type healthProbeKey struct {
+	address string
+	spec    string
+}
+
+// healthSubscription is a single subscriber of a shared health check.
+type healthSubscription struct {
+	onChange func(healthy bool)
+}
+
+// sharedHealthCheck is a running probe stream and its subscribers.
+type sharedHealthCheck struct {
+	cancel      context.CancelFunc
+	done        chan struct{}
+	healthy     bool
+	subscribers map[*healthSubscription]struct{}
+}
+
+// healthRegistry runs one health check per endpoint and probe spec, however
+// many load balancers are interested in it. Checks are reference counted by
+// their subscriptions and stop when the last subscriber leaves.
+type healthRegistry struct {
+	mu     sync.Mutex
+	checks map[healthProbeKey]*sharedHealthCheck
+}
+
+// newHealthRegistry creates an empty health registry.
+func newHealthRegistry() *healthRegistry {
+
+	return &healthRegistry{
+		checks: make(map[healthProbeKey]*sharedHealthCheck),
+	}
+
+}
+
+// Subscribe registers onChange for health changes of server probed with
+// settings, starting the probe stream if nobody probes it yet. It returns the
+// subscription and the current health of the stream, which starts from the
+// health of server when the stream is new.
+func (r *healthRegistry) Subscribe(server *backend.BackendServer, settings config.HealthCheckConfig, onChange func(healthy bool)) (*healthSubscription, bool) {
+
+	key := healthProbeKey{address: server.Address(), spec: fmt.Sprintf("%+v", settings)}
+	subscription := &healthSubscription{onChange: onChange}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if check, ok := r.checks[key]; ok {
+		check.subscribers[subscription] = struct{}{}
+		emit.Debug.StructuredFields("Joined shared health check",
+			emit.ZString("backend_address", key.address),
+			emit.ZInt("subscribers", len(check.subscribers)))
+		return subscription, check.healthy
+	}
+
+	healthy := server.Healthy
+	ctx, cancel := context.WithCancel(context.Background())
+	check := &sharedHealthCheck{
+		cancel:      cancel,
+		done:        make(chan struct{}),
+		healthy:     healthy,
+		subscribers: map[*healthSubscription]struct{}{subscription: {}},
+	}
+	r.checks[key] = check
+
+	emit.Info.StructuredFields("Starting health check for backend",
+		emit.ZString("backend_ip", server.IP),
+		emit.ZInt("backend_port", server.Port),
+		emit.ZString("type", settings.GetType()),
+		emit.ZString("interval", settings.GetInterval().String()))
+
+	go func() {
+		defer close(check.done)
+		server.HealthCheck(ctx, settings, healthy, func(healthy bool) {
+			r.publish(check, healthy)
+		})
+	}()
+
+	return subscription, healthy
+
+}
+
+// publish records a health change of check and notifies its subscribers.
+func (r *healthRegistry) publish(check *sharedHealthCheck, healthy bool) {
+
+	r.mu.Lock()
+	check.healthy = healthy
+	subscribers := make([]*healthSubscription, 0, len(check.subscribers))
+	for subscription := range check.subscribers {
+		subscribers = append(subscribers, subscription)
+	}
+	r.mu.Unlock()
+
+	for _, subscription := range subscribers {
+		subscription.onChange(healthy)
+	}
+
+}
+
+// Unsubscribe removes subscription from the health check of server probed
+// with settings and stops the probe stream when it was the last subscriber.
+// The returned channel is closed once the probe stream is no longer running
+// or, if other subscribers remain, right away.
+func (r *healthRegistry) Unsubscribe(address string, settings config.HealthCheckConfig, subscription *healthSubscription) <-chan struct{} {
+
+	key := healthProbeKey{address: address, spec: fmt.Sprintf("%+v", settings)}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	check, ok := r.checks[key]
+	if !ok {
+		return closedChannel()
+	}
+
+	delete(check.subscribers, subscription)
+	if len(check.subscribers) > 0 {
+		return closedChannel()
+	}
+
+	check.cancel()
+	delete(r.checks, key)
+
+	return check.done
+
+}
+
+// Len returns the number of running probe streams.
+func (r *healthRegistry) Len() int {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.checks)
+
+}
+
+// closedChannel returns an already closed channel.
+func closedChannel() <-chan struct{} {
+
+	ch := make(chan struct{})
+	close(ch)
+
+	return ch
+
+}
@@ -0,0 +1,94 @@
+package loadbalancer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudresty/nautiluslb/backend"
+	"github.com/cloudresty/nautiluslb/config"
+)
+
+// waitForHealth waits for a health change on changes and returns it.
+func waitForHealth(t *testing.T, changes <-chan bool) bool {
+	t.Helper()
+
+	select {
+	case healthy := <-changes:
+		return healthy
+	case <-time.After(5 * time.Second):
+		t.Fatal("No health change reported")
+		return false
+	}
+}
+
+func TestHealthRegistrySharesProbeStreams(t *testing.T) {
+	registry := newHealthRegistry()
+	port := closedPort(t)
+
+	firstChanges := make(chan bool, 1)
+	first := newHealthCheckManager(registry, func(_ string, healthy bool) { firstChanges <- healthy })
+
+	secondChanges := make(chan bool, 1)
+	second := newHealthCheckManager(registry, func(_ string, healthy bool) { secondChanges <- healthy })
+
+	// Each load balancer discovers its own object for the shared endpoint
+	first.Sync([]*backend.BackendServer{{IP: "127.0.0.1", Port: port, Healthy: true}}, fastHealthCheckSettings)
+	second.Sync([]*backend.BackendServer{{IP: "127.0.0.1", Port: port, Healthy: true}}, fastHealthCheckSettings)
+
+	if got := registry.Len(); got != 1 {
+		t.Fatalf("Expected 1 probe stream for a shared endpoint, got %d", got)
+	}
+
+	if waitForHealth(t, firstChanges) || waitForHealth(t, secondChanges) {
+		t.Error("Both subscribers should see the closed port as unhealthy")
+	}
+
+	// A late subscriber takes over the current health of the stream
+	late := newHealthCheckManager(registry, func(string, bool) {})
+	server := &backend.BackendServer{IP: "127.0.0.1", Port: port, Healthy: true}
+	late.Sync([]*backend.BackendServer{server}, fastHealthCheckSettings)
+
+	if server.Healthy {
+		t.Error("A late subscriber should inherit the unhealthy status")
+	}
+
+	for _, m := range []*healthCheckManager{first, late} {
+		if !m.Stop(5 * time.Second) {
+			t.Fatal("Subscription did not stop in time")
+		}
+	}
+
+	if got := registry.Len(); got != 1 {
+		t.Errorf("Stream should keep running while subscribed, got %d streams", got)
+	}
+
+	if !second.Stop(5 * time.Second) {
+		t.Fatal("Probe stream did not stop in time")
+	}
+
+	if got := registry.Len(); got != 0 {
+		t.Errorf("Stream should stop with its last subscriber, got %d streams", got)
+	}
+}
+
+func TestHealthRegistryKeysByProbeSpec(t *testing.T) {
+	registry := newHealthRegistry()
+	port := closedPort(t)
+
+	tcp := newHealthCheckManager(registry, func(string, bool) {})
+	defer tcp.Stop(5 * time.Second)
+
+	http := newHealthCheckManager(registry, func(string, bool) {})
+	defer http.Stop(5 * time.Second)
+
+	tcp.Sync([]*backend.BackendServer{{IP: "127.0.0.1", Port: port}}, fastHealthCheckSettings)
+	http.Sync([]*backend.BackendServer{{IP: "127.0.0.1", Port: port}}, func(*backend.BackendServer) config.HealthCheckConfig {
+		settings := fastHealthCheck
+		settings.Type = config.HealthCheckHTTP
+		return settings
+	})
+
+	if got := registry.Len(); got != 2 {
+		t.Errorf("Expected a probe stream per probe spec, got %d", got)
+	}
+}
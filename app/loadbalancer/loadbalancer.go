@@ -1,75 +1,99 @@
 package loadbalancer
 
 import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/cloudresty/emit"
 	"github.com/cloudresty/nautiluslb/backend"
 	"github.com/cloudresty/nautiluslb/config"
-	"github.com/cloudresty/nautiluslb/kubernetes"
 	"github.com/cloudresty/nautiluslb/utils"
 )
 
 // LoadBalancer represents the load balancer.
 type LoadBalancer struct {
-	backendServers   []*backend.BackendServer
-	nextServer       int
-	Listener         net.Listener
-	listenerAddr     string
-	mu               sync.RWMutex
-	stopChan         chan struct{}
-	stopHealthChecks chan struct{}
-	healthCheckMap   map[string]bool
-	healthCheckCache map[string]bool // Cache for health check status
-	config           config.Configuration
-	requestTimeout   time.Duration
-	ListenerAddress  string
+	backendServers  []*backend.BackendServer
+	strategy        Strategy
+	strategies      map[string]Strategy // Strategies set on services, see strategyFor
+	strategiesMu    sync.Mutex
+	outliers        *outlierDetector
+	trustedProxies  []netip.Prefix // Peers whose connections start with a PROXY protocol header
+	Listener        net.Listener
+	listenerAddr    string
+	mu              sync.RWMutex
+	stopChan        chan struct{}
+	stopOnce        sync.Once
+	sessions        *sessionTracker
+	healthChecks    *healthCheckManager
+	config          config.Configuration
+	ListenerAddress string
 }
 
 // NewLoadBalancer creates a new LoadBalancer instance.
-func NewLoadBalancer(config config.Configuration, requestTimeout time.Duration) *LoadBalancer {
+func NewLoadBalancer(config config.Configuration) *LoadBalancer {
 
 	lb := &LoadBalancer{
-		backendServers:   []*backend.BackendServer{},
-		listenerAddr:     config.ListenerAddress,
-		healthCheckMap:   make(map[string]bool),
-		config:           config,
-		requestTimeout:   requestTimeout,
-		stopChan:         make(chan struct{}),
-		stopHealthChecks: make(chan struct{}),
-		ListenerAddress:  config.ListenerAddress,
-		healthCheckCache: make(map[string]bool),
+		backendServers:  []*backend.BackendServer{},
+		strategy:        NewStrategy(config.Strategy),
+		strategies:      make(map[string]Strategy),
+		outliers:        newOutlierDetector(config.OutlierDetection),
+		trustedProxies:  config.AcceptProxyProtocol.GetTrustedPrefixes(),
+		listenerAddr:    config.ListenerAddress,
+		config:          config,
+		stopChan:        make(chan struct{}),
+		sessions:        newSessionTracker(),
+		ListenerAddress: config.ListenerAddress,
 	}
 	lb.Listener = nil // This should be after the struct initialization
+	lb.healthChecks = newHealthCheckManager(sharedHealthRegistry, lb.setBackendHealth)
 
 	return lb
 }
 
-// Start starts the load balancer.
-func (lb *LoadBalancer) Start() {
+// Start listens on the listener address and serves connections until ctx is
+// done or the load balancer is stopped. Once ctx is done the load balancer is
+// stopped: it no longer accepts connections and its health checks end, while
+// running sessions are left to Shutdown. It returns an error when the listener
+// address cannot be bound.
+func (lb *LoadBalancer) Start(ctx context.Context) error {
 
-	go lb.StartHealthChecks()
-
-	var err error
-	lb.Listener, err = net.Listen("tcp", lb.listenerAddr)
+	listener, err := net.Listen("tcp", lb.listenerAddr)
 	if err != nil {
 		emit.Error.StructuredFields("Failed to listen on port",
 			emit.ZString("port", utils.ExtractPort(lb.listenerAddr)),
 			emit.ZString("error", err.Error()))
-		// Since this is a fatal error, we should exit
-		panic(fmt.Sprintf("Failed to listen on port '%s': %v", utils.ExtractPort(lb.listenerAddr), err))
+		return fmt.Errorf("failed to listen on port '%s': %v", utils.ExtractPort(lb.listenerAddr), err)
 	}
 
-	listener := lb.GetListener()
-
-	if listener == nil {
-		emit.Error.Msg("Listener is not initialized")
-		panic("Listener is not initialized")
+	// Stopped while binding, nothing else closes the listener then
+	lb.mu.Lock()
+	select {
+	case <-lb.stopChan:
+		lb.mu.Unlock()
+		if err := listener.Close(); err != nil {
+			emit.Warn.StructuredFields("Failed to close listener",
+				emit.ZString("error", err.Error()))
+		}
+		return nil
+	default:
+		lb.Listener = listener
 	}
+	lb.mu.Unlock()
+
+	stopOnDone := context.AfterFunc(ctx, lb.Stop)
+	defer stopOnDone()
+
+	go lb.StartHealthChecks()
 
 	// Accept incoming connections
 	for {
@@ -79,9 +103,14 @@ func (lb *LoadBalancer) Start() {
 		case <-lb.stopChan:
 			emit.Info.StructuredFields("Stop signal received, closing listener",
 				emit.ZString("listener_addr", lb.listenerAddr))
-			return
+			return nil
 		default:
 			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				emit.Info.StructuredFields("Listener closed, no longer accepting connections",
+					emit.ZString("listener_addr", lb.listenerAddr))
+				return nil
+			}
 			if err != nil {
 				emit.Error.StructuredFields("Failed to accept connection",
 					emit.ZString("error", err.Error()))
@@ -99,257 +128,518 @@ func (lb *LoadBalancer) Start() {
 // HandleConnection handles a single client connection.
 func (lb *LoadBalancer) HandleConnection(conn net.Conn) {
 
+	session := lb.sessions.add(conn)
+	defer lb.sessions.remove(session)
+
 	defer func() {
-		if err := conn.Close(); err != nil {
+		if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
 			emit.Warn.StructuredFields("Failed to close client connection",
 				emit.ZString("error", err.Error()))
 		}
 	}()
 
+	// Get the listener port
+	listenerPort := conn.LocalAddr().(*net.TCPAddr).Port
+
+	// Behind another load balancer, the client is the one of its header
+	if lb.trustsProxyHeader(conn) {
+		proxied, err := readProxyHeader(conn, lb.config.AcceptProxyProtocol.GetHeaderTimeout())
+		if err != nil {
+			emit.Warn.StructuredFields("Rejected connection without a valid PROXY protocol header",
+				emit.ZString("peer_addr", conn.RemoteAddr().String()),
+				emit.ZInt("listener_port", listenerPort),
+				emit.ZString("error", err.Error()))
+			return
+		}
+		conn = proxied
+	}
+
 	// Get the client IP address
 	clientIP, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	affinityKey := clientIP
 	if err != nil {
 		emit.Error.StructuredFields("Failed to get client IP",
 			emit.ZString("error", err.Error()))
 		clientIP = "unknown"
+		affinityKey = ""
 	}
 
-	// Get the listener port
-	listenerPort := conn.LocalAddr().(*net.TCPAddr).Port
+	// Correlates the logs of the session and, when enabled, its PROXY
+	// protocol header
+	sessionID := rand.Text()
+
 	emit.Info.StructuredFields("Received client request",
+		emit.ZString("session_id", sessionID),
 		emit.ZString("client_ip", clientIP),
 		emit.ZInt("listener_port", listenerPort))
 
-	backend := lb.getNextBackend()
-
-	if backend == nil {
-
-		// No healthy backends
-		emit.Error.StructuredFields("No healthy backends available",
-			emit.ZString("client_ip", clientIP),
-			emit.ZInt("listener_port", listenerPort))
+	backend, backendConn := lb.dialBackend(sessionID, affinityKey, clientIP, listenerPort)
+	if backendConn == nil {
 		return
 	}
+	defer backend.ReleaseConnection()
 
-	emit.Info.StructuredFields("Forwarding client traffic to backend",
-		emit.ZString("client_ip", clientIP),
-		emit.ZInt("listener_port", listenerPort),
-		emit.ZString("loadbalancer", lb.config.Name),
-		emit.ZString("backend_ip", backend.IP),
-		emit.ZInt("backend_port", backend.Port))
-	backend.ActiveConnections++
-
+	// Wait for the data transfer to complete and then close the backend connection
 	defer func() {
-		// log.Printf("Releasing backend '%s:%d'", backend.IP, backend.Port)
-		backend.ActiveConnections--
+		if err := backendConn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			emit.Warn.StructuredFields("Failed to close backend connection",
+				emit.ZString("error", err.Error()))
+		}
 	}()
 
-	// Get a connection from the pool or create a new one
-	backendConn, err := net.Dial("tcp", net.JoinHostPort(backend.IP, fmt.Sprintf("%d", backend.Port)))
-	if err != nil {
-
-		// Handle backend connection error
-		emit.Error.StructuredFields("Failed to connect to backend",
-			emit.ZString("backend_ip", backend.IP),
-			emit.ZInt("backend_port", backend.Port),
-			emit.ZString("client_ip", clientIP),
-			emit.ZString("error", err.Error()))
+	// The load balancer shut down or the backend was removed while connecting
+	if !lb.connectSession(session, backend, backendConn) {
+		return
+	}
 
-		// Check for specific error types and log accordingly
-		if opErr, ok := err.(*net.OpError); ok {
-			if opErr.Op == "dial" && opErr.Net == "tcp" {
-				emit.Error.StructuredFields("Connection refused to backend",
-					emit.ZString("backend_ip", backend.IP),
-					emit.ZInt("backend_port", backend.Port),
-					emit.ZString("error", opErr.Err.Error()))
-			} else {
-				emit.Error.StructuredFields("Network error connecting to backend",
-					emit.ZString("backend_ip", backend.IP),
-					emit.ZInt("backend_port", backend.Port),
-					emit.ZString("error", opErr.Err.Error()))
-			}
+	if version := lb.proxyProtocolFor(backend); version != "" {
+		if err := writeProxyHeader(backendConn, version, conn.RemoteAddr(), conn.LocalAddr(), lb.proxyTLVs(sessionID)...); err != nil {
+			emit.Error.StructuredFields("Failed to send PROXY protocol header to backend",
+				emit.ZString("backend_ip", backend.IP),
+				emit.ZInt("backend_port", backend.Port),
+				emit.ZString("error", err.Error()))
+			return
 		}
+	}
 
+	// Services may set their own idle timeout
+	idleTimeout := lb.config.GetIdleTimeout()
+	if backend.IdleTimeout > 0 {
+		idleTimeout = backend.IdleTimeout
 	}
+	activity := newSessionActivity(idleTimeout, lb.config.GetMaxConnectionDuration())
+	clientSide := &timeoutConn{Conn: conn, activity: activity}
+	backendSide := &timeoutConn{Conn: backendConn, activity: activity}
 
 	// Use a WaitGroup to wait for both goroutines to finish
 	var wg sync.WaitGroup
+	var clientDone atomic.Bool
+	var clientResult, backendResult copyResult
 	wg.Add(2)
 
-	go copyData(backendConn, conn, &wg, "client to backend")
-	go copyData(conn, backendConn, &wg, "backend to client")
+	go func() {
+		defer wg.Done()
+		clientResult = copyData(backendSide, clientSide, "client to backend", activity, func() { clientDone.Store(true) })
+	}()
 
-	// Wait for the data transfer to complete and then return the connection to the pool
-	defer func() {
-		if err := backendConn.Close(); err != nil {
-			emit.Warn.StructuredFields("Failed to close backend connection",
-				emit.ZString("error", err.Error()))
-		}
+	go func() {
+		defer wg.Done()
+		backendResult = copyData(clientSide, backendSide, "backend to client", activity, nil)
+		lb.observeBackendSession(backend, backendResult, clientDone.Load())
 	}()
 
 	wg.Wait()
 
+	// Both directions usually time out together, count the session once
+	if kind := cmp.Or(clientResult.timeout, backendResult.timeout); kind != "" {
+		recordTimeout(lb.config.Name, kind)
+		emit.Info.StructuredFields("Session timed out, closing connections",
+			emit.ZString("loadbalancer", lb.config.Name),
+			emit.ZString("client_ip", clientIP),
+			emit.ZString("backend_ip", backend.IP),
+			emit.ZInt("backend_port", backend.Port),
+			emit.ZString("timeout", kind))
+	}
+
 }
 
-// copyData copies data from src to dst and logs errors.
-func copyData(dst net.Conn, src net.Conn, wg *sync.WaitGroup, direction string) {
+// copyResult describes how one direction of a proxied session ended.
+type copyResult struct {
+	bytes   int64
+	readErr error  // Error reading from the source, nil on a clean EOF
+	timeout string // Kind of session timeout that ended the copy, if any
+}
+
+// trackingReader records the first non-EOF error returned by the wrapped reader,
+// so read failures on the source can be told apart from write failures on the
+// destination.
+type trackingReader struct {
+	reader io.Reader
+	err    error
+}
 
-	defer wg.Done()
+func (r *trackingReader) Read(p []byte) (int, error) {
 
-	_, err := io.Copy(dst, src)
+	n, err := r.reader.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+
+	return n, err
+
+}
+
+// copyData copies data from src to dst and logs errors. Once src is done,
+// srcDone is called when not nil, and then the write side of dst is closed so
+// that the peer sees the end of the stream and the session can wind down.
+// Timeouts of either side are reported in the result, as the kind of timeout
+// of the session that caused them.
+func copyData(dst net.Conn, src io.Reader, direction string, activity *sessionActivity, srcDone func()) copyResult {
+
+	reader := &trackingReader{reader: src}
+	result := copyResult{}
+
+	n, err := io.Copy(dst, reader)
 	if err != nil && err != io.EOF {
 
-		emit.Error.StructuredFields("Error copying data between connections",
-			emit.ZString("direction", direction),
-			emit.ZString("error", err.Error()))
+		if isTimeout(err) {
+			result.timeout = activity.timeoutKind()
+		} else if !errors.Is(err, net.ErrClosed) {
+			emit.Error.StructuredFields("Error copying data between connections",
+				emit.ZString("direction", direction),
+				emit.ZString("error", err.Error()))
+		}
 
-		// Close the destination connection to signal the error
-		if closer, ok := dst.(interface{ CloseWrite() error }); ok {
-			if err := closer.CloseWrite(); err != nil {
-				emit.Warn.StructuredFields("Failed to close write connection",
-					emit.ZString("error", err.Error()))
-			}
+	}
+
+	if srcDone != nil {
+		srcDone()
+	}
+
+	if closer, ok := dst.(interface{ CloseWrite() error }); ok {
+		if err := closer.CloseWrite(); err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, syscall.ENOTCONN) {
+			emit.Warn.StructuredFields("Failed to close write connection",
+				emit.ZString("error", err.Error()))
 		}
+	}
+
+	result.bytes, result.readErr = n, reader.err
 
+	return result
+
+}
+
+// observeBackendSession feeds the outcome of the backend side of a session to
+// the outlier detector. A reset from the backend, or a backend closing the
+// connection without sending anything while the client was still connected,
+// counts as a failure. Any response data counts as a success.
+func (lb *LoadBalancer) observeBackendSession(server *backend.BackendServer, result copyResult, clientDone bool) {
+
+	switch {
+	case errors.Is(result.readErr, syscall.ECONNRESET):
+		lb.reportBackendFailure(server, "connection reset by backend")
+	case result.bytes > 0:
+		lb.outliers.ReportSuccess(server.Address())
+	case result.readErr == nil && !clientDone:
+		lb.reportBackendFailure(server, "backend closed connection immediately")
 	}
 
 }
 
-// getNextBackend returns the next backend server (round-robin for now).
-func (lb *LoadBalancer) getNextBackend() *backend.BackendServer {
+// reportBackendFailure records a live traffic failure for the backend.
+func (lb *LoadBalancer) reportBackendFailure(server *backend.BackendServer, reason string) {
 
-	const maxRetries = 3
+	emit.Debug.StructuredFields("Passive health failure for backend",
+		emit.ZString("backend_ip", server.IP),
+		emit.ZInt("backend_port", server.Port),
+		emit.ZString("reason", reason))
 
-	for i := range maxRetries {
+	lb.mu.RLock()
+	poolSize := 0
+	for _, candidate := range lb.backendServers {
+		if candidate.PortName == lb.config.BackendPortName {
+			poolSize++
+		}
+	}
+	lb.mu.RUnlock()
 
-		lb.mu.Lock()
+	lb.outliers.ReportFailure(server.Address(), poolSize)
 
-		if len(lb.backendServers) == 0 {
-			lb.mu.Unlock()
-			return nil
+}
+
+// dialBackend connects to a healthy backend. When a dial fails the backend is
+// excluded and another one is picked, until the configured number of attempts
+// or the retry time budget is exhausted. On success the returned backend has
+// the connection accounted for and the caller must release it.
+func (lb *LoadBalancer) dialBackend(sessionID string, affinityKey string, clientIP string, listenerPort int) (*backend.BackendServer, net.Conn) {
+
+	maxAttempts := lb.config.Retry.GetMaxAttempts()
+	deadline := time.Now().Add(lb.config.Retry.GetBudget())
+	tried := make(map[string]bool)
+
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			emit.Error.StructuredFields("Retry budget exhausted, closing client connection",
+				emit.ZString("client_ip", clientIP),
+				emit.ZInt("listener_port", listenerPort),
+				emit.ZInt("attempts", attempt-1))
+			return nil, nil
+		}
+
+		server := lb.selectBackend(affinityKey, tried)
+		if server == nil {
+			// No healthy backends left to try
+			emit.Error.StructuredFields("No healthy backends available",
+				emit.ZString("client_ip", clientIP),
+				emit.ZInt("listener_port", listenerPort),
+				emit.ZInt("attempts", attempt-1))
+			return nil, nil
 		}
 
-		// Filter backends by listener port
-		filteredBackends := []*backend.BackendServer{}
+		tried[server.Address()] = true
 
-		for _, server := range lb.backendServers {
+		emit.Info.StructuredFields("Forwarding client traffic to backend",
+			emit.ZString("session_id", sessionID),
+			emit.ZString("client_ip", clientIP),
+			emit.ZInt("listener_port", listenerPort),
+			emit.ZString("loadbalancer", lb.config.Name),
+			emit.ZString("backend_ip", server.IP),
+			emit.ZInt("backend_port", server.Port),
+			emit.ZInt("attempt", attempt))
+
+		if active := server.AcquireConnection(); server.MaxConnections > 0 && active > int64(server.MaxConnections) {
+			// Another connection took the last free slot, try another
+			// backend without spending an attempt
+			server.ReleaseConnection()
+			attempt--
+			continue
+		}
 
-			if server.PortName != lb.config.BackendPortName {
+		backendConn, err := net.DialTimeout("tcp", server.Address(), min(lb.config.GetConnectTimeout(), remaining))
+		if err == nil {
+			return server, backendConn
+		}
 
-				continue
+		server.ReleaseConnection()
+		if isDialTimeout(err) {
+			recordTimeout(lb.config.Name, timeoutConnect)
+		}
+		logDialError(server, clientIP, err)
+		lb.reportBackendFailure(server, "dial failed")
 
-			} else {
+	}
+
+	emit.Error.StructuredFields("All backend connection attempts failed, closing client connection",
+		emit.ZString("client_ip", clientIP),
+		emit.ZInt("listener_port", listenerPort),
+		emit.ZInt("attempts", maxAttempts))
 
-				filteredBackends = append(filteredBackends, server)
+	return nil, nil
 
-			}
+}
 
+// isDialTimeout reports whether a dial failed because it timed out.
+func isDialTimeout(err error) bool {
+
+	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+
+}
+
+// logDialError logs a failed connection attempt to a backend.
+func logDialError(server *backend.BackendServer, clientIP string, err error) {
+
+	emit.Error.StructuredFields("Failed to connect to backend",
+		emit.ZString("backend_ip", server.IP),
+		emit.ZInt("backend_port", server.Port),
+		emit.ZString("client_ip", clientIP),
+		emit.ZString("error", err.Error()))
+
+	// Check for specific error types and log accordingly
+	if opErr, ok := err.(*net.OpError); ok {
+		if opErr.Op == "dial" && opErr.Net == "tcp" {
+			emit.Error.StructuredFields("Connection refused to backend",
+				emit.ZString("backend_ip", server.IP),
+				emit.ZInt("backend_port", server.Port),
+				emit.ZString("error", opErr.Err.Error()))
+		} else {
+			emit.Error.StructuredFields("Network error connecting to backend",
+				emit.ZString("backend_ip", server.IP),
+				emit.ZInt("backend_port", server.Port),
+				emit.ZString("error", opErr.Err.Error()))
 		}
+	}
 
-		if len(filteredBackends) == 0 {
-			lb.mu.Unlock()
-			emit.Warn.StructuredFields("No healthy backends available",
-				emit.ZString("configuration", lb.config.Name))
-			return nil
+}
+
+// getNextBackend returns the next healthy backend server chosen by the configured strategy.
+func (lb *LoadBalancer) getNextBackend() *backend.BackendServer {
+
+	return lb.selectBackend("", nil)
+
+}
+
+// selectBackend returns a healthy backend server for the given client IP,
+// skipping the backends whose address is in exclude. Keyed strategies use
+// the client IP to pin the client to a backend, all other strategies ignore it.
+func (lb *LoadBalancer) selectBackend(clientIP string, exclude map[string]bool) *backend.BackendServer {
+
+	lb.mu.RLock()
+	candidates := lb.healthyBackends(exclude)
+	lb.mu.RUnlock()
+
+	if len(candidates) == 0 {
+		emit.Warn.StructuredFields("No healthy backends available",
+			emit.ZString("configuration", lb.config.Name))
+		return nil
+	}
+
+	strategy := lb.strategyFor(candidates)
+
+	if keyed, ok := strategy.(KeyedStrategy); ok {
+		lb.mu.RLock()
+		pool := lb.portBackends()
+		lb.mu.RUnlock()
+
+		return keyed.NextForKey(clientIP, pool, candidates)
+	}
+
+	return strategy.Next(candidates)
+
+}
+
+// strategyFor returns the strategy to pick among candidates: the one set on
+// their services when they all agree on it, the configured one otherwise.
+func (lb *LoadBalancer) strategyFor(candidates []*backend.BackendServer) Strategy {
+
+	name := candidates[0].Strategy
+	for _, server := range candidates[1:] {
+		if server.Strategy != name {
+			return lb.strategy
 		}
+	}
 
-		// Apply round-robin to the filtered backends
-		lb.nextServer = (lb.nextServer + 1) % len(filteredBackends)
-		server := filteredBackends[lb.nextServer]
+	if name == "" || name == lb.config.Strategy {
+		return lb.strategy
+	}
 
-		lb.mu.Unlock()
+	lb.strategiesMu.Lock()
+	defer lb.strategiesMu.Unlock()
+
+	strategy, ok := lb.strategies[name]
+	if !ok {
+		strategy = NewStrategy(name)
+		lb.strategies[name] = strategy
+	}
+
+	return strategy
+
+}
+
+// portBackends returns the backends serving this configuration's port,
+// available or not. The caller must hold lb.mu.
+func (lb *LoadBalancer) portBackends() []*backend.BackendServer {
+
+	pool := make([]*backend.BackendServer, 0, len(lb.backendServers))
+
+	for _, server := range lb.backendServers {
+		if server.PortName == lb.config.BackendPortName {
+			pool = append(pool, server)
+		}
+	}
+
+	return pool
+
+}
+
+// healthyBackends returns the healthy backends serving this configuration's port,
+// leaving out those whose address is in exclude and those at their connection
+// limit. The caller must hold lb.mu.
+func (lb *LoadBalancer) healthyBackends(exclude map[string]bool) []*backend.BackendServer {
+
+	candidates := make([]*backend.BackendServer, 0, len(lb.backendServers))
+
+	for _, server := range lb.backendServers {
 
-		if server.Healthy {
-			return server
+		if server.PortName != lb.config.BackendPortName || !server.Healthy {
+			continue
 		}
 
-		if i < maxRetries-1 {
-			time.Sleep(100 * time.Millisecond)
+		if exclude[server.Address()] || lb.outliers.IsEjected(server.Address()) {
+			continue
 		}
+
+		if server.MaxConnections > 0 && server.Connections() >= int64(server.MaxConnections) {
+			continue
+		}
+
+		candidates = append(candidates, server)
+
 	}
 
-	return nil // No healthy backends after retries
+	return candidates
+
 }
 
-// StartHealthChecks starts health checks for all backend servers.
+// StartHealthChecks reconciles the running health checks with the current
+// backend servers: new backends get a checker, removed ones lose theirs.
 func (lb *LoadBalancer) StartHealthChecks() {
 
 	lb.mu.Lock()
-	servers := lb.backendServers
-	lb.mu.Unlock()
+	defer lb.mu.Unlock()
 
-	for _, server := range servers {
-		go lb.runHealthCheck(server)
-	}
+	lb.healthChecks.Sync(lb.backendServers, lb.healthCheckSettings)
 
 }
 
-func (lb *LoadBalancer) runHealthCheck(server *backend.BackendServer) {
+// setBackendHealth applies a health check result to every backend object with
+// the given address.
+func (lb *LoadBalancer) setBackendHealth(address string, healthy bool) {
 
 	lb.mu.Lock()
+	defer lb.mu.Unlock()
 
-	if _, ok := lb.healthCheckMap[fmt.Sprintf("%s:%d", server.IP, server.Port)]; ok {
-		emit.Debug.StructuredFields("Health check already running for backend",
-			emit.ZString("backend_ip", server.IP),
-			emit.ZInt("backend_port", server.Port))
-		lb.mu.Unlock()
-		return
+	for _, server := range lb.backendServers {
+		if server.Address() == address {
+			server.PreviousHealthy = server.Healthy
+			server.Healthy = healthy
+		}
 	}
 
-	lb.healthCheckMap[fmt.Sprintf("%s:%d", server.IP, server.Port)] = true
-	lb.mu.Unlock()
+}
 
-	// Check if the health check is already in the cache
-	if _, exists := lb.healthCheckCache[fmt.Sprintf("%s:%d", server.IP, server.Port)]; !exists {
+// ActiveHealthChecks returns the addresses of the backends currently being
+// health checked.
+func (lb *LoadBalancer) ActiveHealthChecks() []string {
 
-		emit.Info.StructuredFields("Starting health check for backend",
-			emit.ZString("backend_ip", server.IP),
-			emit.ZInt("backend_port", server.Port),
-			emit.ZInt("interval_seconds", 10))
-		lb.healthCheckCache[fmt.Sprintf("%s:%d", server.IP, server.Port)] = true
+	return lb.healthChecks.Active()
+
+}
 
+// healthCheckSettings returns the health check settings for a backend, preferring
+// the settings set on its Kubernetes service over those of the configuration.
+// Probes of the backend port send the PROXY protocol header it expects, while
+// a separate health check port is probed as is.
+func (lb *LoadBalancer) healthCheckSettings(server *backend.BackendServer) config.HealthCheckConfig {
+
+	settings := lb.config.HealthCheck
+	if server.HealthCheckOverride != nil {
+		settings = *server.HealthCheckOverride
+	}
+
+	if settings.Port == 0 || settings.Port == server.Port {
+		settings.ProxyProtocol = lb.proxyProtocolFor(server)
 	}
 
-	server.HealthCheck(time.Duration(10) * time.Second)
+	return settings
 
 }
 
-// StopHealthChecks stops health checks for all backend servers.
+// StopHealthChecks stops health checks for all backend servers and waits for
+// the running probes to finish.
 func (lb *LoadBalancer) StopHealthChecks() {
 
-	lb.mu.Lock()
-	defer lb.mu.Unlock()
-
-	// Check if already stopped to prevent closing channel twice
-	select {
-	case <-lb.stopHealthChecks:
-		// Already closed
+	if lb.healthChecks.Stopped() {
 		return
-	default:
-		// Not closed yet, safe to close
 	}
 
 	emit.Info.StructuredFields("Stopping health checks",
 		emit.ZString("listener_addr", lb.listenerAddr))
-	close(lb.stopHealthChecks)
-
-}
 
-func (lb *LoadBalancer) areHealthChecksStopped() bool {
-
-	select {
-	case <-lb.stopHealthChecks:
-		return true
-	default:
-		return false
+	// Wait with a timeout to prevent hanging on a slow probe
+	if !lb.healthChecks.Stop(5 * time.Second) {
+		emit.Warn.StructuredFields("Timeout waiting for health checks to stop",
+			emit.ZString("listener_addr", lb.listenerAddr))
 	}
 
 }
 
-// DiscoverK8sServices discovers services in Kubernetes and adds them as backends.
-func (lb *LoadBalancer) DiscoverK8sServices() {
+func (lb *LoadBalancer) areHealthChecksStopped() bool {
 
-	kubernetes.DiscoverK8sServices(lb, lb.config)
+	return lb.healthChecks.Stopped()
 
 }
 
@@ -367,9 +657,22 @@ func (lb *LoadBalancer) GetBackendServers() []*backend.BackendServer {
 
 }
 
-// SetBackendServers sets the backend servers
+// SetBackendServers sets the backend servers. Backends that are already being
+// health checked take over the last known health of their address, removed
+// backends are drained and forgotten by the outlier detector. The caller must
+// hold the mutex returned by GetMu.
 func (lb *LoadBalancer) SetBackendServers(servers []*backend.BackendServer) {
 
+	current := make(map[string]bool, len(servers))
+	for _, server := range servers {
+		current[server.Address()] = true
+		if healthy, ok := lb.healthChecks.Status(server.Address()); ok {
+			server.Healthy = healthy
+		}
+	}
+
+	lb.outliers.Prune(current)
+	lb.drainRemovedBackends(lb.backendServers, servers)
 	lb.backendServers = servers
 
 }
@@ -377,15 +680,33 @@ func (lb *LoadBalancer) SetBackendServers(servers []*backend.BackendServer) {
 // GetListener returns the listener
 func (lb *LoadBalancer) GetListener() net.Listener {
 
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
 	return lb.Listener
 
 }
 
-// Stop stops the load balancer
+// Stop stops accepting connections and stops the health checks. Running
+// sessions are left alone, see Shutdown. Stopping more than once has no
+// effect.
 func (lb *LoadBalancer) Stop() {
 
-	if lb.Listener != nil {
-		if err := lb.Listener.Close(); err != nil {
+	lb.stopOnce.Do(lb.stop)
+
+}
+
+// stop implements Stop.
+func (lb *LoadBalancer) stop() {
+
+	lb.mu.Lock()
+	listener := lb.Listener
+	lb.Listener = nil
+	close(lb.stopChan)
+	lb.mu.Unlock()
+
+	if listener != nil {
+		if err := listener.Close(); err != nil {
 			emit.Warn.StructuredFields("Failed to close listener",
 				emit.ZString("error", err.Error()))
 		}
@@ -393,26 +714,6 @@ func (lb *LoadBalancer) Stop() {
 			emit.ZString("port", utils.ExtractPort(lb.listenerAddr)))
 	}
 
-	lb.Listener = nil
-	close(lb.stopChan)
-
-	// Stop health checks first, then wait for them to stop
 	lb.StopHealthChecks()
 
-	// Wait for health checks to stop with a timeout to prevent hanging
-	timeout := time.After(5 * time.Second)
-	ticker := time.NewTicker(100 * time.Millisecond)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-timeout:
-			emit.Warn.StructuredFields("Timeout waiting for health checks to stop")
-			return
-		case <-ticker.C:
-			if lb.areHealthChecksStopped() {
-				return
-			}
-		}
-	}
 }
@@ -1,7 +1,12 @@
 package loadbalancer
 
 import (
+	"context"
+	"errors"
+	"net"
+	"os"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -18,8 +23,7 @@ func TestNewLoadBalancer(t *testing.T) {
 		Namespace:       "default",
 	}
 
-	timeout := 30 * time.Second
-	lb := NewLoadBalancer(cfg, timeout)
+	lb := NewLoadBalancer(cfg)
 
 	if lb == nil {
 		t.Fatal("NewLoadBalancer should not return nil")
@@ -29,24 +33,12 @@ func TestNewLoadBalancer(t *testing.T) {
 		t.Errorf("Expected config name 'test-lb', got '%s'", lb.config.Name)
 	}
 
-	if lb.requestTimeout != timeout {
-		t.Errorf("Expected request timeout %v, got %v", timeout, lb.requestTimeout)
-	}
-
 	if lb.stopChan == nil {
 		t.Error("stopChan should be initialized")
 	}
 
-	if lb.stopHealthChecks == nil {
-		t.Error("stopHealthChecks should be initialized")
-	}
-
-	if lb.healthCheckMap == nil {
-		t.Error("healthCheckMap should be initialized")
-	}
-
-	if lb.healthCheckCache == nil {
-		t.Error("healthCheckCache should be initialized")
+	if lb.healthChecks == nil {
+		t.Error("healthChecks should be initialized")
 	}
 
 	// Note: portBackendMap is not initialized in NewLoadBalancer - this is expected behavior
@@ -60,7 +52,7 @@ func TestLoadBalancerGetters(t *testing.T) {
 		BackendPortName: "http",
 	}
 
-	lb := NewLoadBalancer(cfg, 30*time.Second)
+	lb := NewLoadBalancer(cfg)
 
 	// Test GetMu
 	mu := lb.GetMu()
@@ -87,7 +79,7 @@ func TestSetBackendServers(t *testing.T) {
 		BackendPortName: "http",
 	}
 
-	lb := NewLoadBalancer(cfg, 30*time.Second)
+	lb := NewLoadBalancer(cfg)
 
 	servers := []*backend.BackendServer{
 		{
@@ -130,7 +122,7 @@ func TestGetNextBackend(t *testing.T) {
 		BackendPortName: "http",
 	}
 
-	lb := NewLoadBalancer(cfg, 30*time.Second)
+	lb := NewLoadBalancer(cfg)
 
 	servers := []*backend.BackendServer{
 		{
@@ -186,7 +178,7 @@ func TestGetNextBackendNoHealthyServers(t *testing.T) {
 		BackendPortName: "http",
 	}
 
-	lb := NewLoadBalancer(cfg, 30*time.Second)
+	lb := NewLoadBalancer(cfg)
 
 	servers := []*backend.BackendServer{
 		{
@@ -232,7 +224,7 @@ func TestGetNextBackendWithUnhealthyServers(t *testing.T) {
 		BackendPortName: "http",
 	}
 
-	lb := NewLoadBalancer(cfg, 30*time.Second)
+	lb := NewLoadBalancer(cfg)
 
 	servers := []*backend.BackendServer{
 		{
@@ -288,7 +280,7 @@ func TestGetNextBackendEmptyServers(t *testing.T) {
 		BackendPortName: "http",
 	}
 
-	lb := NewLoadBalancer(cfg, 30*time.Second)
+	lb := NewLoadBalancer(cfg)
 
 	backend := lb.getNextBackend()
 	if backend != nil {
@@ -304,7 +296,7 @@ func TestStopHealthChecks(t *testing.T) {
 		BackendPortName: "http",
 	}
 
-	lb := NewLoadBalancer(cfg, 30*time.Second)
+	lb := NewLoadBalancer(cfg)
 
 	// Test stopping health checks
 	lb.StopHealthChecks()
@@ -322,7 +314,7 @@ func TestLoadBalancerStop(t *testing.T) {
 		BackendPortName: "http",
 	}
 
-	lb := NewLoadBalancer(cfg, 30*time.Second)
+	lb := NewLoadBalancer(cfg)
 
 	// Test stopping the load balancer
 	lb.Stop()
@@ -344,7 +336,7 @@ func TestLoadBalancerConcurrency(t *testing.T) {
 		BackendPortName: "http",
 	}
 
-	lb := NewLoadBalancer(cfg, 30*time.Second)
+	lb := NewLoadBalancer(cfg)
 
 	servers := []*backend.BackendServer{
 		{
@@ -398,3 +390,336 @@ func TestLoadBalancerConcurrency(t *testing.T) {
 		t.Fatal("Concurrent test timed out")
 	}
 }
+
+func TestSelectBackendConsistentHash(t *testing.T) {
+	cfg := config.Configuration{
+		Name:            "test-lb",
+		ListenerAddress: ":8080",
+		RequestTimeout:  30,
+		BackendPortName: "http",
+		Strategy:        config.StrategyConsistentHash,
+	}
+
+	lb := NewLoadBalancer(cfg)
+
+	lb.SetBackendServers([]*backend.BackendServer{
+		{ID: 1, IP: "192.168.1.1", Port: 8080, PortName: "http", Healthy: true},
+		{ID: 2, IP: "192.168.1.2", Port: 8080, PortName: "http", Healthy: true},
+		{ID: 3, IP: "192.168.1.3", Port: 8080, PortName: "http", Healthy: true},
+	})
+
+	first := lb.selectBackend("203.0.113.7", nil)
+	if first == nil {
+		t.Fatal("selectBackend should not return nil when healthy servers exist")
+	}
+
+	for i := 0; i < 10; i++ {
+		if got := lb.selectBackend("203.0.113.7", nil); got.ID != first.ID {
+			t.Errorf("Expected client to stay on server %d, got %d", first.ID, got.ID)
+		}
+	}
+}
+
+// closedPort returns a local TCP port with nothing listening on it.
+func closedPort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create test listener: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	if err := listener.Close(); err != nil {
+		t.Fatalf("Failed to close test listener: %v", err)
+	}
+	return port
+}
+
+// acceptingListener returns a local listener that accepts and holds connections.
+func acceptingListener(t *testing.T) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create test listener: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { _ = conn.Close() })
+		}
+	}()
+	return listener
+}
+
+func TestDialBackendFailsOver(t *testing.T) {
+	cfg := config.Configuration{
+		Name:            "test-lb",
+		ListenerAddress: ":8080",
+		BackendPortName: "http",
+	}
+
+	lb := NewLoadBalancer(cfg)
+
+	live := acceptingListener(t)
+	dead := &backend.BackendServer{ID: 1, IP: "127.0.0.1", Port: closedPort(t), PortName: "http", Healthy: true}
+	alive := &backend.BackendServer{ID: 2, IP: "127.0.0.1", Port: live.Addr().(*net.TCPAddr).Port, PortName: "http", Healthy: true}
+
+	lb.SetBackendServers([]*backend.BackendServer{dead, alive})
+
+	// Round-robin starts with the dead backend, so the first attempt must fail over
+	server, conn := lb.dialBackend("test-session", "", "127.0.0.1", 8080)
+	if conn == nil {
+		t.Fatal("Expected dialBackend to fail over to the live backend")
+	}
+	defer func() { _ = conn.Close() }()
+
+	if server != alive {
+		t.Errorf("Expected live backend %d, got %d", alive.ID, server.ID)
+	}
+
+	if dead.Connections() != 0 {
+		t.Errorf("Expected failed attempt to release its connection, got %d", dead.Connections())
+	}
+
+	if alive.Connections() != 1 {
+		t.Errorf("Expected 1 active connection on live backend, got %d", alive.Connections())
+	}
+}
+
+func TestDialBackendGivesUp(t *testing.T) {
+	cfg := config.Configuration{
+		Name:            "test-lb",
+		ListenerAddress: ":8080",
+		BackendPortName: "http",
+		Retry:           config.RetryConfig{MaxAttempts: 2},
+	}
+
+	lb := NewLoadBalancer(cfg)
+
+	servers := []*backend.BackendServer{
+		{ID: 1, IP: "127.0.0.1", Port: closedPort(t), PortName: "http", Healthy: true},
+		{ID: 2, IP: "127.0.0.1", Port: closedPort(t), PortName: "http", Healthy: true},
+		{ID: 3, IP: "127.0.0.1", Port: closedPort(t), PortName: "http", Healthy: true},
+	}
+	lb.SetBackendServers(servers)
+
+	server, conn := lb.dialBackend("test-session", "", "127.0.0.1", 8080)
+	if conn != nil || server != nil {
+		t.Fatal("Expected dialBackend to give up when every backend refuses")
+	}
+
+	for _, s := range servers {
+		if s.Connections() != 0 {
+			t.Errorf("Expected backend %d to have no active connections, got %d", s.ID, s.Connections())
+		}
+	}
+
+	// Only two of the three backends may have been tried, each failed dial
+	// is reported to the outlier detector
+	lb.outliers.mu.Lock()
+	defer lb.outliers.mu.Unlock()
+
+	attempts := 0
+	for _, state := range lb.outliers.hosts {
+		attempts += state.consecutiveFailures
+	}
+
+	if attempts != 2 {
+		t.Errorf("Expected 2 connection attempts, got %d", attempts)
+	}
+}
+
+func TestHealthCheckSettings(t *testing.T) {
+	cfg := config.Configuration{
+		Name:            "test-lb",
+		ListenerAddress: ":8080",
+		BackendPortName: "http",
+		HealthCheck:     config.HealthCheckConfig{Interval: 5},
+	}
+
+	lb := NewLoadBalancer(cfg)
+
+	server := &backend.BackendServer{ID: 1, IP: "192.168.1.1", Port: 8080, PortName: "http"}
+	if got := lb.healthCheckSettings(server); got.Interval != 5 || got.GetType() != config.HealthCheckTCP {
+		t.Errorf("Expected configuration health check settings, got %+v", got)
+	}
+
+	server.HealthCheckOverride = &config.HealthCheckConfig{
+		Type: config.HealthCheckHTTP,
+		HTTP: config.HTTPHealthCheckConfig{Path: "/healthz"},
+	}
+	if got := lb.healthCheckSettings(server); got.GetType() != config.HealthCheckHTTP || got.HTTP.Path != "/healthz" {
+		t.Errorf("Expected service health check override, got %+v", got)
+	}
+}
+
+func TestHealthCheckSettingsProxyProtocol(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured string
+		annotated  string
+		port       int
+		expected   string
+	}{
+		{"Disabled", "", "", 0, ""},
+		{"From configuration", config.ProxyProtocolV2, "", 0, config.ProxyProtocolV2},
+		{"From service", "", config.ProxyProtocolV1, 0, config.ProxyProtocolV1},
+		{"Service opts out", config.ProxyProtocolV2, config.ProxyProtocolNone, 0, ""},
+		{"Backend port named", config.ProxyProtocolV2, "", 8080, config.ProxyProtocolV2},
+		{"Separate health check port", config.ProxyProtocolV2, "", 9000, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := NewLoadBalancer(config.Configuration{
+				ProxyProtocol: config.ProxyProtocolConfig{Version: tt.configured},
+				HealthCheck:   config.HealthCheckConfig{Port: tt.port},
+			})
+			server := &backend.BackendServer{IP: "192.168.1.1", Port: 8080, ProxyProtocol: tt.annotated}
+
+			if got := lb.healthCheckSettings(server).ProxyProtocol; got != tt.expected {
+				t.Errorf("healthCheckSettings().ProxyProtocol = %q; want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestStrategyFromServices(t *testing.T) {
+	cfg := config.Configuration{
+		Name:            "test-lb",
+		ListenerAddress: ":8080",
+		BackendPortName: "http",
+	}
+
+	lb := NewLoadBalancer(cfg)
+
+	agreeing := []*backend.BackendServer{
+		{ID: 1, IP: "10.0.0.1", Port: 80, Strategy: config.StrategyLeastConnections},
+		{ID: 2, IP: "10.0.0.2", Port: 80, Strategy: config.StrategyLeastConnections},
+	}
+
+	strategy := lb.strategyFor(agreeing)
+	if _, ok := strategy.(*leastConnectionsStrategy); !ok {
+		t.Errorf("Expected the strategy of the services, got %T", strategy)
+	}
+
+	if lb.strategyFor(agreeing) != strategy {
+		t.Error("Expected the strategy of the services to be kept between picks")
+	}
+
+	disagreeing := []*backend.BackendServer{
+		{ID: 1, IP: "10.0.0.1", Port: 80, Strategy: config.StrategyLeastConnections},
+		{ID: 2, IP: "10.0.0.2", Port: 80},
+	}
+
+	if lb.strategyFor(disagreeing) != lb.strategy {
+		t.Error("Expected the configured strategy when services disagree")
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	cfg := config.Configuration{
+		Name:            "test-lb",
+		ListenerAddress: ":8080",
+		BackendPortName: "http",
+	}
+
+	lb := NewLoadBalancer(cfg)
+
+	live := acceptingListener(t)
+	port := live.Addr().(*net.TCPAddr).Port
+
+	full := &backend.BackendServer{ID: 1, IP: "127.0.0.1", Port: port, PortName: "http", Healthy: true, MaxConnections: 1}
+	lb.SetBackendServers([]*backend.BackendServer{full})
+
+	server, conn := lb.dialBackend("test-session", "", "127.0.0.1", 8080)
+	if conn == nil {
+		t.Fatal("Expected the first connection to be accepted")
+	}
+	defer func() { _ = conn.Close() }()
+
+	if server, conn := lb.dialBackend("test-session", "", "127.0.0.1", 8080); conn != nil || server != nil {
+		t.Fatal("Expected a backend at its connection limit to be skipped")
+	}
+
+	server.ReleaseConnection()
+
+	if lb.getNextBackend() != full {
+		t.Error("Expected the backend to take connections again once one is released")
+	}
+}
+
+func TestStartFailsWhenAddressInUse(t *testing.T) {
+	taken := acceptingListener(t)
+
+	cfg := config.Configuration{
+		Name:            "test-lb",
+		ListenerAddress: taken.Addr().String(),
+		BackendPortName: "http",
+	}
+
+	lb := NewLoadBalancer(cfg)
+	if err := lb.Start(context.Background()); err == nil {
+		t.Error("Expected an error for a listener address in use")
+	}
+}
+
+func TestStartStopsWhenContextDone(t *testing.T) {
+	cfg := config.Configuration{
+		Name:            "test-lb",
+		ListenerAddress: "127.0.0.1:0",
+		BackendPortName: "http",
+	}
+
+	lb := NewLoadBalancer(cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() { result <- lb.Start(ctx) }()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for lb.GetListener() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Load balancer did not start listening")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cancel()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("Start() error = %v; want nil", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Start() did not return once the context was done")
+	}
+
+	if lb.GetListener() != nil {
+		t.Error("Expected the listener to be closed")
+	}
+}
+
+func TestIsDialTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"Timed out", &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, true},
+		{"Refused", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, false},
+		{"Other error", errors.New("failure"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isDialTimeout(tt.err); got != tt.want {
+				t.Errorf("isDialTimeout() = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
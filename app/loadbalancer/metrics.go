@@ -0,0 +1,40 @@
+package loadbalancer
+
+import (
+	"expvar"
+	"sync"
+)
+
+// Kinds of session timeouts, counted per configuration.
+const (
+	timeoutConnect     = "connect"      // Connecting to a backend took too long
+	timeoutIdle        = "idle"         // No traffic in either direction
+	timeoutMaxDuration = "max_duration" // The session reached its maximum duration
+)
+
+// sessionTimeouts counts session timeouts by configuration name and kind. It
+// is published with the other expvar variables, see the metrics address
+// setting.
+var sessionTimeouts = expvar.NewMap("nautiluslb_session_timeouts_total")
+
+// sessionTimeoutsMu serializes the creation of the per configuration maps.
+var sessionTimeoutsMu sync.Mutex
+
+// recordTimeout counts a session timeout of the given kind for the
+// configuration.
+func recordTimeout(configName, kind string) {
+
+	sessionTimeoutsMu.Lock()
+	counts, ok := sessionTimeouts.Get(configName).(*expvar.Map)
+	if !ok {
+		counts = new(expvar.Map)
+		for _, k := range []string{timeoutConnect, timeoutIdle, timeoutMaxDuration} {
+			counts.Add(k, 0)
+		}
+		sessionTimeouts.Set(configName, counts)
+	}
+	sessionTimeoutsMu.Unlock()
+
+	counts.Add(kind, 1)
+
+}
@@ -0,0 +1,159 @@
+package loadbalancer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cloudresty/emit"
+	"github.com/cloudresty/nautiluslb/config"
+)
+
+// outlierState tracks the passive health of a single backend address.
+type outlierState struct {
+	consecutiveFailures int
+	ejections           int
+	ejectedUntil        time.Time
+}
+
+// outlierDetector ejects backends that keep failing live proxy traffic, in
+// the spirit of Envoy's outlier detection. It complements the active health
+// checks by catching failures that happen between two probes.
+type outlierDetector struct {
+	mu       sync.Mutex
+	settings config.OutlierDetectionConfig
+	hosts    map[string]*outlierState
+	now      func() time.Time
+}
+
+// newOutlierDetector creates an outlier detector with the given settings.
+func newOutlierDetector(settings config.OutlierDetectionConfig) *outlierDetector {
+
+	return &outlierDetector{
+		settings: settings,
+		hosts:    make(map[string]*outlierState),
+		now:      time.Now,
+	}
+
+}
+
+// ReportSuccess records a successful exchange with the backend at address,
+// resetting its consecutive failure count. Backends that were never ejected,
+// or not for a full maximum ejection period, are no longer tracked.
+func (d *outlierDetector) ReportSuccess(address string) {
+
+	if d.settings.Disabled {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	state, ok := d.hosts[address]
+	if !ok {
+		return
+	}
+
+	state.consecutiveFailures = 0
+
+	// Forget past ejections once the backend has behaved for a full maximum ejection period
+	if state.ejections == 0 || d.now().Sub(state.ejectedUntil) > d.settings.GetMaxEjectionTime() {
+		delete(d.hosts, address)
+	}
+
+}
+
+// ReportFailure records a failed exchange with the backend at address and
+// ejects it once the consecutive failure threshold is reached, provided that
+// no more than the allowed share of the poolSize backends is already ejected.
+// It returns true when the backend got ejected.
+func (d *outlierDetector) ReportFailure(address string, poolSize int) bool {
+
+	if d.settings.Disabled {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+
+	state, ok := d.hosts[address]
+	if !ok {
+		state = &outlierState{}
+		d.hosts[address] = state
+	}
+
+	if now.Before(state.ejectedUntil) {
+		return false
+	}
+
+	state.consecutiveFailures++
+
+	if state.consecutiveFailures < d.settings.GetConsecutiveFailures() {
+		return false
+	}
+
+	ejected := 0
+	for _, other := range d.hosts {
+		if now.Before(other.ejectedUntil) {
+			ejected++
+		}
+	}
+
+	if (ejected+1)*100 > d.settings.GetMaxEjectionPercent()*poolSize {
+		emit.Warn.StructuredFields("Not ejecting backend, ejection limit reached",
+			emit.ZString("backend_address", address),
+			emit.ZInt("ejected_backends", ejected),
+			emit.ZInt("pool_size", poolSize))
+		return false
+	}
+
+	// Each ejection lasts longer than the previous one, up to the maximum
+	state.ejections++
+	duration := time.Duration(state.ejections) * d.settings.GetBaseEjectionTime()
+	if duration > d.settings.GetMaxEjectionTime() {
+		duration = d.settings.GetMaxEjectionTime()
+	}
+
+	state.ejectedUntil = now.Add(duration)
+	state.consecutiveFailures = 0
+
+	emit.Warn.StructuredFields("Backend ejected after consecutive failures",
+		emit.ZString("backend_address", address),
+		emit.ZInt("ejections", state.ejections),
+		emit.ZString("ejection_time", duration.String()))
+
+	return true
+
+}
+
+// Prune stops tracking the backends whose address is not in current, so that
+// removed backends neither accumulate nor count against the ejection limit.
+func (d *outlierDetector) Prune(current map[string]bool) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for address := range d.hosts {
+		if !current[address] {
+			delete(d.hosts, address)
+		}
+	}
+
+}
+
+// IsEjected reports whether the backend at address is currently ejected.
+func (d *outlierDetector) IsEjected(address string) bool {
+
+	if d.settings.Disabled {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	state, ok := d.hosts[address]
+
+	return ok && d.now().Before(state.ejectedUntil)
+
+}
@@ -0,0 +1,250 @@
+package loadbalancer
+
+import (
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cloudresty/nautiluslb/backend"
+	"github.com/cloudresty/nautiluslb/config"
+)
+
+// fakeClock is a manually advanced clock for outlier detector tests.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func newTestOutlierDetector(settings config.OutlierDetectionConfig) (*outlierDetector, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	detector := newOutlierDetector(settings)
+	detector.now = clock.Now
+	return detector, clock
+}
+
+func TestOutlierDetectorEjectsAfterConsecutiveFailures(t *testing.T) {
+	detector, _ := newTestOutlierDetector(config.OutlierDetectionConfig{ConsecutiveFailures: 3})
+
+	for i := 0; i < 2; i++ {
+		if detector.ReportFailure("10.0.0.1:80", 4) {
+			t.Fatalf("Backend ejected after only %d failures", i+1)
+		}
+	}
+
+	if detector.IsEjected("10.0.0.1:80") {
+		t.Fatal("Backend should not be ejected before reaching the threshold")
+	}
+
+	if !detector.ReportFailure("10.0.0.1:80", 4) {
+		t.Fatal("Backend should be ejected on the third consecutive failure")
+	}
+
+	if !detector.IsEjected("10.0.0.1:80") {
+		t.Error("Backend should be reported as ejected")
+	}
+}
+
+func TestOutlierDetectorForgetsHealthyBackends(t *testing.T) {
+	detector, _ := newTestOutlierDetector(config.OutlierDetectionConfig{ConsecutiveFailures: 3})
+
+	detector.ReportFailure("10.0.0.1:80", 4)
+	detector.ReportSuccess("10.0.0.1:80")
+
+	if len(detector.hosts) != 0 {
+		t.Errorf("Tracked backends = %d; want 0 after a success", len(detector.hosts))
+	}
+}
+
+func TestOutlierDetectorPrune(t *testing.T) {
+	detector, _ := newTestOutlierDetector(config.OutlierDetectionConfig{ConsecutiveFailures: 1, MaxEjectionPercent: 50})
+
+	if !detector.ReportFailure("10.0.0.1:80", 2) {
+		t.Fatal("Backend should be ejected on its first failure")
+	}
+
+	// The ejected backend goes away, so another one may now be ejected
+	detector.Prune(map[string]bool{"10.0.0.2:80": true, "10.0.0.3:80": true})
+
+	if detector.IsEjected("10.0.0.1:80") {
+		t.Error("A pruned backend should no longer be tracked")
+	}
+
+	if !detector.ReportFailure("10.0.0.2:80", 2) {
+		t.Error("A pruned backend should not count against the ejection limit")
+	}
+}
+
+func TestOutlierDetectorSuccessResetsFailures(t *testing.T) {
+	detector, _ := newTestOutlierDetector(config.OutlierDetectionConfig{ConsecutiveFailures: 2})
+
+	detector.ReportFailure("10.0.0.1:80", 4)
+	detector.ReportSuccess("10.0.0.1:80")
+
+	if detector.ReportFailure("10.0.0.1:80", 4) {
+		t.Error("Failures should not be consecutive across a success")
+	}
+}
+
+func TestOutlierDetectorEjectionBackoff(t *testing.T) {
+	detector, clock := newTestOutlierDetector(config.OutlierDetectionConfig{
+		ConsecutiveFailures: 1,
+		BaseEjectionTime:    10,
+		MaxEjectionTime:     25,
+	})
+
+	expected := []time.Duration{10 * time.Second, 20 * time.Second, 25 * time.Second}
+
+	for i, duration := range expected {
+		if !detector.ReportFailure("10.0.0.1:80", 4) {
+			t.Fatalf("Ejection %d did not happen", i+1)
+		}
+
+		clock.now = clock.now.Add(duration - time.Second)
+		if !detector.IsEjected("10.0.0.1:80") {
+			t.Errorf("Ejection %d should last %v", i+1, duration)
+		}
+
+		clock.now = clock.now.Add(time.Second)
+		if detector.IsEjected("10.0.0.1:80") {
+			t.Errorf("Ejection %d should end after %v", i+1, duration)
+		}
+	}
+}
+
+func TestOutlierDetectorMaxEjectionPercent(t *testing.T) {
+	detector, _ := newTestOutlierDetector(config.OutlierDetectionConfig{
+		ConsecutiveFailures: 1,
+		MaxEjectionPercent:  50,
+	})
+
+	if !detector.ReportFailure("10.0.0.1:80", 4) {
+		t.Fatal("First backend should be ejected")
+	}
+
+	if !detector.ReportFailure("10.0.0.2:80", 4) {
+		t.Fatal("Second backend should be ejected, 50% of the pool")
+	}
+
+	if detector.ReportFailure("10.0.0.3:80", 4) {
+		t.Error("Third backend must not be ejected, it would exceed 50% of the pool")
+	}
+
+	if detector.IsEjected("10.0.0.3:80") {
+		t.Error("Third backend should still be in the pool")
+	}
+}
+
+func TestOutlierDetectorDisabled(t *testing.T) {
+	detector, _ := newTestOutlierDetector(config.OutlierDetectionConfig{
+		Disabled:            true,
+		ConsecutiveFailures: 1,
+	})
+
+	if detector.ReportFailure("10.0.0.1:80", 4) || detector.IsEjected("10.0.0.1:80") {
+		t.Error("Disabled outlier detection should never eject")
+	}
+}
+
+func TestObserveBackendSession(t *testing.T) {
+	tests := []struct {
+		name       string
+		result     copyResult
+		clientDone bool
+		ejected    bool
+	}{
+		{"Response data", copyResult{bytes: 128}, false, false},
+		{"Reset by backend", copyResult{readErr: syscall.ECONNRESET}, false, true},
+		{"Reset after data", copyResult{bytes: 64, readErr: syscall.ECONNRESET}, false, true},
+		{"Immediate close", copyResult{}, false, true},
+		{"Client closed first", copyResult{}, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Configuration{
+				Name:             "test-lb",
+				ListenerAddress:  ":8080",
+				BackendPortName:  "http",
+				OutlierDetection: config.OutlierDetectionConfig{ConsecutiveFailures: 1},
+			}
+
+			lb := NewLoadBalancer(cfg)
+
+			servers := []*backend.BackendServer{
+				{ID: 1, IP: "192.168.1.1", Port: 8080, PortName: "http", Healthy: true},
+				{ID: 2, IP: "192.168.1.2", Port: 8080, PortName: "http", Healthy: true},
+			}
+			lb.SetBackendServers(servers)
+
+			lb.observeBackendSession(servers[0], tt.result, tt.clientDone)
+
+			if got := lb.outliers.IsEjected(servers[0].Address()); got != tt.ejected {
+				t.Errorf("Expected ejected=%v, got %v", tt.ejected, got)
+			}
+		})
+	}
+}
+
+func TestEjectedBackendIsSkipped(t *testing.T) {
+	cfg := config.Configuration{
+		Name:             "test-lb",
+		ListenerAddress:  ":8080",
+		BackendPortName:  "http",
+		OutlierDetection: config.OutlierDetectionConfig{ConsecutiveFailures: 1},
+	}
+
+	lb := NewLoadBalancer(cfg)
+
+	live := acceptingListener(t)
+	dead := &backend.BackendServer{ID: 1, IP: "127.0.0.1", Port: closedPort(t), PortName: "http", Healthy: true}
+	alive := &backend.BackendServer{ID: 2, IP: "127.0.0.1", Port: live.Addr().(*net.TCPAddr).Port, PortName: "http", Healthy: true}
+	lb.SetBackendServers([]*backend.BackendServer{dead, alive})
+
+	_, conn := lb.dialBackend("test-session", "", "127.0.0.1", 8080)
+	if conn == nil {
+		t.Fatal("Expected dialBackend to fail over to the live backend")
+	}
+	_ = conn.Close()
+
+	// The refused dial ejected the dead backend, so it must not be picked again
+	for i := 0; i < 4; i++ {
+		if got := lb.getNextBackend(); got != alive {
+			t.Errorf("Expected only the live backend to be selected, got %d", got.ID)
+		}
+	}
+}
+
+// closeWriteConn records whether the source of the copy was reported done by
+// the time its write side is closed.
+type closeWriteConn struct {
+	net.Conn
+	srcDone      *bool
+	doneAtCloser bool
+}
+
+func (c *closeWriteConn) CloseWrite() error {
+	c.doneAtCloser = *c.srcDone
+	return nil
+}
+
+func TestCopyDataReportsSourceDoneBeforeCloseWrite(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+	defer func() { _ = server.Close() }()
+
+	// The backend may close as soon as it sees the end of the client stream,
+	// which must not pass for a backend failure
+	srcDone := false
+	dst := &closeWriteConn{Conn: server, srcDone: &srcDone}
+
+	copyData(dst, strings.NewReader(""), "client to backend", newSessionActivity(0, 0), func() { srcDone = true })
+
+	if !dst.doneAtCloser {
+		t.Error("Expected the source to be reported done before closing the write side")
+	}
+}
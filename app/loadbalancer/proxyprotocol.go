@@ -0,0 +1,419 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudresty/nautiluslb/backend"
+	"github.com/cloudresty/nautiluslb/config"
+)
+
+// proxyProtocolV2Signature starts every PROXY protocol v2 header.
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolV1Prefix starts every PROXY protocol v1 header, and
+// proxyProtocolV1MaxLength is the longest header including the CRLF.
+const (
+	proxyProtocolV1Prefix    = "PROXY "
+	proxyProtocolV1MaxLength = 107
+)
+
+// PROXY protocol v2 header fields, see the HAProxy PROXY protocol
+// specification.
+const (
+	proxyProtocolV2Local = 0x20 // Version 2, LOCAL command
+	proxyProtocolV2Proxy = 0x21 // Version 2, PROXY command
+
+	proxyProtocolV2Unspec = 0x00 // Unknown address family and transport
+	proxyProtocolV2TCP4   = 0x11 // TCP over IPv4
+	proxyProtocolV2TCP6   = 0x21 // TCP over IPv6
+
+	proxyProtocolV2TypeCRC32C   = 0x03 // CRC32C checksum of the whole header
+	proxyProtocolV2TypeUniqueID = 0x05 // Opaque ID of the connection, up to 128 bytes
+)
+
+// crc32cTable is the Castagnoli table used by the CRC32C TLV.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// proxyTLV is a type-length-value field appended to a PROXY protocol v2
+// header. The value of a CRC32C TLV is ignored and filled in with the
+// checksum of the header.
+type proxyTLV struct {
+	kind  byte
+	value []byte
+}
+
+// writeProxyHeader writes a PROXY protocol header of the given version to w,
+// describing a connection from source to destination. Addresses that are not
+// TCP addresses are sent as unknown. The TLVs are only sent in v2 headers, v1
+// has no room for them.
+func writeProxyHeader(w io.Writer, version string, source, destination net.Addr, tlvs ...proxyTLV) error {
+
+	var header []byte
+
+	switch version {
+	case config.ProxyProtocolV1:
+		header = proxyHeaderV1(source, destination)
+	case config.ProxyProtocolV2:
+		header = proxyHeaderV2(source, destination, tlvs)
+	default:
+		return fmt.Errorf("unsupported PROXY protocol version '%s'", version)
+	}
+
+	_, err := w.Write(header)
+
+	return err
+
+}
+
+// proxyHeaderV1 returns the text header of PROXY protocol v1.
+func proxyHeaderV1(source, destination net.Addr) []byte {
+
+	src, dst, ipv4, ok := proxyAddresses(source, destination)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	family := "TCP6"
+	if ipv4 {
+		family = "TCP4"
+	}
+
+	return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family, src.IP, dst.IP, src.Port, dst.Port)
+
+}
+
+// proxyHeaderV2 returns the binary header of PROXY protocol v2, followed by
+// the TLVs.
+func proxyHeaderV2(source, destination net.Addr, tlvs []proxyTLV) []byte {
+
+	command, family := byte(proxyProtocolV2Proxy), byte(proxyProtocolV2TCP6)
+	var payload []byte
+
+	src, dst, ipv4, ok := proxyAddresses(source, destination)
+	if ok {
+		srcIP, dstIP := src.IP.To16(), dst.IP.To16()
+		if ipv4 {
+			family = proxyProtocolV2TCP4
+			srcIP, dstIP = src.IP.To4(), dst.IP.To4()
+		}
+
+		payload = append(payload, srcIP...)
+		payload = append(payload, dstIP...)
+		payload = binary.BigEndian.AppendUint16(payload, uint16(src.Port))
+		payload = binary.BigEndian.AppendUint16(payload, uint16(dst.Port))
+	} else {
+		// The backend must use its own view of the connection
+		command, family = proxyProtocolV2Local, proxyProtocolV2Unspec
+	}
+
+	checksumAt := -1
+	for _, tlv := range tlvs {
+		value := tlv.value
+		if tlv.kind == proxyProtocolV2TypeCRC32C {
+			value = make([]byte, crc32.Size)
+			checksumAt = len(proxyProtocolV2Signature) + 4 + len(payload) + 3
+		}
+
+		payload = append(payload, tlv.kind)
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(value)))
+		payload = append(payload, value...)
+	}
+
+	var header bytes.Buffer
+	header.Write(proxyProtocolV2Signature)
+	header.Write([]byte{command, family})
+	header.Write(binary.BigEndian.AppendUint16(nil, uint16(len(payload))))
+	header.Write(payload)
+
+	// The checksum covers the header with the checksum itself zeroed
+	result := header.Bytes()
+	if checksumAt >= 0 {
+		binary.BigEndian.PutUint32(result[checksumAt:], crc32.Checksum(result, crc32cTable))
+	}
+
+	return result
+
+}
+
+// proxyAddresses returns source and destination as TCP addresses and whether
+// both are IPv4. Mixed families are both sent as IPv6.
+func proxyAddresses(source, destination net.Addr) (*net.TCPAddr, *net.TCPAddr, bool, bool) {
+
+	src, srcOK := source.(*net.TCPAddr)
+	dst, dstOK := destination.(*net.TCPAddr)
+	if !srcOK || !dstOK || src.IP == nil || dst.IP == nil {
+		return nil, nil, false, false
+	}
+
+	return src, dst, src.IP.To4() != nil && dst.IP.To4() != nil, true
+
+}
+
+// proxyProtocolFor returns the PROXY protocol version of the header sent to
+// server: that set on its service, else that of the configuration. An empty
+// version means no header.
+func (lb *LoadBalancer) proxyProtocolFor(server *backend.BackendServer) string {
+
+	version := cmp.Or(server.ProxyProtocol, lb.config.ProxyProtocol.Version)
+	if version == config.ProxyProtocolNone {
+		return ""
+	}
+
+	return version
+
+}
+
+// proxyTLVs returns the TLVs enabled in the configuration for the PROXY
+// protocol v2 header of a session. The unique ID is the session ID, as logged
+// by the load balancer.
+func (lb *LoadBalancer) proxyTLVs(sessionID string) []proxyTLV {
+
+	var tlvs []proxyTLV
+
+	if lb.config.ProxyProtocol.UniqueID {
+		tlvs = append(tlvs, proxyTLV{kind: proxyProtocolV2TypeUniqueID, value: []byte(sessionID)})
+	}
+
+	if lb.config.ProxyProtocol.Checksum {
+		tlvs = append(tlvs, proxyTLV{kind: proxyProtocolV2TypeCRC32C})
+	}
+
+	return tlvs
+
+}
+
+// proxiedConn is a client connection that started with a PROXY protocol
+// header. Its addresses are those of the header, and reads continue right
+// after it.
+type proxiedConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxiedConn) Read(p []byte) (int, error) {
+
+	return c.reader.Read(p)
+
+}
+
+// RemoteAddr returns the address of the client, as sent in the header.
+func (c *proxiedConn) RemoteAddr() net.Addr {
+
+	return c.remote
+
+}
+
+// LocalAddr returns the address the client connected to, as sent in the
+// header.
+func (c *proxiedConn) LocalAddr() net.Addr {
+
+	return c.local
+
+}
+
+// CloseWrite closes the write side of the underlying connection when it has
+// one, see copyData.
+func (c *proxiedConn) CloseWrite() error {
+
+	if closer, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite()
+	}
+
+	return nil
+
+}
+
+// trustsProxyHeader reports whether conn comes from a trusted peer, whose
+// connections start with a PROXY protocol header.
+func (lb *LoadBalancer) trustsProxyHeader(conn net.Conn) bool {
+
+	if len(lb.trustedProxies) == 0 {
+		return false
+	}
+
+	peer, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	ip, ok := netip.AddrFromSlice(peer.IP)
+	if !ok {
+		return false
+	}
+
+	ip = ip.Unmap()
+	for _, prefix := range lb.trustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+// readProxyHeader reads the PROXY protocol v1 or v2 header that starts conn
+// and returns conn with the addresses of the header. Headers without
+// addresses, such as the LOCAL command of health checks, keep the addresses of
+// conn. The header must arrive within timeout.
+func readProxyHeader(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+
+	start, err := reader.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol header: %v", err)
+	}
+
+	var source, destination net.Addr
+	switch {
+	case bytes.Equal(start, proxyProtocolV2Signature):
+		source, destination, err = parseProxyHeaderV2(reader)
+	case bytes.HasPrefix(start, []byte(proxyProtocolV1Prefix)):
+		source, destination, err = parseProxyHeaderV1(reader)
+	default:
+		return nil, fmt.Errorf("connection does not start with a PROXY protocol header")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	proxied := &proxiedConn{Conn: conn, reader: reader, remote: conn.RemoteAddr(), local: conn.LocalAddr()}
+	if source != nil && destination != nil {
+		proxied.remote, proxied.local = source, destination
+	}
+
+	return proxied, nil
+
+}
+
+// parseProxyHeaderV1 reads a text header of PROXY protocol v1 and returns its
+// addresses, or nil addresses for the UNKNOWN protocol.
+func parseProxyHeaderV1(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtocolV1MaxLength {
+			return nil, nil, fmt.Errorf("PROXY protocol v1 header is longer than %d bytes", proxyProtocolV1MaxLength)
+		}
+
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read PROXY protocol v1 header: %v", err)
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed PROXY protocol v1 header %q", line)
+	}
+
+	source, err := parseProxyAddressV1(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	destination, err := parseProxyAddressV1(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return source, destination, nil
+
+}
+
+// parseProxyAddressV1 parses an address of a PROXY protocol v1 header, which
+// must belong to family.
+func parseProxyAddressV1(family, ip, port string) (*net.TCPAddr, error) {
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Is4() != (family == "TCP4") {
+		return nil, fmt.Errorf("invalid %s address '%s' in PROXY protocol v1 header", family, ip)
+	}
+
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port '%s' in PROXY protocol v1 header", port)
+	}
+
+	return &net.TCPAddr{IP: addr.AsSlice(), Port: int(number)}, nil
+
+}
+
+// parseProxyHeaderV2 reads a binary header of PROXY protocol v2 and returns
+// its addresses, or nil addresses for the LOCAL command and for address
+// families other than TCP. TLVs are skipped.
+func parseProxyHeaderV2(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+
+	fixed := make([]byte, len(proxyProtocolV2Signature)+4)
+	if _, err := io.ReadFull(reader, fixed); err != nil {
+		return nil, nil, fmt.Errorf("failed to read PROXY protocol v2 header: %v", err)
+	}
+
+	command, family := fixed[12], fixed[13]
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, nil, fmt.Errorf("failed to read PROXY protocol v2 header: %v", err)
+	}
+
+	switch command {
+	case proxyProtocolV2Local:
+		return nil, nil, nil
+	case proxyProtocolV2Proxy:
+	default:
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol v2 version and command 0x%02x", command)
+	}
+
+	size := 0
+	switch family {
+	case proxyProtocolV2TCP4:
+		size = net.IPv4len
+	case proxyProtocolV2TCP6:
+		size = net.IPv6len
+	default:
+		// Not a TCP connection, the receiver keeps its own view
+		return nil, nil, nil
+	}
+
+	if len(payload) < 2*size+4 {
+		return nil, nil, fmt.Errorf("PROXY protocol v2 header too short for its addresses")
+	}
+
+	source := &net.TCPAddr{
+		IP:   net.IP(bytes.Clone(payload[:size])),
+		Port: int(binary.BigEndian.Uint16(payload[2*size:])),
+	}
+	destination := &net.TCPAddr{
+		IP:   net.IP(bytes.Clone(payload[size : 2*size])),
+		Port: int(binary.BigEndian.Uint16(payload[2*size+2:])),
+	}
+
+	return source, destination, nil
+
+}
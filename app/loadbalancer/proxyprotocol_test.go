@@ -0,0 +1,447 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cloudresty/nautiluslb/backend"
+	"github.com/cloudresty/nautiluslb/config"
+)
+
+func TestWriteProxyHeaderV1(t *testing.T) {
+	tests := []struct {
+		name        string
+		source      net.Addr
+		destination net.Addr
+		expected    string
+	}{
+		{
+			name:        "IPv4",
+			source:      &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 51234},
+			destination: &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443},
+			expected:    "PROXY TCP4 192.0.2.10 198.51.100.1 51234 443\r\n",
+		},
+		{
+			name:        "IPv6",
+			source:      &net.TCPAddr{IP: net.ParseIP("2001:db8::10"), Port: 51234},
+			destination: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+			expected:    "PROXY TCP6 2001:db8::10 2001:db8::1 51234 443\r\n",
+		},
+		{
+			name:        "Unknown",
+			source:      &net.UnixAddr{Name: "/tmp/socket", Net: "unix"},
+			destination: &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443},
+			expected:    "PROXY UNKNOWN\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var header bytes.Buffer
+			if err := writeProxyHeader(&header, config.ProxyProtocolV1, tt.source, tt.destination); err != nil {
+				t.Fatalf("writeProxyHeader() error = %v", err)
+			}
+
+			if header.String() != tt.expected {
+				t.Errorf("writeProxyHeader() = %q; want %q", header.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestWriteProxyHeaderV2(t *testing.T) {
+	source := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 51234}
+	destination := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+
+	var header bytes.Buffer
+	if err := writeProxyHeader(&header, config.ProxyProtocolV2, source, destination); err != nil {
+		t.Fatalf("writeProxyHeader() error = %v", err)
+	}
+
+	expected := append([]byte("\r\n\r\n\x00\r\nQUIT\n"),
+		0x21, 0x11, 0x00, 0x0c, // PROXY over TCP4, 12 bytes of addresses
+		192, 0, 2, 10,
+		198, 51, 100, 1,
+		0xc8, 0x22, // 51234
+		0x01, 0xbb, // 443
+	)
+
+	if !bytes.Equal(header.Bytes(), expected) {
+		t.Errorf("writeProxyHeader() = %x; want %x", header.Bytes(), expected)
+	}
+}
+
+func TestWriteProxyHeaderV2MixedFamilies(t *testing.T) {
+	source := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 51234}
+	destination := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+
+	var header bytes.Buffer
+	if err := writeProxyHeader(&header, config.ProxyProtocolV2, source, destination); err != nil {
+		t.Fatalf("writeProxyHeader() error = %v", err)
+	}
+
+	got := header.Bytes()
+	if len(got) != 16+36 || got[13] != proxyProtocolV2TCP6 {
+		t.Errorf("Expected an IPv6 header with 36 bytes of addresses, got %x", got)
+	}
+}
+
+func TestWriteProxyHeaderUnsupportedVersion(t *testing.T) {
+	var header bytes.Buffer
+	if err := writeProxyHeader(&header, "v3", &net.TCPAddr{}, &net.TCPAddr{}); err == nil {
+		t.Error("Expected an error for an unsupported version")
+	}
+}
+
+func TestWriteProxyHeaderV2TLVs(t *testing.T) {
+	source := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 51234}
+	destination := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+
+	var header bytes.Buffer
+	err := writeProxyHeader(&header, config.ProxyProtocolV2, source, destination,
+		proxyTLV{kind: proxyProtocolV2TypeUniqueID, value: []byte("abc")},
+		proxyTLV{kind: proxyProtocolV2TypeCRC32C})
+	if err != nil {
+		t.Fatalf("writeProxyHeader() error = %v", err)
+	}
+
+	got := header.Bytes()
+	if length := binary.BigEndian.Uint16(got[14:16]); length != 12+6+7 {
+		t.Fatalf("Header length = %d; want %d", length, 12+6+7)
+	}
+
+	uniqueID := got[28:34]
+	if !bytes.Equal(uniqueID, []byte{proxyProtocolV2TypeUniqueID, 0, 3, 'a', 'b', 'c'}) {
+		t.Errorf("Unique ID TLV = %x", uniqueID)
+	}
+
+	checksum := got[34:]
+	if checksum[0] != proxyProtocolV2TypeCRC32C || binary.BigEndian.Uint16(checksum[1:3]) != 4 {
+		t.Fatalf("CRC32C TLV = %x", checksum)
+	}
+
+	// The checksum is that of the header with the checksum zeroed
+	zeroed := bytes.Clone(got)
+	copy(zeroed[37:], []byte{0, 0, 0, 0})
+	if want := crc32.Checksum(zeroed, crc32cTable); binary.BigEndian.Uint32(checksum[3:]) != want {
+		t.Errorf("Checksum = %x; want %x", checksum[3:], want)
+	}
+}
+
+func TestWriteProxyHeaderV2LocalWithTLVs(t *testing.T) {
+	var header bytes.Buffer
+	err := writeProxyHeader(&header, config.ProxyProtocolV2, &net.UnixAddr{Name: "/tmp/socket", Net: "unix"}, &net.TCPAddr{},
+		proxyTLV{kind: proxyProtocolV2TypeUniqueID, value: []byte("id")})
+	if err != nil {
+		t.Fatalf("writeProxyHeader() error = %v", err)
+	}
+
+	expected := append(bytes.Clone(proxyProtocolV2Signature),
+		0x20, 0x00, 0x00, 0x05, // LOCAL, unknown family, 5 bytes of TLVs
+		proxyProtocolV2TypeUniqueID, 0x00, 0x02, 'i', 'd',
+	)
+
+	if !bytes.Equal(header.Bytes(), expected) {
+		t.Errorf("writeProxyHeader() = %x; want %x", header.Bytes(), expected)
+	}
+}
+
+func TestWriteProxyHeaderV1IgnoresTLVs(t *testing.T) {
+	source := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 51234}
+	destination := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+
+	var header bytes.Buffer
+	if err := writeProxyHeader(&header, config.ProxyProtocolV1, source, destination, proxyTLV{kind: proxyProtocolV2TypeCRC32C}); err != nil {
+		t.Fatalf("writeProxyHeader() error = %v", err)
+	}
+
+	if expected := "PROXY TCP4 192.0.2.10 198.51.100.1 51234 443\r\n"; header.String() != expected {
+		t.Errorf("writeProxyHeader() = %q; want %q", header.String(), expected)
+	}
+}
+
+func TestProxyProtocolFor(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured string
+		annotated  string
+		expected   string
+	}{
+		{"Disabled", "", "", ""},
+		{"From configuration", config.ProxyProtocolV2, "", config.ProxyProtocolV2},
+		{"From service", "", config.ProxyProtocolV1, config.ProxyProtocolV1},
+		{"Service overrides configuration", config.ProxyProtocolV2, config.ProxyProtocolV1, config.ProxyProtocolV1},
+		{"Service opts out", config.ProxyProtocolV2, config.ProxyProtocolNone, ""},
+		{"Configuration set to none", config.ProxyProtocolNone, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := NewLoadBalancer(config.Configuration{ProxyProtocol: config.ProxyProtocolConfig{Version: tt.configured}})
+			server := &backend.BackendServer{ProxyProtocol: tt.annotated}
+
+			if got := lb.proxyProtocolFor(server); got != tt.expected {
+				t.Errorf("proxyProtocolFor() = %q; want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderFromProbes(t *testing.T) {
+	for _, version := range []string{config.ProxyProtocolV1, config.ProxyProtocolV2} {
+		t.Run(version, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Failed to create test listener: %v", err)
+			}
+			defer func() { _ = listener.Close() }()
+
+			accepted := make(chan error, 1)
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					accepted <- err
+					return
+				}
+				defer func() { _ = conn.Close() }()
+
+				proxied, err := readProxyHeader(conn, time.Second)
+				if err == nil && proxied.RemoteAddr().String() != conn.RemoteAddr().String() {
+					err = fmt.Errorf("remote address %s; want %s", proxied.RemoteAddr(), conn.RemoteAddr())
+				}
+				accepted <- err
+			}()
+
+			probe, err := backend.NewProbe(config.HealthCheckConfig{ProxyProtocol: version})
+			if err != nil {
+				t.Fatalf("NewProbe() error = %v", err)
+			}
+			if err := probe.Check(listener.Addr().String(), time.Second); err != nil {
+				t.Fatalf("Check() error = %v", err)
+			}
+
+			if err := <-accepted; err != nil {
+				t.Errorf("readProxyHeader() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestProxyTLVs(t *testing.T) {
+	lb := NewLoadBalancer(config.Configuration{})
+	if tlvs := lb.proxyTLVs("test-session"); len(tlvs) != 0 {
+		t.Errorf("proxyTLVs() = %v; want none", tlvs)
+	}
+
+	lb = NewLoadBalancer(config.Configuration{ProxyProtocol: config.ProxyProtocolConfig{
+		Version:  config.ProxyProtocolV2,
+		UniqueID: true,
+		Checksum: true,
+	}})
+
+	tlvs := lb.proxyTLVs("test-session")
+	if len(tlvs) != 2 || tlvs[0].kind != proxyProtocolV2TypeUniqueID || tlvs[1].kind != proxyProtocolV2TypeCRC32C {
+		t.Fatalf("proxyTLVs() = %v; want a unique ID and a checksum", tlvs)
+	}
+
+	if got := string(tlvs[0].value); got != "test-session" {
+		t.Errorf("Unique ID = %q; want the session ID %q", got, "test-session")
+	}
+}
+
+// proxiedPipe returns the server side of a connection whose client wrote
+// data, as net.Pipe does not buffer.
+func proxiedPipe(t *testing.T, data []byte) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { _ = client.Close(); _ = server.Close() })
+	go func() { _, _ = client.Write(data) }()
+	return server
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	source := &net.TCPAddr{IP: net.ParseIP("192.0.2.10").To4(), Port: 51234}
+	destination := &net.TCPAddr{IP: net.ParseIP("198.51.100.1").To4(), Port: 443}
+	source6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::10"), Port: 51234}
+	destination6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+
+	tests := []struct {
+		name        string
+		header      []byte
+		source      string // Empty to keep the addresses of the connection
+		destination string
+	}{
+		{"v1 TCP4", proxyHeaderV1(source, destination), "192.0.2.10:51234", "198.51.100.1:443"},
+		{"v1 TCP6", proxyHeaderV1(source6, destination6), "[2001:db8::10]:51234", "[2001:db8::1]:443"},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"), "", ""},
+		{"v2 TCP4", proxyHeaderV2(source, destination, nil), "192.0.2.10:51234", "198.51.100.1:443"},
+		{"v2 TCP6", proxyHeaderV2(source6, destination6, nil), "[2001:db8::10]:51234", "[2001:db8::1]:443"},
+		{"v2 with TLVs", proxyHeaderV2(source, destination, []proxyTLV{
+			{kind: proxyProtocolV2TypeUniqueID, value: []byte("id")},
+			{kind: proxyProtocolV2TypeCRC32C},
+		}), "192.0.2.10:51234", "198.51.100.1:443"},
+		{"v2 LOCAL", proxyHeaderV2(&net.UnixAddr{}, destination, nil), "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := proxiedPipe(t, append(bytes.Clone(tt.header), "hello"...))
+
+			conn, err := readProxyHeader(server, time.Second)
+			if err != nil {
+				t.Fatalf("readProxyHeader() error = %v", err)
+			}
+
+			wantSource, wantDestination := tt.source, tt.destination
+			if wantSource == "" {
+				wantSource, wantDestination = server.RemoteAddr().String(), server.LocalAddr().String()
+			}
+			if got := conn.RemoteAddr().String(); got != wantSource {
+				t.Errorf("RemoteAddr() = %s; want %s", got, wantSource)
+			}
+			if got := conn.LocalAddr().String(); got != wantDestination {
+				t.Errorf("LocalAddr() = %s; want %s", got, wantDestination)
+			}
+
+			// The data after the header is left to read
+			data := make([]byte, 5)
+			if _, err := io.ReadFull(conn, data); err != nil || string(data) != "hello" {
+				t.Errorf("Read() = %q, %v; want %q", data, err, "hello")
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+	}{
+		{"No header", []byte("GET / HTTP/1.1\r\n\r\n")},
+		{"v1 unknown family", []byte("PROXY UDP4 192.0.2.10 198.51.100.1 1 2\r\n")},
+		{"v1 family mismatch", []byte("PROXY TCP4 2001:db8::10 198.51.100.1 1 2\r\n")},
+		{"v1 invalid port", []byte("PROXY TCP4 192.0.2.10 198.51.100.1 1 65536\r\n")},
+		{"v1 missing fields", []byte("PROXY TCP4 192.0.2.10\r\n")},
+		{"v1 too long", append([]byte("PROXY TCP4 "), bytes.Repeat([]byte("1"), 200)...)},
+		{"v2 unknown command", append(bytes.Clone(proxyProtocolV2Signature), 0x22, 0x11, 0x00, 0x00)},
+		{"v2 short addresses", append(bytes.Clone(proxyProtocolV2Signature), 0x21, 0x11, 0x00, 0x04, 1, 2, 3, 4)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := proxiedPipe(t, tt.header)
+
+			if _, err := readProxyHeader(server, 200*time.Millisecond); err == nil {
+				t.Error("readProxyHeader() error = nil; want an error")
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderTimesOut(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+	defer func() { _ = server.Close() }()
+
+	if _, err := readProxyHeader(server, 50*time.Millisecond); err == nil {
+		t.Error("readProxyHeader() error = nil; want a timeout")
+	}
+}
+
+func TestTrustsProxyHeader(t *testing.T) {
+	lb := NewLoadBalancer(config.Configuration{AcceptProxyProtocol: config.AcceptProxyProtocolConfig{
+		TrustedCIDRs: []string{"10.0.0.0/8", "2001:db8::/32"},
+	}})
+
+	tests := []struct {
+		name    string
+		peer    net.Addr
+		trusted bool
+	}{
+		{"Trusted IPv4", &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1}, true},
+		{"Trusted IPv6", &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}, true},
+		{"Untrusted", &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 1}, false},
+		{"Not TCP", &net.UnixAddr{Name: "/tmp/socket", Net: "unix"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &proxiedConn{remote: tt.peer}
+			if got := lb.trustsProxyHeader(conn); got != tt.trusted {
+				t.Errorf("trustsProxyHeader() = %v; want %v", got, tt.trusted)
+			}
+		})
+	}
+
+	if NewLoadBalancer(config.Configuration{}).trustsProxyHeader(&proxiedConn{remote: tests[0].peer}) {
+		t.Error("Expected no peer to be trusted without trusted CIDRs")
+	}
+}
+
+func TestHandleConnectionAcceptsProxyHeader(t *testing.T) {
+	// The backend records what it receives
+	backendListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create test listener: %v", err)
+	}
+	defer func() { _ = backendListener.Close() }()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := backendListener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		data, _ := io.ReadAll(conn)
+		received <- string(data)
+	}()
+
+	lb := NewLoadBalancer(config.Configuration{
+		Name:                "test-accept-proxy",
+		BackendPortName:     "http",
+		ProxyProtocol:       config.ProxyProtocolConfig{Version: config.ProxyProtocolV1},
+		AcceptProxyProtocol: config.AcceptProxyProtocolConfig{TrustedCIDRs: []string{"127.0.0.0/8"}},
+	})
+	lb.SetBackendServers([]*backend.BackendServer{
+		{ID: 1, IP: "127.0.0.1", Port: backendListener.Addr().(*net.TCPAddr).Port, PortName: "http", Healthy: true},
+	})
+
+	front, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create test listener: %v", err)
+	}
+	defer func() { _ = front.Close() }()
+
+	go func() {
+		conn, err := front.Accept()
+		if err == nil {
+			lb.HandleConnection(conn)
+		}
+	}()
+
+	client, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	_, _ = client.Write([]byte("PROXY TCP4 192.0.2.10 198.51.100.1 51234 443\r\nhello"))
+	_ = client.(*net.TCPConn).CloseWrite()
+	defer func() { _ = client.Close() }()
+
+	// The backend sees the client of the header, then the data
+	select {
+	case data := <-received:
+		if expected := "PROXY TCP4 192.0.2.10 198.51.100.1 51234 443\r\nhello"; data != expected {
+			t.Errorf("Backend received %q; want %q", data, expected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Backend received nothing")
+	}
+}
@@ -0,0 +1,164 @@
+package loadbalancer
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// sessionActivity tracks when a proxied session last carried data in either
+// direction, so that an idle timeout only fires once both are quiet, and when
+// the session reaches its maximum duration.
+type sessionActivity struct {
+	idle    time.Duration // Zero disables the idle timeout
+	expires time.Time     // End of the maximum duration, zero when unlimited
+	last    atomic.Int64  // Unix nanoseconds
+}
+
+// newSessionActivity returns the activity of a session that starts now. A
+// zero maxDuration leaves the session unlimited.
+func newSessionActivity(idle, maxDuration time.Duration) *sessionActivity {
+
+	activity := &sessionActivity{idle: idle}
+	if maxDuration > 0 {
+		activity.expires = time.Now().Add(maxDuration)
+	}
+	activity.touch()
+
+	return activity
+
+}
+
+// touch records activity on the session.
+func (a *sessionActivity) touch() {
+
+	a.last.Store(time.Now().UnixNano())
+
+}
+
+// deadline returns the time at which a read times out: when the session
+// becomes idle or reaches its maximum duration, whichever comes first. The
+// zero time means no deadline.
+func (a *sessionActivity) deadline() time.Time {
+
+	var deadline time.Time
+	if a.idle > 0 {
+		deadline = time.Unix(0, a.last.Load()).Add(a.idle)
+	}
+
+	return earliest(deadline, a.expires)
+
+}
+
+// writeDeadline returns the time at which a write starting now times out: a
+// peer that does not read for the idle timeout is as stuck as one that does
+// not send.
+func (a *sessionActivity) writeDeadline() time.Time {
+
+	var deadline time.Time
+	if a.idle > 0 {
+		deadline = time.Now().Add(a.idle)
+	}
+
+	return earliest(deadline, a.expires)
+
+}
+
+// expired reports whether the session reached its maximum duration.
+func (a *sessionActivity) expired() bool {
+
+	return !a.expires.IsZero() && !time.Now().Before(a.expires)
+
+}
+
+// timeoutKind returns the timeout that ended a session whose read or write
+// timed out.
+func (a *sessionActivity) timeoutKind() string {
+
+	if a.expired() {
+		return timeoutMaxDuration
+	}
+
+	return timeoutIdle
+
+}
+
+// earliest returns the earlier of two deadlines, the zero time meaning none.
+func earliest(a, b time.Time) time.Time {
+
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+
+	return a
+
+}
+
+// timeoutConn is one side of a proxied session. Every read and write refreshes
+// its deadline from the activity of the whole session, and fails with a
+// timeout error once the session is idle or reaches its maximum duration.
+type timeoutConn struct {
+	net.Conn
+	activity *sessionActivity
+}
+
+func (c *timeoutConn) Read(p []byte) (int, error) {
+
+	for {
+
+		deadline := c.activity.deadline()
+		if err := c.Conn.SetReadDeadline(deadline); err != nil {
+			return 0, err
+		}
+
+		n, err := c.Conn.Read(p)
+		if n > 0 {
+			c.activity.touch()
+		}
+
+		// The other direction kept the session alive, keep waiting
+		if n == 0 && isTimeout(err) && !c.activity.expired() && time.Now().Before(c.activity.deadline()) {
+			continue
+		}
+
+		return n, err
+
+	}
+
+}
+
+func (c *timeoutConn) Write(p []byte) (int, error) {
+
+	if err := c.Conn.SetWriteDeadline(c.activity.writeDeadline()); err != nil {
+		return 0, err
+	}
+
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.activity.touch()
+	}
+
+	return n, err
+
+}
+
+// CloseWrite closes the write side of the underlying connection when it has
+// one, see copyData.
+func (c *timeoutConn) CloseWrite() error {
+
+	if closer, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite()
+	}
+
+	return nil
+
+}
+
+// isTimeout reports whether err is a deadline expiry.
+func isTimeout(err error) bool {
+
+	return errors.Is(err, os.ErrDeadlineExceeded)
+
+}
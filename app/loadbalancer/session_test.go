@@ -0,0 +1,206 @@
+package loadbalancer
+
+import (
+	"expvar"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// timeoutCount returns the number of session timeouts of the given kind
+// recorded for the configuration.
+func timeoutCount(configName, kind string) int64 {
+	counts, ok := sessionTimeouts.Get(configName).(*expvar.Map)
+	if !ok {
+		return 0
+	}
+	count, ok := counts.Get(kind).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return count.Value()
+}
+
+func TestTimeoutConnIdle(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+	defer func() { _ = server.Close() }()
+
+	activity := newSessionActivity(50*time.Millisecond, 0)
+	conn := &timeoutConn{Conn: server, activity: activity}
+
+	start := time.Now()
+	_, err := conn.Read(make([]byte, 1))
+	if !isTimeout(err) {
+		t.Fatalf("Expected a timeout error, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected the read to wait for the idle timeout, returned after %v", elapsed)
+	}
+
+	if kind := activity.timeoutKind(); kind != timeoutIdle {
+		t.Errorf("timeoutKind() = %q; want %q", kind, timeoutIdle)
+	}
+}
+
+func TestTimeoutConnKeptAliveByOtherDirection(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+	defer func() { _ = server.Close() }()
+
+	activity := newSessionActivity(100*time.Millisecond, 0)
+	conn := &timeoutConn{Conn: server, activity: activity}
+
+	// Traffic in the other direction keeps the session alive
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				activity.touch()
+			}
+		}
+	}()
+
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		_, _ = client.Write([]byte("x"))
+	}()
+
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Expected the read to outlast the idle timeout, got %v", err)
+	}
+}
+
+func TestTimeoutConnMaxDuration(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+	defer func() { _ = server.Close() }()
+
+	activity := newSessionActivity(time.Hour, 150*time.Millisecond)
+	conn := &timeoutConn{Conn: server, activity: activity}
+
+	// A busy session still ends at its maximum duration
+	go func() {
+		for {
+			if _, err := client.Write([]byte("x")); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	start := time.Now()
+	_, err := io.Copy(io.Discard, conn)
+	if !isTimeout(err) {
+		t.Fatalf("Expected a timeout error, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Expected the session to end after its maximum duration, ended after %v", elapsed)
+	}
+
+	if kind := activity.timeoutKind(); kind != timeoutMaxDuration {
+		t.Errorf("timeoutKind() = %q; want %q", kind, timeoutMaxDuration)
+	}
+}
+
+func TestTimeoutConnWriteToStuckPeer(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+	defer func() { _ = server.Close() }()
+
+	// Nothing reads from client, so the write blocks
+	conn := &timeoutConn{Conn: server, activity: newSessionActivity(50*time.Millisecond, 0)}
+
+	if _, err := conn.Write([]byte("x")); !isTimeout(err) {
+		t.Fatalf("Expected a timeout error, got %v", err)
+	}
+}
+
+func TestEarliest(t *testing.T) {
+	now := time.Now()
+	later := now.Add(time.Second)
+
+	tests := []struct {
+		name string
+		a, b time.Time
+		want time.Time
+	}{
+		{"both unset", time.Time{}, time.Time{}, time.Time{}},
+		{"first unset", time.Time{}, later, later},
+		{"second unset", now, time.Time{}, now},
+		{"first earlier", now, later, now},
+		{"second earlier", later, now, now},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := earliest(tt.a, tt.b); !got.Equal(tt.want) {
+				t.Errorf("earliest() = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIdleSessionIsClosedAndCounted(t *testing.T) {
+	lb := newDrainTestLoadBalancer(t, echoListener(t), 0)
+	lb.config.Name = "test-idle-timeout"
+	lb.backendServers[0].IdleTimeout = 200 * time.Millisecond
+	before := timeoutCount("test-idle-timeout", timeoutIdle)
+
+	client, done := startSession(t, lb)
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Idle session was not closed")
+	}
+
+	// The client sees the echo and then the end of the session
+	if _, err := io.ReadAll(client); err != nil {
+		t.Errorf("Expected the client connection to be closed cleanly, got %v", err)
+	}
+
+	if got := timeoutCount("test-idle-timeout", timeoutIdle) - before; got != 1 {
+		t.Errorf("Idle timeouts = %d; want 1", got)
+	}
+}
+
+func TestSessionMaxDurationIsEnforced(t *testing.T) {
+	lb := newDrainTestLoadBalancer(t, echoListener(t), 0)
+	lb.config.Name = "test-max-duration"
+	lb.config.MaxConnectionDuration = 1
+	before := timeoutCount("test-max-duration", timeoutMaxDuration)
+
+	client, done := startSession(t, lb)
+
+	// Keep the session busy
+	go func() {
+		for {
+			if _, err := client.Write([]byte("ping")); err != nil {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+	go func() { _, _ = io.Copy(io.Discard, client) }()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Session outlived its maximum duration")
+	}
+
+	if got := timeoutCount("test-max-duration", timeoutMaxDuration) - before; got != 1 {
+		t.Errorf("Max duration timeouts = %d; want 1", got)
+	}
+}
@@ -0,0 +1,191 @@
+package loadbalancer
+
+import (
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cloudresty/nautiluslb/backend"
+	"github.com/cloudresty/nautiluslb/config"
+)
+
+// Strategy selects a backend server from a list of healthy candidates.
+// Implementations must be safe for concurrent use.
+type Strategy interface {
+	Next(backends []*backend.BackendServer) *backend.BackendServer
+}
+
+// NewStrategy returns the strategy registered under name.
+// Unknown or empty names fall back to round-robin.
+func NewStrategy(name string) Strategy {
+
+	switch name {
+	case config.StrategyRandom:
+		return &randomStrategy{}
+	case config.StrategyLeastConnections:
+		return &leastConnectionsStrategy{}
+	case config.StrategyPowerOfTwoChoices:
+		return &powerOfTwoChoicesStrategy{}
+	case config.StrategyWeightedRoundRobin:
+		return &weightedRoundRobinStrategy{}
+	case config.StrategyConsistentHash:
+		return &consistentHashStrategy{}
+	default:
+		return &roundRobinStrategy{}
+	}
+
+}
+
+// roundRobinStrategy cycles through the candidates in order.
+type roundRobinStrategy struct {
+	counter atomic.Uint64
+}
+
+func (s *roundRobinStrategy) Next(backends []*backend.BackendServer) *backend.BackendServer {
+
+	if len(backends) == 0 {
+		return nil
+	}
+
+	n := s.counter.Add(1) - 1
+
+	return backends[n%uint64(len(backends))]
+
+}
+
+// randomStrategy picks a candidate uniformly at random.
+type randomStrategy struct{}
+
+func (s *randomStrategy) Next(backends []*backend.BackendServer) *backend.BackendServer {
+
+	if len(backends) == 0 {
+		return nil
+	}
+
+	return backends[rand.IntN(len(backends))]
+
+}
+
+// leastConnectionsStrategy picks the candidate with the fewest active connections.
+// Ties are broken by rotating the starting point so idle pools still spread load.
+type leastConnectionsStrategy struct {
+	counter atomic.Uint64
+}
+
+func (s *leastConnectionsStrategy) Next(backends []*backend.BackendServer) *backend.BackendServer {
+
+	if len(backends) == 0 {
+		return nil
+	}
+
+	start := int(s.counter.Add(1) % uint64(len(backends)))
+
+	var selected *backend.BackendServer
+	var selectedConnections int64
+
+	for i := range backends {
+		server := backends[(start+i)%len(backends)]
+		connections := server.Connections()
+		if selected == nil || connections < selectedConnections {
+			selected = server
+			selectedConnections = connections
+		}
+	}
+
+	return selected
+
+}
+
+// powerOfTwoChoicesStrategy samples two distinct candidates at random and picks
+// the one with fewer active connections. It avoids the herding that strict
+// least-connections shows when many connections arrive at once.
+type powerOfTwoChoicesStrategy struct{}
+
+func (s *powerOfTwoChoicesStrategy) Next(backends []*backend.BackendServer) *backend.BackendServer {
+
+	switch len(backends) {
+	case 0:
+		return nil
+	case 1:
+		return backends[0]
+	}
+
+	i := rand.IntN(len(backends))
+	j := rand.IntN(len(backends) - 1)
+	if j >= i {
+		j++
+	}
+
+	if backends[j].Connections() < backends[i].Connections() {
+		return backends[j]
+	}
+
+	return backends[i]
+
+}
+
+// weightedRoundRobinStrategy implements nginx's smooth weighted round-robin.
+// Each candidate's running weight grows by its configured weight on every pick,
+// the candidate with the highest running weight wins and is reduced by the total.
+// This honours the weights while interleaving picks instead of sending bursts
+// of consecutive connections to the heaviest backend.
+type weightedRoundRobinStrategy struct {
+	mu      sync.Mutex
+	current map[string]int // Running weights keyed by backend address
+}
+
+func (s *weightedRoundRobinStrategy) Next(backends []*backend.BackendServer) *backend.BackendServer {
+
+	if len(backends) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current == nil {
+		s.current = make(map[string]int)
+	}
+
+	total := 0
+	var selected *backend.BackendServer
+	seen := make(map[string]struct{}, len(backends))
+
+	for _, server := range backends {
+
+		key := server.Address()
+		seen[key] = struct{}{}
+
+		weight := effectiveWeight(server)
+		s.current[key] += weight
+		total += weight
+
+		if selected == nil || s.current[key] > s.current[selected.Address()] {
+			selected = server
+		}
+
+	}
+
+	s.current[selected.Address()] -= total
+
+	// Forget backends that are no longer candidates so the map stays bounded
+	for key := range s.current {
+		if _, ok := seen[key]; !ok {
+			delete(s.current, key)
+		}
+	}
+
+	return selected
+
+}
+
+// effectiveWeight returns the weight of a backend, treating unset or negative weights as 1.
+func effectiveWeight(server *backend.BackendServer) int {
+
+	if server.Weight <= 0 {
+		return 1
+	}
+
+	return server.Weight
+
+}
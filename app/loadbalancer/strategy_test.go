@@ -0,0 +1,209 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/cloudresty/nautiluslb/backend"
+	"github.com/cloudresty/nautiluslb/config"
+)
+
+func testBackends(weights ...int) []*backend.BackendServer {
+	var servers []*backend.BackendServer
+	for i, weight := range weights {
+		servers = append(servers, &backend.BackendServer{
+			ID:       i + 1,
+			IP:       fmt.Sprintf("10.0.0.%d", i+1),
+			Port:     8080,
+			PortName: "http",
+			Weight:   weight,
+			Healthy:  true,
+		})
+	}
+	return servers
+}
+
+func TestNewStrategy(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		expected Strategy
+	}{
+		{"Empty defaults to round-robin", "", &roundRobinStrategy{}},
+		{"Round-robin", config.StrategyRoundRobin, &roundRobinStrategy{}},
+		{"Random", config.StrategyRandom, &randomStrategy{}},
+		{"Least connections", config.StrategyLeastConnections, &leastConnectionsStrategy{}},
+		{"Power of two choices", config.StrategyPowerOfTwoChoices, &powerOfTwoChoicesStrategy{}},
+		{"Weighted round-robin", config.StrategyWeightedRoundRobin, &weightedRoundRobinStrategy{}},
+		{"Unknown defaults to round-robin", "bogus", &roundRobinStrategy{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NewStrategy(tt.strategy)
+			if gotType, wantType := fmt.Sprintf("%T", got), fmt.Sprintf("%T", tt.expected); gotType != wantType {
+				t.Errorf("NewStrategy(%q) = %s; want %s", tt.strategy, gotType, wantType)
+			}
+		})
+	}
+}
+
+func TestStrategiesEmptyBackends(t *testing.T) {
+	for _, name := range []string{
+		config.StrategyRoundRobin,
+		config.StrategyRandom,
+		config.StrategyLeastConnections,
+		config.StrategyPowerOfTwoChoices,
+		config.StrategyWeightedRoundRobin,
+	} {
+		if got := NewStrategy(name).Next(nil); got != nil {
+			t.Errorf("%s: expected nil for empty backends, got %v", name, got)
+		}
+	}
+}
+
+func TestRoundRobinStrategy(t *testing.T) {
+	servers := testBackends(1, 1, 1)
+	strategy := NewStrategy(config.StrategyRoundRobin)
+
+	for i := 0; i < 6; i++ {
+		got := strategy.Next(servers)
+		if got != servers[i%3] {
+			t.Errorf("Call %d: expected server %d, got %d", i, servers[i%3].ID, got.ID)
+		}
+	}
+}
+
+func TestRandomStrategy(t *testing.T) {
+	servers := testBackends(1, 1, 1)
+	strategy := NewStrategy(config.StrategyRandom)
+
+	for i := 0; i < 100; i++ {
+		got := strategy.Next(servers)
+		if got == nil {
+			t.Fatal("Random strategy should not return nil")
+		}
+	}
+}
+
+func TestLeastConnectionsStrategy(t *testing.T) {
+	servers := testBackends(1, 1, 1)
+	servers[0].ActiveConnections = 5
+	servers[1].ActiveConnections = 1
+	servers[2].ActiveConnections = 3
+
+	strategy := NewStrategy(config.StrategyLeastConnections)
+
+	for i := 0; i < 5; i++ {
+		if got := strategy.Next(servers); got != servers[1] {
+			t.Errorf("Expected server 2 with fewest connections, got %d", got.ID)
+		}
+	}
+}
+
+func TestLeastConnectionsStrategyTieBreak(t *testing.T) {
+	servers := testBackends(1, 1, 1)
+	strategy := NewStrategy(config.StrategyLeastConnections)
+
+	seen := make(map[int]bool)
+	for i := 0; i < 3; i++ {
+		seen[strategy.Next(servers).ID] = true
+	}
+
+	if len(seen) != 3 {
+		t.Errorf("Expected ties to rotate across all servers, got %v", seen)
+	}
+}
+
+func TestPowerOfTwoChoicesStrategy(t *testing.T) {
+	servers := testBackends(1, 1)
+	servers[0].ActiveConnections = 10
+
+	strategy := NewStrategy(config.StrategyPowerOfTwoChoices)
+
+	// With two candidates both are always sampled, so the idle one must win
+	for i := 0; i < 20; i++ {
+		if got := strategy.Next(servers); got != servers[1] {
+			t.Errorf("Expected idle server 2, got %d", got.ID)
+		}
+	}
+
+	single := testBackends(1)
+	if got := strategy.Next(single); got != single[0] {
+		t.Error("Expected the only candidate to be returned")
+	}
+}
+
+func TestLeastConnectionsStrategyConcurrent(t *testing.T) {
+	servers := testBackends(1, 1, 1, 1)
+	strategy := NewStrategy(config.StrategyLeastConnections)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server := strategy.Next(servers)
+			server.AcquireConnection()
+		}()
+	}
+	wg.Wait()
+
+	var total int64
+	for _, server := range servers {
+		total += server.Connections()
+	}
+
+	if total != 100 {
+		t.Errorf("Expected 100 active connections in total, got %d", total)
+	}
+
+	// Picks racing each other may land on the same backend, but the load
+	// still ends up spread across all of them
+	for _, server := range servers {
+		if connections := server.Connections(); connections < 15 || connections > 35 {
+			t.Errorf("Expected about 25 active connections on backend %d, got %d", server.ID, connections)
+		}
+	}
+}
+
+func TestWeightedRoundRobinStrategy(t *testing.T) {
+	servers := testBackends(3, 1, 0)
+	strategy := NewStrategy(config.StrategyWeightedRoundRobin)
+
+	counts := make(map[int]int)
+	for i := 0; i < 50; i++ {
+		counts[strategy.Next(servers).ID]++
+	}
+
+	// Weights 3, 1 and 1 (unset) over 50 picks
+	if counts[1] != 30 || counts[2] != 10 || counts[3] != 10 {
+		t.Errorf("Unexpected weighted distribution: %v", counts)
+	}
+}
+
+func TestWeightedRoundRobinStrategyIsSmooth(t *testing.T) {
+	servers := testBackends(5, 1, 1)
+	strategy := NewStrategy(config.StrategyWeightedRoundRobin)
+
+	// nginx's reference sequence for weights {a:5, b:1, c:1}
+	expected := []int{1, 1, 2, 1, 3, 1, 1}
+	for i, id := range expected {
+		if got := strategy.Next(servers); got.ID != id {
+			t.Errorf("Pick %d: expected server %d, got %d", i, id, got.ID)
+		}
+	}
+}
+
+func TestWeightedRoundRobinStrategyForgetsRemovedBackends(t *testing.T) {
+	servers := testBackends(2, 1)
+	strategy := NewStrategy(config.StrategyWeightedRoundRobin).(*weightedRoundRobinStrategy)
+
+	strategy.Next(servers)
+	strategy.Next(servers[:1])
+
+	if len(strategy.current) != 1 {
+		t.Errorf("Expected state for 1 backend, got %d", len(strategy.current))
+	}
+}
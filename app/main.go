@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"sync"
@@ -38,10 +43,32 @@ func main() {
 		fmt.Println("  It automatically discovers Kubernetes services with the annotation:")
 		fmt.Println("  nautiluslb.cloudresty.io/enabled=true")
 		fmt.Println()
+		fmt.Println("Exit codes:")
+		fmt.Println("  0  Shut down on SIGINT or SIGTERM")
+		fmt.Println("  1  Invalid configuration, Kubernetes unreachable or service discovery failed")
+		fmt.Println("  2  A listener or metrics address could not be bound")
+		fmt.Println()
 		fmt.Println("For more information, visit: https://github.com/cloudresty/nautiluslb")
-		os.Exit(0)
+		os.Exit(exitOK)
 	}
 
+	os.Exit(run())
+
+}
+
+// Exit codes of the process.
+const (
+	exitOK            = 0 // Shut down on a signal
+	exitFailure       = 1 // Invalid configuration, Kubernetes unreachable or discovery failed
+	exitListenFailure = 2 // A listener or metrics address could not be bound
+)
+
+// run starts the load balancers and service discovery under a root context
+// that SIGINT and SIGTERM cancel, and returns the exit code of the process.
+// On shutdown, discovery stops first, then every listener stops accepting
+// connections and drains its sessions up to its drain timeout.
+func run() int {
+
 	emit.Info.Msg("Starting NautilusLB...")
 	emit.Info.StructuredFields("Application Information",
 		emit.ZString("app_name", "NautilusLB"),
@@ -57,7 +84,7 @@ func main() {
 		emit.Error.StructuredFields("Failed to load configuration",
 			emit.ZString("config_file", "config.yaml"),
 			emit.ZString("error", err.Error()))
-		os.Exit(1)
+		return exitFailure
 	}
 
 	//
@@ -69,12 +96,31 @@ func main() {
 		emit.Error.StructuredFields("Failed to initialize Kubernetes client",
 			emit.ZString("kubeconfig_path", configData.Settings.KubeconfigPath),
 			emit.ZString("error", err.Error()))
-		os.Exit(1)
+		return exitFailure
 	}
 	emit.Info.StructuredFields("Initialized Kubernetes client",
 		emit.ZString("context", currentContext))
-	var wg sync.WaitGroup
+
+	// The root context, cancelled on the first SIGINT or SIGTERM
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
+	ctx, cancel := context.WithCancel(signalCtx)
+	defer cancel()
+
 	var loadBalancers []*loadbalancer.LoadBalancer
+	var listeners sync.WaitGroup
+	listenErrors := make(chan error, len(configData.BackendConfigurations)+1)
+
+	if address := configData.Settings.MetricsAddress; address != "" {
+		listeners.Add(1)
+		go func() {
+			defer listeners.Done()
+			if err := serveMetrics(ctx, address); err != nil {
+				listenErrors <- err
+			}
+		}()
+	}
 
 	//
 	// Create a new load balancer for each backend configuration (without individual discovery)
@@ -82,18 +128,16 @@ func main() {
 
 	for _, backendConfig := range configData.BackendConfigurations {
 
-		wg.Add(1)
-
-		// Parse the duration string into a time.Duration
-		duration := time.Duration(backendConfig.RequestTimeout) * time.Second
-
-		lb := loadbalancer.NewLoadBalancer(backendConfig, duration)
+		lb := loadbalancer.NewLoadBalancer(backendConfig)
 		loadBalancers = append(loadBalancers, lb)
 
 		// Start the load balancer
+		listeners.Add(1)
 		go func(lb *loadbalancer.LoadBalancer) {
-			defer wg.Done()
-			lb.Start()
+			defer listeners.Done()
+			if err := lb.Start(ctx); err != nil {
+				listenErrors <- err
+			}
 		}(lb)
 
 		emit.Info.StructuredFields("Started load balancer",
@@ -108,26 +152,103 @@ func main() {
 	for _, lb := range loadBalancers {
 		lbInterfaces = append(lbInterfaces, lb)
 	}
-	go kubernetes.DiscoverK8sServicesForAll(lbInterfaces, configData.BackendConfigurations)
 
-	wg.Wait()
-	emit.Info.Msg("All load balancers stopped, exiting")
+	discoveryDone := make(chan error, 1)
+	go func() {
+		discoveryDone <- kubernetes.DiscoverK8sServicesForAll(ctx, lbInterfaces, configData.BackendConfigurations)
+	}()
 
-	// Graceful shutdown on signals
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-	<-sigChan
+	exitCode := exitOK
+	discoveryStopped := false
 
-	emit.Info.Msg("Shutting down gracefully...")
+	select {
+	case <-signalCtx.Done():
+		emit.Info.Msg("Shutdown signal received, shutting down gracefully...")
+	case err := <-listenErrors:
+		emit.Error.StructuredFields("Load balancer failed to start, shutting down",
+			emit.ZString("error", err.Error()))
+		exitCode = exitListenFailure
+	case err := <-discoveryDone:
+		emit.Error.StructuredFields("Service discovery failed, shutting down",
+			emit.ZString("error", fmt.Sprint(err)))
+		exitCode = exitFailure
+		discoveryStopped = true
+	}
 
-	for _, backendConfig := range configData.BackendConfigurations {
-		emit.Info.StructuredFields("Stopping load balancer",
-			emit.ZString("config_name", backendConfig.Name))
-		lb := loadbalancer.NewLoadBalancer(backendConfig, time.Duration(backendConfig.RequestTimeout)*time.Second)
-		lb.Stop()
+	// A second signal terminates the process right away
+	stopSignals()
+
+	// Stop discovery first, so that no backends change while draining
+	cancel()
+	if !discoveryStopped {
+		<-discoveryDone
+	}
+
+	// Drain all listeners at once, each up to its own drain timeout
+	var shutdown sync.WaitGroup
+	for i, lb := range loadBalancers {
+
+		backendConfig := configData.BackendConfigurations[i]
+		shutdown.Add(1)
+
+		go func(lb *loadbalancer.LoadBalancer) {
+			defer shutdown.Done()
+
+			emit.Info.StructuredFields("Stopping load balancer",
+				emit.ZString("config_name", backendConfig.Name),
+				emit.ZString("drain_timeout", backendConfig.GetDrainTimeout().String()))
+
+			drainCtx, cancelDrain := context.WithTimeout(context.Background(), backendConfig.GetDrainTimeout())
+			defer cancelDrain()
+
+			if err := lb.Shutdown(drainCtx); err != nil {
+				emit.Warn.StructuredFields("Load balancer did not drain in time",
+					emit.ZString("config_name", backendConfig.Name),
+					emit.ZString("error", err.Error()))
+			}
+		}(lb)
+
+	}
+	shutdown.Wait()
+	listeners.Wait()
+
+	emit.Info.StructuredFields("Shutdown complete.",
+		emit.ZInt("exit_code", exitCode))
+
+	return exitCode
+
+}
+
+// serveMetrics serves the metrics of the process in the expvar JSON format on
+// /debug/vars until ctx is done. It returns an error when address cannot be
+// bound.
+func serveMetrics(ctx context.Context, address string) error {
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on metrics address '%s': %v", address, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	stopOnDone := context.AfterFunc(ctx, func() {
+		if err := server.Close(); err != nil {
+			emit.Warn.StructuredFields("Failed to close metrics server",
+				emit.ZString("error", err.Error()))
+		}
+	})
+	defer stopOnDone()
+
+	emit.Info.StructuredFields("Serving metrics",
+		emit.ZString("metrics_addr", address))
+
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		emit.Error.StructuredFields("Metrics server failed",
+			emit.ZString("error", err.Error()))
 	}
 
-	emit.Info.Msg("Shutdown complete.")
-	os.Exit(0)
+	return nil
 
 }